@@ -0,0 +1,194 @@
+package memberlist
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// admissionSweepInterval 清理空闲令牌桶的间隔
+const admissionSweepInterval = time.Minute
+
+// RateLimit 单个来源IP发送某种消息的速率限制
+type RateLimit struct {
+	// Rate 每秒允许的消息数
+	Rate float64
+	// Burst 允许的突发消息数
+	Burst int
+}
+
+// AdmissionStats 入站流量被丢弃的统计
+type AdmissionStats struct {
+	// Throttled 每种消息类型因超过速率而被丢弃的数量
+	Throttled map[MessageType]uint64
+	// Banned 因来源被封禁而丢弃的数据包、流连接数量
+	Banned uint64
+}
+
+type admissionKey struct {
+	source  string
+	msgType MessageType
+}
+
+type admissionEntry struct {
+	bucket  *pkg.TokenBucket
+	dropped uint64 // 令牌桶上次补满以来被丢弃的消息数
+}
+
+// admission 按来源IP和消息类型做准入控制
+type admission struct {
+	lock        sync.Mutex
+	entries     map[admissionKey]*admissionEntry
+	banned      map[string]time.Time // 来源 -> 解封时间
+	throttled   map[MessageType]uint64
+	bannedDrops uint64
+	lastSweep   time.Time
+}
+
+func newAdmission() *admission {
+	return &admission{
+		entries:   make(map[admissionKey]*admissionEntry),
+		banned:    make(map[string]time.Time),
+		throttled: make(map[MessageType]uint64),
+		lastSweep: time.Now(),
+	}
+}
+
+// isBanned 需要持有锁
+func (a *admission) isBanned(source string, now time.Time) bool {
+	until, ok := a.banned[source]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(a.banned, source)
+		return false
+	}
+	return true
+}
+
+// sweep 回收已经补满的令牌桶,避免大量来源撑大map;需要持有锁
+func (a *admission) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < admissionSweepInterval {
+		return
+	}
+	a.lastSweep = now
+	for k, e := range a.entries {
+		if e.bucket.Full(now) {
+			delete(a.entries, k)
+		}
+	}
+}
+
+// sourceOf 返回地址中的IP,作为限流和封禁的键
+func sourceOf(from net.Addr) string {
+	if from == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(from.String())
+	if err != nil {
+		return from.String()
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// admitSource 来源没有被封禁时返回true
+func (m *Members) admitSource(from net.Addr) bool {
+	now := time.Now()
+	a := m.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.isBanned(sourceOf(from), now) {
+		a.bannedDrops++
+		return false
+	}
+	return true
+}
+
+// admit 检查来源是否被封禁,以及该类型的消息是否超过速率;被限流时通知 Config.Admission
+func (m *Members) admit(from net.Addr, msgType MessageType) bool {
+	source := sourceOf(from)
+	now := time.Now()
+	a := m.admission
+
+	a.lock.Lock()
+	if a.isBanned(source, now) {
+		a.bannedDrops++
+		a.lock.Unlock()
+		return false
+	}
+	limit, ok := m.Config.RateLimits[msgType]
+	if !ok {
+		a.lock.Unlock()
+		return true
+	}
+	a.sweep(now)
+	k := admissionKey{source, msgType}
+	e, ok := a.entries[k]
+	if !ok {
+		e = &admissionEntry{bucket: pkg.NewTokenBucket(limit.Rate, limit.Burst, now)}
+		a.entries[k] = e
+	} else if e.bucket.Full(now) {
+		// 令牌桶已经补满,之前的丢弃不再算作该来源最近的丢弃
+		e.dropped = 0
+	}
+	if e.bucket.Allow(now) {
+		a.lock.Unlock()
+		return true
+	}
+	e.dropped++
+	dropped := e.dropped
+	a.throttled[msgType]++
+	a.lock.Unlock()
+
+	if d := m.Config.Admission; d != nil {
+		if ban := d.NotifyThrottled(from, msgType, dropped); ban > 0 {
+			m.banSource(source, ban)
+			m.Logger.Printf("[WARN] memberlist: 来源被限流后封禁 %s: %s", ban, pkg.LogAddress(from))
+		}
+	}
+	return false
+}
+
+// BanSource 在d时间内丢弃来自该IP的全部入站流量
+func (m *Members) BanSource(ip net.IP, d time.Duration) {
+	m.banSource(ip.String(), d)
+}
+
+// UnbanSource 提前解除对该IP的封禁
+func (m *Members) UnbanSource(ip net.IP) {
+	a := m.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.banned, ip.String())
+}
+
+func (m *Members) banSource(source string, d time.Duration) {
+	a := m.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	until := time.Now().Add(d)
+	if cur, ok := a.banned[source]; !ok || until.After(cur) {
+		a.banned[source] = until
+	}
+}
+
+// AdmissionStats 返回入站流量被丢弃的统计
+func (m *Members) AdmissionStats() AdmissionStats {
+	a := m.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	stats := AdmissionStats{
+		Throttled: make(map[MessageType]uint64, len(a.throttled)),
+		Banned:    a.bannedDrops,
+	}
+	for t, n := range a.throttled {
+		stats.Throttled[t] = n
+	}
+	return stats
+}
@@ -0,0 +1,243 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist/broadcast_tree"
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// AppBroadcast 通过 Members.BroadcastApp 发出的应用广播。
+// Epoch 是来源节点启动的时间,来源重启后序号从头开始
+type AppBroadcast struct {
+	Origin  string
+	Epoch   int64
+	Seq     uint64
+	Payload []byte
+}
+
+// AppVersion 版本向量中一个来源的版本,push/pull时交换
+type AppVersion struct {
+	Epoch int64
+	Seq   uint64 // 不大于Seq的广播都已经收到
+	Floor uint64 // 日志中保留的最旧的序号,更旧的无法再修复;0表示日志为空
+}
+
+// appOriginLog 一个来源最近的广播
+type appOriginLog struct {
+	epoch   int64
+	contig  uint64              // 不大于contig的广播都已经收到
+	above   map[uint64]struct{} // 收到的大于contig的序号
+	entries []*AppBroadcast     // 按序号排列
+}
+
+func (o *appOriginLog) floor() uint64 {
+	if len(o.entries) == 0 {
+		return 0
+	}
+	return o.entries[0].Seq
+}
+
+// skipTo 放弃不大于seq的缺口
+func (o *appOriginLog) skipTo(seq uint64) {
+	if seq <= o.contig {
+		return
+	}
+	o.contig = seq
+	for s := range o.above {
+		if s <= o.contig {
+			delete(o.above, s)
+		}
+	}
+	o.advance()
+}
+
+func (o *appOriginLog) advance() {
+	for {
+		if _, ok := o.above[o.contig+1]; !ok {
+			return
+		}
+		delete(o.above, o.contig+1)
+		o.contig++
+	}
+}
+
+// appLog 本节点发出和收到的应用广播日志
+type appLog struct {
+	lock    sync.Mutex
+	size    int
+	epoch   int64
+	seq     uint64
+	origins map[string]*appOriginLog
+}
+
+func newAppLog(size int) *appLog {
+	if size <= 0 {
+		size = 1
+	}
+	return &appLog{
+		size:    size,
+		epoch:   time.Now().UnixNano(),
+		origins: make(map[string]*appOriginLog),
+	}
+}
+
+// originLocked 返回来源的日志,epoch更新时丢弃旧的日志;epoch更旧时返回nil
+func (l *appLog) originLocked(name string, epoch int64) *appOriginLog {
+	o, ok := l.origins[name]
+	if ok && o.epoch > epoch {
+		return nil
+	}
+	if !ok || o.epoch < epoch {
+		o = &appOriginLog{epoch: epoch, above: make(map[uint64]struct{})}
+		l.origins[name] = o
+	}
+	return o
+}
+
+// record 记录广播,返回false表示已经收到过或者已经过期
+func (l *appLog) record(e *AppBroadcast) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	o := l.originLocked(e.Origin, e.Epoch)
+	if o == nil || e.Seq <= o.contig {
+		return false
+	}
+	if _, ok := o.above[e.Seq]; ok {
+		return false
+	}
+	o.above[e.Seq] = struct{}{}
+	o.advance()
+
+	idx := sort.Search(len(o.entries), func(i int) bool { return o.entries[i].Seq > e.Seq })
+	o.entries = append(o.entries, nil)
+	copy(o.entries[idx+1:], o.entries[idx:])
+	o.entries[idx] = e
+	if len(o.entries) > l.size {
+		o.entries = o.entries[len(o.entries)-l.size:]
+	}
+	// 缺口太多,不会再被修复
+	if len(o.above) > l.size {
+		o.skipTo(o.floor() - 1)
+	}
+	return true
+}
+
+// versions 返回版本向量
+func (l *appLog) versions() map[string]AppVersion {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	out := make(map[string]AppVersion, len(l.origins))
+	for name, o := range l.origins {
+		out[name] = AppVersion{Epoch: o.epoch, Seq: o.contig, Floor: o.floor()}
+	}
+	return out
+}
+
+// witness 根据对方的版本向量,放弃对方也无法修复的缺口
+func (l *appLog) witness(remote map[string]AppVersion) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for name, rv := range remote {
+		if rv.Floor <= 1 {
+			continue
+		}
+		if o := l.originLocked(name, rv.Epoch); o != nil && o.epoch == rv.Epoch {
+			o.skipTo(rv.Floor - 1)
+		}
+	}
+}
+
+// missing 返回对方缺少、本地日志中还有的广播
+func (l *appLog) missing(remote map[string]AppVersion) []*AppBroadcast {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var out []*AppBroadcast
+	for name, o := range l.origins {
+		rv, ok := remote[name]
+		if ok && rv.Epoch > o.epoch {
+			continue
+		}
+		for _, e := range o.entries {
+			if !ok || rv.Epoch < o.epoch || e.Seq > rv.Seq {
+				out = append(out, e)
+			}
+		}
+	}
+	return out
+}
+
+// BroadcastApp 向集群广播应用数据,接收方通过 Delegate.NotifyMsg 收到。
+// 与 Delegate.GetBroadcasts 不同,最近的 AppLogSize 条广播会保留在每个节点上,
+// 错过的节点在push/pull时只拉取缺少的部分。返回广播的序号
+func (m *Members) BroadcastApp(payload []byte) (uint64, error) {
+	l := m.appLog
+	l.lock.Lock()
+	l.seq++
+	e := &AppBroadcast{Origin: m.Config.Name, Epoch: l.epoch, Seq: l.seq, Payload: payload}
+	l.lock.Unlock()
+
+	buf, err := Encode(AppMsg, e)
+	if err != nil {
+		return 0, err
+	}
+	if limit := m.maxRequestPacket() - CompoundHeaderOverhead - CompoundOverhead; buf.Len() > limit {
+		return 0, fmt.Errorf("应用广播太大 (%d > %d)", buf.Len(), limit)
+	}
+	l.record(e)
+	m.Broadcasts.QueueBroadcast(broadcast_tree.NewUniqueBroadcast(buf.Bytes(), nil))
+	return e.Seq, nil
+}
+
+// handleAppBroadcast 处理gossip收到的应用广播:去重、继续传播、投递
+func (m *Members) handleAppBroadcast(buf []byte, from net.Addr) {
+	var e AppBroadcast
+	if err := Decode(buf, &e); err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码应用广播失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	if !m.appLog.record(&e) {
+		return
+	}
+
+	msg := make([]byte, 1, len(buf)+1)
+	msg[0] = byte(AppMsg)
+	msg = append(msg, buf...)
+	m.Broadcasts.QueueBroadcast(broadcast_tree.NewUniqueBroadcast(msg, nil))
+	m.handleUser(e.Payload, from)
+}
+
+// mergeAppLog 合并push/pull中收到的版本向量和缺少的广播,修复的广播不再gossip
+func (m *Members) mergeAppLog(versions map[string]AppVersion, entries []*AppBroadcast) {
+	m.appLog.witness(versions)
+	for _, e := range entries {
+		if m.appLog.record(e) {
+			m.handleUser(e.Payload, nil)
+		}
+	}
+}
+
+// appLogEnabled AppLogSize为0时不在push/pull中交换应用广播
+func (m *Members) appLogEnabled() bool {
+	return m.Config.AppLogSize > 0
+}
+
+// repairAppLog push/pull发起方把对方缺少的广播直接发送过去
+func (m *Members) repairAppLog(a pkg.Address, versions map[string]AppVersion) {
+	for _, e := range m.appLog.missing(versions) {
+		buf, err := Encode(AppMsg, e)
+		if err != nil {
+			m.Logger.Printf("[错误] memberlist: 编码应用广播失败: %s", err)
+			continue
+		}
+		if err := m.RawSendMsgPacket(a, nil, buf.Bytes()); err != nil {
+			m.Logger.Printf("[错误] memberlist: 发送应用广播失败 %s: %s", a.Name, err)
+			return
+		}
+	}
+}
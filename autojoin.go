@@ -0,0 +1,74 @@
+package memberlist
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/memberlist/discover"
+)
+
+// AutoJoin 立即通过 providers 发现种子节点并加入,之后每隔 AutoJoinInterval(或某个 discover.Watcher 通知变化时)
+// 在本节点孤立时重新发现并加入。返回的函数用于停止;节点停止时也会结束
+func (m *Members) AutoJoin(providers ...discover.Provider) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	changed := make(chan struct{}, 1)
+	for _, p := range providers {
+		w, ok := p.(discover.Watcher)
+		if !ok {
+			continue
+		}
+		go func(ch <-chan struct{}) {
+			for range ch {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}(w.Watch(ctx))
+	}
+
+	go func() {
+		var tick <-chan time.Time
+		if m.Config.AutoJoinInterval > 0 {
+			t := time.NewTicker(m.Config.AutoJoinInterval)
+			defer t.Stop()
+			tick = t.C
+		}
+		for {
+			m.autoJoin(ctx, providers)
+			select {
+			case <-tick:
+			case <-changed:
+			case <-ctx.Done():
+				return
+			case <-m.ShutdownCh:
+				cancel()
+				return
+			}
+		}
+	}()
+	return cancel
+}
+
+// autoJoin 只在集群中只有自己时才发现并加入
+func (m *Members) autoJoin(ctx context.Context, providers []discover.Provider) {
+	if m.NumMembers() > 1 {
+		return
+	}
+	addrs, err := discover.Discover(ctx, providers...)
+	if err != nil {
+		m.Logger.Printf("[WARN] memberlist: 发现种子节点失败: %v", err)
+		return
+	}
+	if len(addrs) == 0 {
+		m.Logger.Printf("[DEBUG] memberlist: 没有发现种子节点")
+		return
+	}
+	n, err := m.Join(addrs)
+	if err != nil {
+		m.Logger.Printf("[WARN] memberlist: 自动加入失败: %v", err)
+		return
+	}
+	m.Logger.Printf("[INFO] memberlist: 自动加入成功, 联系了 %d 个节点", n)
+}
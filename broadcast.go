@@ -40,6 +40,16 @@ func (m *Members) EncodeBroadcastNotify(node string, msgType MessageType, msg in
 
 // queueBroadcast 开始广播消息,它将被发送至配置的次数。该消息有可能被未来关于同一节点的消息所废止。
 func (m *Members) queueBroadcast(node string, msg []byte, notify chan struct{}) {
+	if d := m.takeNotify(notify); d != nil {
+		m.Broadcasts.QueueBroadcast(&trackedNamed{
+			node:   node,
+			msg:    encodeTracked(d, m.Config.Name, msg),
+			notify: notify,
+			m:      m,
+			d:      d,
+		})
+		return
+	}
 	b := &broadcast_tree.MemberlistBroadcast{Node: node, Msg: msg, Notify: notify}
 	m.Broadcasts.QueueBroadcast(b)
 }
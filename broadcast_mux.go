@@ -0,0 +1,228 @@
+package memberlist
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/memberlist/broadcast_tree"
+)
+
+// maxTopicName 主题名的最大长度,主题名以一个字节的长度前缀编码在每条消息前
+const maxTopicName = 255
+
+// BroadcastTopic 在 BroadcastMux 上注册的一个广播主题
+type BroadcastTopic struct {
+	// Name 主题名,集群中所有节点需要使用相同的名字
+	Name string
+
+	// Weight 分配每个数据包字节预算时的权重,小于等于0时按1计算
+	Weight int
+
+	// Queue 该主题的广播队列,由子系统自己向其中添加广播
+	Queue *broadcast_tree.TransmitLimitedQueue
+
+	// Handler 收到该主题的消息时调用,与 Delegate.NotifyMsg 一样不要阻塞,需要保留消息时自行复制
+	Handler func(msg []byte)
+}
+
+func (t *BroadcastTopic) weight() int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// BroadcastMux 让多个子系统共用 Config.Delegate 进行gossip。
+// 每个主题有自己的 TransmitLimitedQueue,GetBroadcasts 按权重分配字节预算,
+// 某个主题用不完的部分再分给其他主题;NotifyMsg 根据消息前缀的主题名分发给对应的Handler。
+//
+// Delegate(可以为nil)相当于一个名字为空、权重为1的主题:它的 GetBroadcasts 返回的消息以一个0字节为前缀发送,
+// 收到这样的消息时去掉前缀转发给它的 NotifyMsg。通过 SendReliable 等直接发送给 Delegate 的消息也需要加上这个0字节。
+// NodeMeta、LocalState、MergeRemoteState 直接转发给 Delegate
+type BroadcastMux struct {
+	// unknown 收到的未注册主题的消息数;放在第一个字段,保证32位平台上原子操作的对齐
+	unknown uint64
+
+	Delegate Delegate
+
+	lock   sync.RWMutex
+	topics []*BroadcastTopic
+	byName map[string]*BroadcastTopic
+	next   int // 下一次 GetBroadcasts 优先的主题,轮流优先避免总是同一个主题拿到剩余预算
+}
+
+var _ Delegate = &BroadcastMux{}
+
+// NewBroadcastMux 创建一个多路复用器,d 处理与广播无关的回调
+func NewBroadcastMux(d Delegate) *BroadcastMux {
+	return &BroadcastMux{
+		Delegate: d,
+		byName:   make(map[string]*BroadcastTopic),
+	}
+}
+
+// Register 注册一个主题
+func (x *BroadcastMux) Register(t *BroadcastTopic) error {
+	if t.Name == "" || len(t.Name) > maxTopicName {
+		return fmt.Errorf("主题名长度必须在 1 到 %d 之间", maxTopicName)
+	}
+	if t.Queue == nil {
+		return fmt.Errorf("主题 %s 没有设置Queue", t.Name)
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if _, ok := x.byName[t.Name]; ok {
+		return fmt.Errorf("主题 %s 已经注册", t.Name)
+	}
+	x.byName[t.Name] = t
+	x.topics = append(x.topics, t)
+	return nil
+}
+
+// Deregister 删除一个主题,之后收到的该主题消息会被丢弃
+func (x *BroadcastMux) Deregister(name string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if _, ok := x.byName[name]; !ok {
+		return
+	}
+	delete(x.byName, name)
+	for i, t := range x.topics {
+		if t.Name == name {
+			x.topics = append(x.topics[:i], x.topics[i+1:]...)
+			break
+		}
+	}
+	if x.next >= len(x.topics) {
+		x.next = 0
+	}
+}
+
+// Topic 返回已注册的主题
+func (x *BroadcastMux) Topic(name string) *BroadcastTopic {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.byName[name]
+}
+
+// UnknownCount 返回收到的未注册主题的消息数
+func (x *BroadcastMux) UnknownCount() uint64 {
+	return atomic.LoadUint64(&x.unknown)
+}
+
+// GetBroadcasts 先按权重把limit分给每个主题和 Delegate,再把剩余的字节依次分给还有消息的主题和 Delegate
+func (x *BroadcastMux) GetBroadcasts(overhead, limit int) [][]byte {
+	x.lock.Lock()
+	topics := make([]*BroadcastTopic, 0, len(x.topics))
+	for i := range x.topics {
+		topics = append(topics, x.topics[(x.next+i)%len(x.topics)])
+	}
+	if len(x.topics) > 0 {
+		x.next = (x.next + 1) % len(x.topics)
+	}
+	x.lock.Unlock()
+
+	// 不知道 Delegate 有没有消息,总是给它留一份
+	totalWeight := 0
+	if x.Delegate != nil {
+		totalWeight++
+	}
+	for _, t := range topics {
+		if t.Queue.NumQueued() > 0 {
+			totalWeight += t.weight()
+		}
+	}
+	if totalWeight == 0 {
+		return nil
+	}
+
+	var toSend [][]byte
+	used := 0
+	wrap := func(name string, msgs [][]byte) {
+		hdr := 1 + len(name)
+		for _, msg := range msgs {
+			buf := make([]byte, 0, hdr+len(msg))
+			buf = append(buf, byte(len(name)))
+			buf = append(buf, name...)
+			buf = append(buf, msg...)
+			toSend = append(toSend, buf)
+			used += overhead + len(buf)
+		}
+	}
+	take := func(t *BroadcastTopic, budget int) {
+		wrap(t.Name, t.Queue.GetBroadcasts(overhead+1+len(t.Name), budget))
+	}
+	takeDelegate := func(budget int) {
+		if x.Delegate != nil {
+			wrap("", x.Delegate.GetBroadcasts(overhead+1, budget))
+		}
+	}
+
+	// 按权重分配
+	for _, t := range topics {
+		if t.Queue.NumQueued() == 0 {
+			continue
+		}
+		take(t, limit*t.weight()/totalWeight)
+	}
+	takeDelegate(limit / totalWeight)
+	// 分配剩余的字节
+	for _, t := range topics {
+		if limit-used <= overhead {
+			break
+		}
+		if t.Queue.NumQueued() == 0 {
+			continue
+		}
+		take(t, limit-used)
+	}
+	if limit-used > overhead {
+		takeDelegate(limit - used)
+	}
+	return toSend
+}
+
+// NotifyMsg 根据主题名分发消息,没有主题名的消息转发给 Delegate
+func (x *BroadcastMux) NotifyMsg(buf []byte) {
+	if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+		atomic.AddUint64(&x.unknown, 1)
+		return
+	}
+	n := int(buf[0])
+	if n == 0 {
+		if x.Delegate == nil {
+			atomic.AddUint64(&x.unknown, 1)
+			return
+		}
+		x.Delegate.NotifyMsg(buf[1:])
+		return
+	}
+	t := x.Topic(string(buf[1 : 1+n]))
+	if t == nil || t.Handler == nil {
+		atomic.AddUint64(&x.unknown, 1)
+		return
+	}
+	t.Handler(buf[1+n:])
+}
+
+func (x *BroadcastMux) NodeMeta(limit int) []byte {
+	if x.Delegate == nil {
+		return nil
+	}
+	return x.Delegate.NodeMeta(limit)
+}
+
+func (x *BroadcastMux) LocalState(join bool) []byte {
+	if x.Delegate == nil {
+		return nil
+	}
+	return x.Delegate.LocalState(join)
+}
+
+func (x *BroadcastMux) MergeRemoteState(buf []byte, join bool) {
+	if x.Delegate != nil {
+		x.Delegate.MergeRemoteState(buf, join)
+	}
+}
@@ -0,0 +1,84 @@
+package broadcast_tree
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type expiringBroadcast struct {
+	MemberlistBroadcast
+	expires time.Time
+}
+
+func (b *expiringBroadcast) ExpiresAt() time.Time {
+	return b.expires
+}
+
+func TestTransmitLimited_MaxBytes(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 3, NumNodes: func() int { return 10 }, MaxBytes: 30}
+	notify := make(chan struct{}, 1)
+	q.QueueBroadcast(&MemberlistBroadcast{"old", make([]byte, 10), notify})
+
+	// 重传过一次的消息优先级最低
+	require.Len(t, q.GetBroadcasts(0, 100), 1)
+
+	q.QueueBroadcast(&MemberlistBroadcast{"a", make([]byte, 10), nil})
+	q.QueueBroadcast(&MemberlistBroadcast{"b", make([]byte, 10), nil})
+	require.Equal(t, int64(30), q.Stats().Bytes)
+
+	q.QueueBroadcast(&MemberlistBroadcast{"c", make([]byte, 5), nil})
+	st := q.Stats()
+	require.Equal(t, 3, st.Queued)
+	require.Equal(t, int64(25), st.Bytes)
+	require.Equal(t, uint64(1), st.Evicted)
+	for _, b := range q.OrderedView(false) {
+		require.NotEqual(t, "old", b.B.(*MemberlistBroadcast).Node)
+	}
+	select {
+	case <-notify:
+	default:
+		t.Fatalf("evicted broadcast not finished")
+	}
+
+	// 替换同名的消息不会重复计算字节数
+	q.QueueBroadcast(&MemberlistBroadcast{"c", make([]byte, 5), nil})
+	require.Equal(t, int64(25), q.Stats().Bytes)
+
+	q.Prune(1)
+	st = q.Stats()
+	require.Equal(t, int64(10), st.Bytes)
+	require.Equal(t, uint64(3), st.Evicted)
+
+	q.Reset()
+	require.Equal(t, int64(0), q.Stats().Bytes)
+}
+
+func TestTransmitLimited_Expire(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 3, NumNodes: func() int { return 10 }, TTL: 20 * time.Millisecond}
+	notify := make(chan struct{}, 1)
+	q.QueueBroadcast(&MemberlistBroadcast{"ttl", []byte("1"), notify})
+	q.QueueBroadcast(&expiringBroadcast{MemberlistBroadcast{"own", []byte("2"), nil}, time.Now().Add(time.Hour)})
+
+	time.Sleep(30 * time.Millisecond)
+	out := q.GetBroadcasts(0, 100)
+	require.Equal(t, []string{"'2'"}, prettyPrintMessages(out))
+
+	st := q.Stats()
+	require.Equal(t, 1, st.Queued)
+	require.Equal(t, uint64(1), st.Expired)
+	select {
+	case <-notify:
+	default:
+		t.Fatalf("expired broadcast not finished")
+	}
+}
+
+func TestTransmitLimited_NoExpire(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 3, NumNodes: func() int { return 10 }}
+	q.QueueBroadcast(&MemberlistBroadcast{"a", []byte("1"), nil})
+	time.Sleep(5 * time.Millisecond)
+	require.Len(t, q.GetBroadcasts(0, 100), 1)
+	require.Equal(t, uint64(0), q.Stats().Expired)
+}
@@ -0,0 +1,139 @@
+package broadcast_tree
+
+import "time"
+
+// 常用的广播实现,Notify不为nil时,消息不再广播后会向其中非阻塞地发送一次
+
+func notify(ch chan struct{}) {
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// KeyedMsg 按键失效的广播,新消息会使队列中与它有任意相同键的消息失效
+type KeyedMsg struct {
+	KeyList []string
+	Msg     []byte
+	Notify  chan struct{}
+}
+
+var _ KeyedBroadcast = &KeyedMsg{}
+
+// NewKeyedBroadcast 创建一个按键失效的广播
+func NewKeyedBroadcast(msg []byte, notify chan struct{}, keys ...string) *KeyedMsg {
+	return &KeyedMsg{KeyList: keys, Msg: msg, Notify: notify}
+}
+
+func (b *KeyedMsg) Keys() []string {
+	return b.KeyList
+}
+
+// Invalidates 与队列使用相同的规则:有相同的键
+func (b *KeyedMsg) Invalidates(other Broadcast) bool {
+	kb, ok := other.(KeyedBroadcast)
+	if !ok {
+		return false
+	}
+	for _, a := range b.KeyList {
+		for _, o := range kb.Keys() {
+			if a == o {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *KeyedMsg) Message() []byte {
+	return b.Msg
+}
+
+func (b *KeyedMsg) Finished() {
+	notify(b.Notify)
+}
+
+// UniqueMsg 不会使其他消息失效,也不会被其他消息失效的广播
+type UniqueMsg struct {
+	Msg    []byte
+	Notify chan struct{}
+}
+
+var _ UniqueBroadcast = &UniqueMsg{}
+
+// NewUniqueBroadcast 创建一个唯一的广播
+func NewUniqueBroadcast(msg []byte, notify chan struct{}) *UniqueMsg {
+	return &UniqueMsg{Msg: msg, Notify: notify}
+}
+
+func (b *UniqueMsg) UniqueBroadcast() {}
+
+func (b *UniqueMsg) Invalidates(other Broadcast) bool {
+	return false
+}
+
+func (b *UniqueMsg) Message() []byte {
+	return b.Msg
+}
+
+func (b *UniqueMsg) Finished() {
+	notify(b.Notify)
+}
+
+// Expire 给广播设置过期时间,返回的广播保留原来的 NamedBroadcast、KeyedBroadcast、UniqueBroadcast 语义
+func Expire(b Broadcast, at time.Time) Broadcast {
+	e := expiring{Broadcast: b, expires: at}
+	switch v := b.(type) {
+	case NamedBroadcast:
+		return &expiringNamed{e, v}
+	case KeyedBroadcast:
+		return &expiringKeyed{e, v}
+	case UniqueBroadcast:
+		return &expiringUnique{e}
+	default:
+		return &e
+	}
+}
+
+type expiring struct {
+	Broadcast
+	expires time.Time
+}
+
+func (b *expiring) ExpiresAt() time.Time {
+	return b.expires
+}
+
+func (b *expiring) Priority() Priority {
+	if pb, ok := b.Broadcast.(PrioritizedBroadcast); ok {
+		return pb.Priority()
+	}
+	return PriorityNormal
+}
+
+type expiringNamed struct {
+	expiring
+	nb NamedBroadcast
+}
+
+func (b *expiringNamed) Name() string {
+	return b.nb.Name()
+}
+
+type expiringKeyed struct {
+	expiring
+	kb KeyedBroadcast
+}
+
+func (b *expiringKeyed) Keys() []string {
+	return b.kb.Keys()
+}
+
+type expiringUnique struct {
+	expiring
+}
+
+func (b *expiringUnique) UniqueBroadcast() {}
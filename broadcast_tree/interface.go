@@ -1,6 +1,10 @@
 package broadcast_tree
 
-import "github.com/google/btree"
+import (
+	"time"
+
+	"github.com/google/btree"
+)
 
 // Broadcast 通过gossip协议发送到集群中成员
 type Broadcast interface {
@@ -23,12 +27,54 @@ type UniqueBroadcast interface {
 	UniqueBroadcast()
 }
 
+// KeyedBroadcast 带有失效键的广播。新消息会使队列中与它有相同键的消息失效,
+// 通过哈希索引查找,不需要遍历整个队列
+type KeyedBroadcast interface {
+	Broadcast
+	Keys() []string
+}
+
+// Priority 广播的优先级,GetBroadcasts 先用高优先级的消息填充数据包
+type Priority uint8
+
+const (
+	PriorityLow    Priority = iota
+	PriorityNormal          // 没有实现 PrioritizedBroadcast 的消息
+	PriorityHigh            // 成员状态消息,例如对怀疑的反驳
+	numPriorities
+)
+
+// defaultMaxStarvation 低优先级连续没有发送机会的次数上限
+const defaultMaxStarvation = 10
+
+func (p Priority) clamp() Priority {
+	if p >= numPriorities {
+		return numPriorities - 1
+	}
+	return p
+}
+
+// PrioritizedBroadcast 指定优先级的广播
+type PrioritizedBroadcast interface {
+	Broadcast
+	Priority() Priority
+}
+
+// ExpiringBroadcast 有过期时间的广播,过期后即使没有达到重传次数也会被丢弃并调用Finished
+type ExpiringBroadcast interface {
+	Broadcast
+	ExpiresAt() time.Time
+}
+
 // 被限制的广播
 type limitedBroadcast struct {
-	transmits int       // btree-key[0]: 尝试传输的次数
-	msgLen    int64     // btree-key[1]: 消息长度len(b.Message())
-	id        int64     // btree-key[2]: 提交时的唯一的递增标识
+	priority  Priority  // btree-key[0]: 优先级,高的在前
+	transmits int       // btree-key[1]: 尝试传输的次数
+	msgLen    int64     // btree-key[2]: 消息长度len(b.Message())
+	id        int64     // btree-key[3]: 提交时的唯一的递增标识
 	B         Broadcast // 广播消息
+	expires   time.Time // 过期时间,零值表示不过期
+	keys      []string  // set if Broadcast is a KeyedBroadcast
 
 	name string // set if Broadcast is a NamedBroadcast
 }
@@ -36,6 +82,11 @@ type limitedBroadcast struct {
 // Less 比较b 是不是小于 than [[1,18],[1,16],[2,1],[2,1]]
 func (b *limitedBroadcast) Less(than btree.Item) bool {
 	o := than.(*limitedBroadcast)
+	if b.priority > o.priority {
+		return true
+	} else if b.priority < o.priority {
+		return false
+	}
 	if b.transmits < o.transmits {
 		return true
 	} else if b.transmits > o.transmits {
@@ -77,6 +128,11 @@ func (b *MemberlistBroadcast) Message() []byte {
 	return b.Msg
 }
 
+// Priority 成员状态消息优先于用户数据
+func (b *MemberlistBroadcast) Priority() Priority {
+	return PriorityHigh
+}
+
 // Finished ok
 func (b *MemberlistBroadcast) Finished() {
 	// case <-notifyCh:
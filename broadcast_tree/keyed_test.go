@@ -0,0 +1,73 @@
+package broadcast_tree
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransmitLimited_Keyed(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 1, NumNodes: func() int { return 1 }}
+	n1 := make(chan struct{}, 1)
+	n2 := make(chan struct{}, 1)
+	q.QueueBroadcast(NewKeyedBroadcast([]byte("1"), n1, "a", "b"))
+	q.QueueBroadcast(NewKeyedBroadcast([]byte("2"), n2, "c"))
+	q.QueueBroadcast(NewUniqueBroadcast([]byte("3"), nil))
+	require.Equal(t, 3, q.NumQueued())
+
+	// 与第一条共享键 b
+	q.QueueBroadcast(NewKeyedBroadcast([]byte("4"), nil, "b", "d"))
+	require.Equal(t, 3, q.NumQueued())
+	select {
+	case <-n1:
+	default:
+		t.Fatalf("invalidated broadcast not finished")
+	}
+	select {
+	case <-n2:
+		t.Fatalf("unrelated broadcast finished")
+	default:
+	}
+
+	// 没有实现任何接口的广播不会使带键的消息失效
+	q.QueueBroadcast(&MemberlistBroadcast{"x", []byte("5"), nil})
+	require.Equal(t, 4, q.NumQueued())
+
+	// 发送后键索引被清理,同样的键不会误删
+	q.GetBroadcasts(0, 100)
+	require.Equal(t, 0, q.NumQueued())
+	q.QueueBroadcast(NewKeyedBroadcast([]byte("6"), nil, "c"))
+	require.Equal(t, 1, q.NumQueued())
+	require.Len(t, q.tk, 1)
+}
+
+func TestTransmitLimited_ExpireHelper(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 1, NumNodes: func() int { return 1 }}
+	past := time.Now().Add(-time.Second)
+	q.QueueBroadcast(Expire(NewKeyedBroadcast([]byte("1"), nil, "a"), past))
+	q.QueueBroadcast(Expire(&MemberlistBroadcast{"n", []byte("2"), nil}, past))
+	q.QueueBroadcast(Expire(NewUniqueBroadcast([]byte("3"), nil), time.Now().Add(time.Hour)))
+
+	// 保留原来的语义
+	q.QueueBroadcast(NewKeyedBroadcast([]byte("4"), nil, "a"))
+	q.QueueBroadcast(&MemberlistBroadcast{"n", []byte("5"), nil})
+	require.Equal(t, 3, q.NumQueued())
+
+	q.QueueBroadcast(Expire(NewKeyedBroadcast([]byte("6"), nil, "b"), past))
+	out := q.GetBroadcasts(0, 100)
+	require.ElementsMatch(t, []string{"'3'", "'4'", "'5'"}, prettyPrintMessages(out))
+	require.Equal(t, uint64(1), q.Stats().Expired)
+}
+
+func BenchmarkTransmitLimited_QueueKeyed(b *testing.B) {
+	q := &TransmitLimitedQueue{RetransmitMult: 1, NumNodes: func() int { return 1 }}
+	for i := 0; i < 10000; i++ {
+		q.QueueBroadcast(NewKeyedBroadcast(nil, nil, fmt.Sprintf("k%d", i)))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.QueueBroadcast(NewKeyedBroadcast(nil, nil, fmt.Sprintf("k%d", i%10000)))
+	}
+}
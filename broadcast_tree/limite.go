@@ -5,6 +5,13 @@ import (
 	"github.com/hashicorp/memberlist/pkg"
 	"math"
 	"sync"
+	"time"
+)
+
+// maxInt、minInt 当前平台int的上下限;transmits 是int,32位平台上不能直接用 math.MaxInt64
+const (
+	maxInt = int(^uint(0) >> 1)
+	minInt = -maxInt - 1
 )
 
 // -------------------------------------------- OK -----------------------------------------------
@@ -17,10 +24,34 @@ type TransmitLimitedQueue struct {
 	NumNodes func() int
 	// RetransmitMult 用于确定重传的最大次数的 重传系数。
 	RetransmitMult int
-	mu             sync.Mutex
-	tq             *btree.BTree                 // stores *limitedBroadcast as btree.Item
-	tm             map[string]*limitedBroadcast // 节点 --> 广播消息
-	idGen          int64
+	// MaxBytes 队列中所有消息的总字节数上限,超过时从优先级最低的消息开始丢弃;0表示不限制
+	MaxBytes int64
+	// MaxStarvation 低优先级的消息连续多少次没有机会发送后,下一次优先发送;0使用默认值,小于0表示不保护
+	MaxStarvation int
+	// TTL 没有实现 ExpiringBroadcast 的消息在队列中的最长时间,过期后丢弃;0表示不过期
+	TTL time.Duration
+
+	mu         sync.Mutex
+	tq         *btree.BTree                              // stores *limitedBroadcast as btree.Item
+	tm         map[string]*limitedBroadcast              // 节点 --> 广播消息
+	tk         map[string]map[*limitedBroadcast]struct{} // 失效键 --> 广播消息
+	idGen      int64
+	bytes      int64     // 队列中消息的总字节数
+	nextExpire time.Time // 最早的过期时间,零值表示没有会过期的消息
+	evicted    uint64
+	expired    uint64
+	counts     [numPriorities]int // 每个优先级的消息数
+	starved    [numPriorities]int // 每个优先级连续没有发送的次数
+}
+
+// QueueStats 队列的统计
+type QueueStats struct {
+	Queued int
+	Bytes  int64
+	// Evicted 因为 MaxBytes 或 Prune 被丢弃的消息数
+	Evicted uint64
+	// Expired 因为过期被丢弃的消息数
+	Expired uint64
 }
 
 // 添加消息，同时使存在的消息Finished
@@ -48,11 +79,24 @@ func (q *TransmitLimitedQueue) queueBroadcast(b Broadcast, initialTransmits int)
 		msgLen:    int64(len(b.Message())),
 		id:        id,
 		B:         b,
+		priority:  PriorityNormal,
+	}
+	if pb, ok := b.(PrioritizedBroadcast); ok {
+		lb.priority = pb.Priority().clamp()
+	}
+	if eb, ok := b.(ExpiringBroadcast); ok && !eb.ExpiresAt().IsZero() {
+		lb.expires = eb.ExpiresAt()
+	} else if q.TTL > 0 {
+		lb.expires = time.Now().Add(q.TTL)
 	}
 	unique := false
+	keyed := false
 	if nb, ok := b.(NamedBroadcast); ok {
 		var _ NamedBroadcast = &MemberlistBroadcast{}
 		lb.name = nb.Name()
+	} else if kb, ok := b.(KeyedBroadcast); ok {
+		keyed = true
+		lb.keys = kb.Keys()
 	} else if _, ok := b.(UniqueBroadcast); ok {
 		// UniqueBroadcast 没有具体实现
 		unique = true
@@ -65,6 +109,18 @@ func (q *TransmitLimitedQueue) queueBroadcast(b Broadcast, initialTransmits int)
 			old.B.Finished()
 			q.DeleteItem(old)
 		}
+	} else if keyed {
+		// 与新消息有相同键的消息都失效
+		remove := make(map[*limitedBroadcast]struct{})
+		for _, key := range lb.keys {
+			for cur := range q.tk[key] {
+				remove[cur] = struct{}{}
+			}
+		}
+		for cur := range remove {
+			cur.B.Finished()
+			q.DeleteItem(cur)
+		}
 	} else if !unique {
 		// lb.name == "" && unique == false
 		// 消息没有命名、且不是UniqueBroadcast的实现
@@ -77,6 +133,8 @@ func (q *TransmitLimitedQueue) queueBroadcast(b Broadcast, initialTransmits int)
 				// noop
 			case UniqueBroadcast:
 				// noop
+			case KeyedBroadcast:
+				// noop
 			default:
 				if b.Invalidates(cur.B) {
 					cur.B.Finished()
@@ -92,6 +150,51 @@ func (q *TransmitLimitedQueue) queueBroadcast(b Broadcast, initialTransmits int)
 
 	//入队
 	q.addItem(lb)
+	q.evictLocked()
+}
+
+// evictLocked 超过 MaxBytes 时丢弃优先级最低(重传次数最多、最旧)的消息。调用时持锁
+func (q *TransmitLimitedQueue) evictLocked() {
+	if q.MaxBytes <= 0 {
+		return
+	}
+	for q.bytes > q.MaxBytes {
+		item := q.tq.Max()
+		if item == nil {
+			break
+		}
+		cur := item.(*limitedBroadcast)
+		cur.B.Finished()
+		q.DeleteItem(cur)
+		q.evicted++
+	}
+}
+
+// expireLocked 丢弃过期的消息。只有到了最早的过期时间才遍历队列。调用时持锁
+func (q *TransmitLimitedQueue) expireLocked(now time.Time) {
+	if q.nextExpire.IsZero() || now.Before(q.nextExpire) {
+		return
+	}
+	var remove []*limitedBroadcast
+	var next time.Time
+	q.tq.Ascend(func(item btree.Item) bool {
+		cur := item.(*limitedBroadcast)
+		if cur.expires.IsZero() {
+			return true
+		}
+		if !now.Before(cur.expires) {
+			remove = append(remove, cur)
+		} else if next.IsZero() || cur.expires.Before(next) {
+			next = cur.expires
+		}
+		return true
+	})
+	for _, cur := range remove {
+		cur.B.Finished()
+		q.DeleteItem(cur)
+		q.expired++
+	}
+	q.nextExpire = next
 }
 
 // Prune 将保留maxRetain的最新信息，其余的将被丢弃。这可以用来防止无限制的队列广播大小
@@ -106,6 +209,7 @@ func (q *TransmitLimitedQueue) Prune(maxRetain int) {
 		cur := item.(*limitedBroadcast)
 		cur.B.Finished()
 		q.DeleteItem(cur)
+		q.evicted++
 	}
 }
 
@@ -129,7 +233,12 @@ func (q *TransmitLimitedQueue) Reset() {
 
 	q.tq = nil
 	q.tm = nil
+	q.tk = nil
 	q.idGen = 0
+	q.bytes = 0
+	q.nextExpire = time.Time{}
+	q.counts = [numPriorities]int{}
+	q.starved = [numPriorities]int{}
 }
 
 // NumQueued 返回入队的消息
@@ -139,6 +248,18 @@ func (q *TransmitLimitedQueue) NumQueued() int {
 	return q.lenLocked()
 }
 
+// Stats 返回队列的统计
+func (q *TransmitLimitedQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Queued:  q.lenLocked(),
+		Bytes:   q.bytes,
+		Evicted: q.evicted,
+		Expired: q.expired,
+	}
+}
+
 // lazyInit 初始化内部数据结构
 func (q *TransmitLimitedQueue) lazyInit() {
 	if q.tq == nil {
@@ -147,6 +268,9 @@ func (q *TransmitLimitedQueue) lazyInit() {
 	if q.tm == nil {
 		q.tm = make(map[string]*limitedBroadcast)
 	}
+	if q.tk == nil {
+		q.tk = make(map[string]map[*limitedBroadcast]struct{})
+	}
 }
 
 // QueueBroadcast 广播消息入队,重试次数为0
@@ -211,6 +335,10 @@ func (q *TransmitLimitedQueue) GetBroadcasts(overhead, limit int) [][]byte {
 	if q.lenLocked() == 0 {
 		return nil
 	}
+	q.expireLocked(time.Now())
+	if q.lenLocked() == 0 {
+		return nil
+	}
 	// 重试次数,根据集群规模调整重试次数
 	transmitLimit := pkg.RetransmitLimit(q.RetransmitMult, q.NumNodes())
 
@@ -222,67 +350,82 @@ func (q *TransmitLimitedQueue) GetBroadcasts(overhead, limit int) [][]byte {
 		//	获取<=指定大小的消息;如果该消息重试次数>transmitLimit,删除;否则需要重新添加到BTree
 	)
 
-	// 返回消息树中重试次数的区间
-	minTr, maxTr := q.getTransmitRange()
-	for transmits := minTr; transmits <= maxTr; /*不自动前进*/ {
-		free := int64(limit - bytesUsed - overhead) //消息体剩余的消息空间
-		if free <= 0 {
-			break //
-		}
-		// >=
-		greaterOrEqual := &limitedBroadcast{
-			transmits: transmits,
-			msgLen:    free,
-			id:        math.MaxInt64, // 消息进行比较，ID上限，为的是寻找transmits=transmits的消息
-		}
-		// <
-		lessThan := &limitedBroadcast{
-			transmits: transmits + 1,
-			msgLen:    math.MaxInt64,
-			id:        math.MaxInt64,
-		}
-		var keep *limitedBroadcast // 获取transmits次数下,消息长度远小于free的消息
-		// 升序某个范围     a<= ? < b
-		// 同一个重试次数下，数据是按照从最多到最小排布的
-		q.tq.AscendRange(greaterOrEqual, lessThan, func(item btree.Item) bool {
-			cur := item.(*limitedBroadcast)
-			// 检查这是否在我们的范围内
-			if int64(len(cur.B.Message())) > free {
-				//获取消息长度> free的消息
-				return true
+	// 按优先级从高到低填充,长期没有发送机会的低优先级先发送
+	for _, p := range q.priorityOrderLocked() {
+		queued := q.counts[p] > 0
+		sent := false
+
+		// 返回该优先级中重试次数的区间
+		minTr, maxTr := q.getTransmitRange(p)
+		for transmits := minTr; queued && transmits <= maxTr; /*不自动前进*/ {
+			free := int64(limit - bytesUsed - overhead) //消息体剩余的消息空间
+			if free <= 0 {
+				break //
+			}
+			// >=
+			greaterOrEqual := &limitedBroadcast{
+				priority:  p,
+				transmits: transmits,
+				msgLen:    free,
+				id:        math.MaxInt64, // 消息进行比较，ID上限，为的是寻找transmits=transmits的消息
+			}
+			// <
+			lessThan := &limitedBroadcast{
+				priority:  p,
+				transmits: transmits + 1,
+				msgLen:    math.MaxInt64,
+				id:        math.MaxInt64,
+			}
+			var keep *limitedBroadcast // 获取transmits次数下,消息长度远小于free的消息
+			// 升序某个范围     a<= ? < b
+			// 同一个重试次数下，数据是按照从最多到最小排布的
+			q.tq.AscendRange(greaterOrEqual, lessThan, func(item btree.Item) bool {
+				cur := item.(*limitedBroadcast)
+				// 检查这是否在我们的范围内
+				if int64(len(cur.B.Message())) > free {
+					//获取消息长度> free的消息
+					return true
+				}
+				keep = cur
+				return false
+			})
+			if keep == nil {
+				// 该transmits中不再有适当大小的消息。
+				transmits++
+				continue
 			}
-			keep = cur
-			return false
-		})
-		if keep == nil {
-			// 该transmits中不再有适当大小的消息。
-			transmits++
-			continue
-		}
-
-		msg := keep.B.Message()
 
-		// 添加到切片中，以便发送
-		bytesUsed += overhead + len(msg)
-		toSend = append(toSend, msg)
-		// 从BTree中删除该消息
-		q.DeleteItem(keep)
+			msg := keep.B.Message()
+			sent = true
+
+			// 添加到切片中，以便发送
+			bytesUsed += overhead + len(msg)
+			toSend = append(toSend, msg)
+			// 从BTree中删除该消息
+			q.DeleteItem(keep)
+
+			// 检查我们是否应该停止传输
+			// 可能因集群节点的变更，transmitLimit变小了，但是BTree中存在超过了该值的消息
+			if keep.transmits+1 >= transmitLimit {
+				// 因为次数是从0开始的
+				// 重试次数，超过了限制
+				keep.B.Finished()
+			} else {
+				// We need to bump this item down to another transmit tier, but
+				// because it would be in the same direction that we're walking the
+				// tiers, we will have to delay the reinsertion until we are
+				// finished our search. Otherwise we'll possibly re-add the message
+				// when we ascend to the next tier.
+				//如果消息重试次数，没有超过的话，还需要继续添加到BTree中，重新发送
+				keep.transmits++
+				reinsert = append(reinsert, keep)
+			}
+		}
 
-		// 检查我们是否应该停止传输
-		// 可能因集群节点的变更，transmitLimit变小了，但是BTree中存在超过了该值的消息
-		if keep.transmits+1 >= transmitLimit {
-			// 因为次数是从0开始的
-			// 重试次数，超过了限制
-			keep.B.Finished()
+		if queued && !sent {
+			q.starved[p]++
 		} else {
-			// We need to bump this item down to another transmit tier, but
-			// because it would be in the same direction that we're walking the
-			// tiers, we will have to delay the reinsertion until we are
-			// finished our search. Otherwise we'll possibly re-add the message
-			// when we ascend to the next tier.
-			//如果消息重试次数，没有超过的话，还需要继续添加到BTree中，重新发送
-			keep.transmits++
-			reinsert = append(reinsert, keep)
+			q.starved[p] = 0
 		}
 	}
 
@@ -293,29 +436,78 @@ func (q *TransmitLimitedQueue) GetBroadcasts(overhead, limit int) [][]byte {
 	return toSend
 }
 
-// 返回消息树中重试次数的区间
-// 因为消息按照重试次数进行了排序
-func (q *TransmitLimitedQueue) getTransmitRange() (minTransmit, maxTransmit int) {
-	if q.lenLocked() == 0 {
+// priorityOrderLocked 返回本次填充数据包时各优先级的顺序:
+// 连续 MaxStarvation 次有消息却没有发送的优先级排在最前,其余按优先级从高到低
+func (q *TransmitLimitedQueue) priorityOrderLocked() []Priority {
+	limit := q.MaxStarvation
+	if limit == 0 {
+		limit = defaultMaxStarvation
+	}
+	order := make([]Priority, 0, numPriorities)
+	if limit > 0 {
+		for p := PriorityLow; p < numPriorities; p++ {
+			if q.starved[p] >= limit {
+				order = append(order, p)
+			}
+		}
+	}
+	for i := int(numPriorities) - 1; i >= 0; i-- {
+		if p := Priority(i); limit <= 0 || q.starved[p] < limit {
+			order = append(order, p)
+		}
+	}
+	return order
+}
+
+// 返回某个优先级中重试次数的区间
+// 因为消息按照优先级、重试次数进行了排序
+func (q *TransmitLimitedQueue) getTransmitRange(p Priority) (minTransmit, maxTransmit int) {
+	if q.lenLocked() == 0 || q.counts[p] == 0 {
 		return 0, 0
 	}
-	minItem, maxItem := q.tq.Min(), q.tq.Max()
-	if minItem == nil || maxItem == nil {
+	var minItem, maxItem *limitedBroadcast
+	q.tq.AscendGreaterOrEqual(&limitedBroadcast{
+		priority:  p,
+		transmits: minInt,
+		msgLen:    math.MaxInt64,
+		id:        math.MaxInt64,
+	}, func(item btree.Item) bool {
+		minItem = item.(*limitedBroadcast)
+		return false
+	})
+	q.tq.DescendLessOrEqual(&limitedBroadcast{
+		priority:  p,
+		transmits: maxInt,
+		msgLen:    math.MinInt64,
+		id:        math.MinInt64,
+	}, func(item btree.Item) bool {
+		maxItem = item.(*limitedBroadcast)
+		return false
+	})
+	if minItem == nil || maxItem == nil || minItem.priority != p || maxItem.priority != p {
 		return 0, 0
 	}
 
-	min := minItem.(*limitedBroadcast).transmits
-	max := maxItem.(*limitedBroadcast).transmits
-
-	return min, max
+	return minItem.transmits, maxItem.transmits
 }
 
 // DeleteItem 删除给定的项目。你必须已经持有该mutex。
 func (q *TransmitLimitedQueue) DeleteItem(cur *limitedBroadcast) {
-	_ = q.tq.Delete(cur)
+	if q.tq.Delete(cur) != nil {
+		q.bytes -= cur.msgLen
+		q.counts[cur.priority]--
+	}
 	if cur.name != "" {
 		delete(q.tm, cur.name)
 	}
+	for _, key := range cur.keys {
+		if set, ok := q.tk[key]; ok {
+			delete(set, cur)
+			if len(set) == 0 {
+				delete(q.tk, key)
+			}
+		}
+	}
 
 	if q.tq.Len() == 0 {
 		// 在闲暇时，没有理由让idGen无限期地继续下去。
@@ -325,8 +517,22 @@ func (q *TransmitLimitedQueue) DeleteItem(cur *limitedBroadcast) {
 
 // addItem 将给定的项目添加到整个数据结构中。你必须已经持有该mutex。
 func (q *TransmitLimitedQueue) addItem(cur *limitedBroadcast) {
-	_ = q.tq.ReplaceOrInsert(cur) // 替换或插入,返回存在的或nil
+	if q.tq.ReplaceOrInsert(cur) == nil { // 替换或插入,返回存在的或nil
+		q.bytes += cur.msgLen
+		q.counts[cur.priority]++
+	}
 	if cur.name != "" {
 		q.tm[cur.name] = cur
 	}
+	for _, key := range cur.keys {
+		set, ok := q.tk[key]
+		if !ok {
+			set = make(map[*limitedBroadcast]struct{})
+			q.tk[key] = set
+		}
+		set[cur] = struct{}{}
+	}
+	if !cur.expires.IsZero() && (q.nextExpire.IsZero() || cur.expires.Before(q.nextExpire)) {
+		q.nextExpire = cur.expires
+	}
 }
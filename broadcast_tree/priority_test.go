@@ -0,0 +1,84 @@
+package broadcast_tree
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type lowBroadcast struct {
+	UniqueMsg
+}
+
+func (b *lowBroadcast) Priority() Priority {
+	return PriorityLow
+}
+
+func TestLimitedBroadcastLess_Priority(t *testing.T) {
+	high := &limitedBroadcast{priority: PriorityHigh, transmits: 5, msgLen: 1, id: 1}
+	low := &limitedBroadcast{priority: PriorityNormal, transmits: 0, msgLen: 100, id: 100}
+	require.True(t, high.Less(low))
+	require.False(t, low.Less(high))
+}
+
+func TestTransmitLimited_PriorityOrder(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 3, NumNodes: func() int { return 10 }}
+	q.QueueBroadcast(&lowBroadcast{UniqueMsg{Msg: []byte("low")}})
+	q.QueueBroadcast(NewUniqueBroadcast([]byte("user"), nil))
+	q.QueueBroadcast(&MemberlistBroadcast{"node", []byte("alive"), nil})
+
+	// 重传过的成员消息仍然排在新的用户数据之前
+	require.Equal(t, []string{"'alive'"}, prettyPrintMessages(q.GetBroadcasts(0, 5)))
+	require.Equal(t, []string{"'alive'", "'user'"}, prettyPrintMessages(q.GetBroadcasts(0, 9)))
+	require.Equal(t, []string{"'alive'", "'user'", "'low'"}, prettyPrintMessages(q.GetBroadcasts(0, 100)))
+
+	// 优先级不影响 Expire 包装
+	b := Expire(&lowBroadcast{UniqueMsg{Msg: []byte("x")}}, time.Time{})
+	require.Equal(t, PriorityLow, b.(PrioritizedBroadcast).Priority())
+}
+
+func TestTransmitLimited_Starvation(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 100, NumNodes: func() int { return 10 }, MaxStarvation: 3}
+	q.QueueBroadcast(&lowBroadcast{UniqueMsg{Msg: []byte("low")}})
+
+	lowAt := -1
+	for round := 0; round < 10; round++ {
+		// 每次都有足够填满数据包的成员消息
+		for i := 0; i < 4; i++ {
+			q.QueueBroadcast(&MemberlistBroadcast{fmt.Sprintf("n%d-%d", round, i), []byte("alive"), nil})
+		}
+		for _, msg := range q.GetBroadcasts(0, 10) {
+			if string(msg) == "low" && lowAt < 0 {
+				lowAt = round
+			}
+		}
+	}
+	require.Equal(t, 3, lowAt)
+
+	// 关闭保护后低优先级一直没有机会
+	q = &TransmitLimitedQueue{RetransmitMult: 100, NumNodes: func() int { return 10 }, MaxStarvation: -1}
+	q.QueueBroadcast(&lowBroadcast{UniqueMsg{Msg: []byte("low")}})
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 4; i++ {
+			q.QueueBroadcast(&MemberlistBroadcast{fmt.Sprintf("n%d-%d", round, i), []byte("alive"), nil})
+		}
+		for _, msg := range q.GetBroadcasts(0, 10) {
+			require.NotEqual(t, "low", string(msg))
+		}
+	}
+}
+
+// getTransmitRange 的边界值必须能放进32位平台的int
+func TestTransmitLimited_Vet386(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go vet in short mode")
+	}
+	cmd := exec.Command("go", "vet", ".")
+	cmd.Env = append(os.Environ(), "GOARCH=386")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
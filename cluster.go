@@ -1,13 +1,13 @@
 package memberlist
 
 import (
-	"container/list"
 	"fmt"
 	"github.com/hashicorp/memberlist/broadcast_tree"
 	"github.com/hashicorp/memberlist/pkg"
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 // NewMembers 创建网络监听器,只能在主线程被调度
@@ -35,6 +35,10 @@ func NewMembers(conf *Config) (*Members, error) {
 		}
 	}
 
+	if err := validateNodeID(conf.NodeID); err != nil {
+		return nil, err
+	}
+
 	if conf.LogOutput != nil && conf.Logger != nil {
 		return nil, fmt.Errorf("不能同时指定LogOutput和Logger。请选择一个单一的日志配置设置。")
 	}
@@ -114,32 +118,53 @@ func NewMembers(conf *Config) (*Members, error) {
 	}
 
 	m := &Members{
-		Config:               conf,
-		ShutdownCh:           make(chan struct{}),
-		LeaveBroadcast:       make(chan struct{}, 1), //
-		Transport:            nodeAwareTransport,
-		HandoffCh:            make(chan struct{}, 1),
-		HighPriorityMsgQueue: list.New(), // 高优先级消息队列
-		LowPriorityMsgQueue:  list.New(), // 低优先级消息队列
-		NodeMap:              make(map[string]*NodeState),
-		NodeTimers:           make(map[string]*Suspicion),
-		Awareness:            pkg.NewAwareness(conf.AwarenessMaxMultiplier), // 感知对象
-		AckHandlers:          make(map[uint32]*AckHandler),
-		Broadcasts:           &broadcast_tree.TransmitLimitedQueue{RetransmitMult: conf.RetransmitMult},
-		Logger:               Logger,
+		Config:         conf,
+		ShutdownCh:     make(chan struct{}),
+		LeaveBroadcast: make(chan struct{}, 1), //
+		Transport:      nodeAwareTransport,
+		HandoffCh:      make(chan struct{}, 1),
+		HandoffQueue:   conf.Handoff,
+		NodeMap:        make(map[string]*NodeState),
+		NodeTimers:     make(map[string]*Suspicion),
+		Awareness:      pkg.NewAwareness(conf.AwarenessMaxMultiplier), // 感知对象
+		AckHandlers:    make(map[uint32]*AckHandler),
+		reqHandlers:    make(map[uint32]*pendingRequest),
+		queryResponses: make(map[uint32]*QueryResponse),
+		querySeen:      make(map[queryKey]time.Time),
+		userEvents:     newUserEvents(conf.UserEventBuffer),
+		deliveries:     newDeliveries(),
+		appLog:         newAppLog(conf.AppLogSize),
+		conflicts:      newConflicts(),
+		reconnects:     newReconnects(),
+		partition:      newPartitionDetector(),
+		dnsCache:       pkg.NewDNSCache(),
+		health:         newHealth(),
+		Broadcasts:     &broadcast_tree.TransmitLimitedQueue{RetransmitMult: conf.RetransmitMult},
+		admission:      newAdmission(),
+		Logger:         Logger,
+	}
+	if m.HandoffQueue == nil {
+		m.HandoffQueue = NewFairHandoffScheduler(conf)
 	}
 	m.Broadcasts.NumNodes = func() int {
 		return m.EstNumNodes()
 	}
+	m.replMap = newReplicatedMap(m)
+	m.Awareness.SetNotify(m.healthChanged)
 
 	// 设置广播地址
 	if _, _, err := m.RefreshAdvertise(); err != nil {
 		return nil, err
 	}
 
+	m.startUserWorkers() // 用户消息worker
+
 	go m.StreamListen()  // push\pull模式,处理每一个tcp链接 ✅
 	go m.PacketListen()  // 从网络中接收消息
 	go m.PacketHandler() // 处理消息
+	if conf.HealthAdvertise {
+		go m.healthAdvertiseLoop() // 健康分数变化后重新广播元信息
+	}
 
 	return m, nil
 }
@@ -95,6 +95,45 @@ type Config struct {
 	// GossipToTheDeadTime node失败后，继续探测的时间
 	GossipToTheDeadTime time.Duration
 
+	// DeadNodeRetention 失败节点的墓碑在节点列表中保留的时间,超过后被移除并发出 NodeReap 事件。
+	// LeftNodeRetention 是主动离开的节点的保留时间。为0时使用 GossipToTheDeadTime
+	DeadNodeRetention time.Duration
+	LeftNodeRetention time.Duration
+
+	// ReconnectInterval 尝试与一个失败节点 push/pull 的间隔,失败后按倍数退避。默认为0,不重连;
+	// 需要网络分区恢复后自动合并时设置,例如 10s,并同时设置 ReconnectTimeout
+	ReconnectInterval time.Duration
+
+	// ReconnectTimeout 节点失败超过这个时间后不再重连,例如 24h。为0时一直重连到墓碑被移除(见 DeadNodeRetention)
+	ReconnectTimeout time.Duration
+
+	// PartitionThreshold 在 PartitionWindow 内变为 suspect/dead 的节点占 EstNumNodes 的比例达到这个值时,
+	// 认为发生了网络分区而不是大量节点故障。默认为0,不检测;开启时例如设置为 0.3
+	PartitionThreshold float64
+	PartitionWindow    time.Duration
+
+	// PartitionSuspicionMult 分区期间怀疑超时乘以这个倍数,放慢宣布死亡。小于等于1时不改变
+	PartitionSuspicionMult int
+
+	// PartitionRejoinInterval 分区期间重新 Join 第一次加入时的种子节点的间隔,直到失联的节点回来
+	PartitionRejoinInterval time.Duration
+
+	// Partition 接收分区检测与分区结束的事件
+	Partition PartitionDelegate
+
+	// Health 接收本节点健康分数的变化,见 RegisterHealthCheck
+	Health HealthDelegate
+
+	// HealthAdvertise 在节点元信息末尾附加健康分数(HealthMetaSize 字节),其他节点用 Node.HealthScore 读取。
+	// 开启后 Delegate.NodeMeta 的长度限制相应减少
+	HealthAdvertise bool
+
+	// HealthAdvertiseInterval 健康分数变化后两次重新广播之间的最小间隔
+	HealthAdvertiseInterval time.Duration
+
+	// AutoJoinInterval AutoJoin 在本节点孤立时重新发现种子节点的间隔,为0时只在启动和 Watcher 通知时尝试
+	AutoJoinInterval time.Duration
+
 	// 控制是否对gossip进行加密。它用于在运行的集群上从未加密的gossip转移到加密的gossip。
 	GossipVerifyIncoming bool
 	GossipVerifyOutgoing bool // 校验出流量; 用于出去的数据加密
@@ -121,27 +160,130 @@ type Config struct {
 	Ping     PingDelegate     // Ping 委托/实现
 	Alive    AliveDelegate    // 探活 委托/实现
 
+	// Requests 处理 Members.Request 发来的请求
+	Requests RequestHandler
+
+	// RequestTimeout ctx没有设置超时时 Members.Request 等待响应的时间,避免丢包后一直等待;为0时不限制
+	RequestTimeout time.Duration
+
+	// Queries 处理 Members.Query 发起的查询
+	Queries QueryHandler
+
+	// QueryTimeoutMult 查询的默认有效期为 GossipInterval * QueryTimeoutMult * log(N+1)
+	QueryTimeoutMult int
+
+	// QuerySizeLimit 编码后查询的最大字节数,需要能放进一个gossip包
+	QuerySizeLimit int
+
+	// QueryResponseSizeLimit 单个响应的最大字节数,超过时不发送
+	QueryResponseSizeLimit int
+
+	// UserEventCh 接收用户事件的通道,包括本节点发出的事件;需要及时取走,否则会阻塞用户消息的处理
+	UserEventCh chan<- UserEvent
+
+	// UserEventBuffer 用于去重的最近事件缓冲区大小,以逻辑时间计;更旧的事件会被丢弃
+	UserEventBuffer int
+
+	// UserEventSizeLimit 编码后用户事件的最大字节数
+	UserEventSizeLimit int
+
+	// UserEventCoalescePeriod 可合并的同名事件在这段时间内只投递最新的一个;0表示不合并投递
+	UserEventCoalescePeriod time.Duration
+
+	// DeliveryAckTimeout 带跟踪的广播停止重传后,继续接收确认的时间
+	DeliveryAckTimeout time.Duration
+
+	// AppLogSize 每个来源保留的最近应用广播数,push/pull时用于修复错过的广播;为0时push/pull不交换应用广播
+	AppLogSize int
+
+	// EnableReplicatedMap 启用复制map;关闭时写入返回错误,收到的写入被忽略,push/pull不交换复制map
+	EnableReplicatedMap bool
+
+	// MapMaxClockDrift 复制map收到的写入时间最多超前本地时钟多久,更超前的写入被丢弃;为0时不限制
+	MapMaxClockDrift time.Duration
+
+	// MapEvents 接收复制map的变化,包括本地写入;在写入或处理消息的goroutine中调用,不要阻塞
+	MapEvents MapDelegate
+
+	// ResolveConflicts 发现名字冲突时,询问其他节点并按多数决定名字属于哪个地址,落败的节点会被通知
+	ResolveConflicts bool
+
+	// ConflictVoters 名字冲突时询问的节点数
+	ConflictVoters int
+
+	// ConflictVoteTimeout 等待投票的时间
+	ConflictVoteTimeout time.Duration
+
+	// ConflictLoser 本节点在名字冲突中落败时调用;为nil时本节点停止
+	ConflictLoser ConflictLoserDelegate
+
+	// MapTombstoneTTL 复制map中删除留下的墓碑保留的时间;离线超过这个时间的节点重新加入时,被删除的键可能复活
+	MapTombstoneTTL time.Duration
+
+	// MapTombstoneGCInterval 回收过期墓碑的间隔,为0时不自动回收,只能调用 ReplicatedMap.CollectTombstones
+	MapTombstoneGCInterval time.Duration
+
 	// dns 配置文件
 	DNSConfigPath string
 
+	// DNSServer 解析种子地址使用的DNS服务器 host[:port],为空时使用 DNSConfigPath 中的第一个服务器
+	DNSServer string
+
 	LogOutput io.Writer
 
 	Logger *log.Logger
 
-	// UDP消息队列,取决于消息的大小
+	// UDP消息队列,取决于消息的大小;成员消息队列的深度,也是用户消息队列的默认深度
 	HandoffQueueDepth int
 
+	// HandoffUserQueueDepth 用户消息队列的深度,0表示与HandoffQueueDepth相同
+	HandoffUserQueueDepth int
+
+	// HandoffMembershipWeight、HandoffUserWeight 两类消息都有积压时的出队比例
+	HandoffMembershipWeight int
+	HandoffUserWeight       int
+
+	// HandoffOverflow 队列满时的丢弃策略
+	HandoffOverflow OverflowPolicy
+
+	// Handoff 自定义的移交调度器,nil时使用 FairHandoffScheduler
+	Handoff HandoffScheduler
+
+	// UserMsgWorkers 处理用户消息的worker数,成员消息始终在 PacketHandler 中按顺序处理;
+	// 0表示在处理成员消息的goroutine中直接调用NotifyMsg,默认为0
+	UserMsgWorkers int
+
+	// UserMsgWorkerQueue 每个worker的队列长度,0表示使用默认值
+	UserMsgWorkerQueue int
+
+	// UserMsgShardBySender 按发送方地址选择worker,保持同一发送方的消息顺序;否则轮询分配
+	UserMsgShardBySender bool
+
+	// UserMsgDispatchTimeout worker队列满时最多等待的时间,超时则丢弃该用户消息;0表示不等待
+	UserMsgDispatchTimeout time.Duration
+
 	// 写缓冲大小
 	UDPBufferSize int // 1400
 
 	// 控制一个死亡节点的名字可以被不同地址或端口的节点回收的时间。默认情况下，该值为0，意味着节点不能以这种方式被回收。
+	// 双方都带有 NodeID 且ID不同时,死亡节点的名字可以立即被回收
 	DeadNodeReclaimTime time.Duration
 
+	// NodeID 可选的稳定节点ID(NodeIDSize 字节,见 GenerateNodeID),由调用方持久化。
+	// 带有ID时,同一ID换了地址视为同一个节点重启,不同ID视为另一台机器
+	NodeID []byte
+
 	// RequireNodeNames 控制在发送一个消息到节点时,是否需要节点的名称。
 	RequireNodeNames bool // 默认不需要
 
 	// CIDRsAllowed nil,允许所有链接,[]拒绝所有链接
 	CIDRsAllowed []net.IPNet
+
+	// RateLimits 按来源IP和消息类型限流,没有配置的类型不限流;复合、压缩消息按拆开后的每条消息计算
+	RateLimits map[MessageType]RateLimit
+
+	// Admission 来源被限流时调用,可以临时封禁该来源
+	Admission AdmissionDelegate
 }
 
 // ParseCIDRs 解析CIDR 列表  【192.0.2.1/24】
@@ -204,9 +346,29 @@ func DefaultLANConfig() *Config {
 
 		DNSConfigPath: "/etc/resolv.conf",
 
-		HandoffQueueDepth: 1024,
-		UDPBufferSize:     1400,
-		CIDRsAllowed:      nil, // same as allow all
+		HandoffQueueDepth:       1024,
+		HandoffMembershipWeight: 4, // 成员消息优先,但不会饿死用户消息
+		HandoffUserWeight:       1,
+		RequestTimeout:          5 * time.Second,
+		QueryTimeoutMult:        16,
+		QuerySizeLimit:          1024,
+		QueryResponseSizeLimit:  1024,
+		UserEventBuffer:         512,
+		UserEventSizeLimit:      512,
+		DeliveryAckTimeout:      5 * time.Second,
+		AppLogSize:              128,
+		EnableReplicatedMap:     true,
+		MapMaxClockDrift:        time.Minute,
+		MapTombstoneTTL:         time.Hour,
+		MapTombstoneGCInterval:  time.Minute,
+		ConflictVoters:          5,
+		ConflictVoteTimeout:     time.Second,
+		PartitionWindow:         30 * time.Second,
+		PartitionRejoinInterval: 30 * time.Second,
+		AutoJoinInterval:        30 * time.Second,
+		HealthAdvertiseInterval: 5 * time.Second,
+		UDPBufferSize:           1400,
+		CIDRsAllowed:            nil, // same as allow all
 	}
 }
 
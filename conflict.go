@@ -0,0 +1,400 @@
+package memberlist
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// VoteReq 询问其他节点认为哪个地址拥有某个名字
+type VoteReq struct {
+	SeqNo uint32
+	Node  string
+}
+
+// VoteResp 对 VoteReq 的回答,Known为false表示弃权
+type VoteResp struct {
+	SeqNo uint32
+	Node  string
+	Known bool
+	Addr  []byte
+	Port  uint16
+}
+
+// VoteLost 通知名字冲突中落败的节点
+type VoteLost struct {
+	Node   string
+	Addr   []byte // 胜出的地址
+	Port   uint16
+	Winner []byte // 胜出节点的元数据
+}
+
+// ConflictResolution 一次名字冲突投票的结果
+type ConflictResolution struct {
+	Name        string
+	Winner      Node
+	Loser       Node
+	WinnerVotes int
+	LoserVotes  int
+	Abstained   int
+}
+
+// ConflictResolutionDelegate Config.Conflict 可以额外实现这个接口,接收投票的结果
+type ConflictResolutionDelegate interface {
+	NotifyConflictResolved(r *ConflictResolution)
+}
+
+// ConflictLoserDelegate 本节点在名字冲突投票中落败时调用
+type ConflictLoserDelegate interface {
+	// NotifyConflictLost 返回true表示由应用自己处理(例如换一个名字重新加入),否则本节点停止
+	NotifyConflictLost(winner *Node) bool
+}
+
+// conflicts 进行中的投票
+type conflicts struct {
+	lock     sync.Mutex
+	seq      uint32
+	voting   map[string]time.Time    // 名字 -> 可以再次投票的时间
+	pending  map[uint32]*pendingVote // 序号 -> 收集回答
+	announce time.Time               // 作为胜者可以再次重新广播的时间
+	lost     bool
+}
+
+// pendingVote 本节点发起的一次投票,只接受被询问的地址的回答
+type pendingVote struct {
+	ch     chan VoteResp
+	voters map[string]bool
+}
+
+func newConflicts() *conflicts {
+	return &conflicts{
+		voting:  make(map[string]time.Time),
+		pending: make(map[uint32]*pendingVote),
+	}
+}
+
+// cooldown 为名字开始一次投票,冷却期内返回false
+func (c *conflicts) cooldown(name string, d time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if until, ok := c.voting[name]; ok && time.Now().Before(until) {
+		return false
+	}
+	c.voting[name] = time.Now().Add(d)
+	return true
+}
+
+// askVoters 向voters询问名字属于哪个地址,返回在 ConflictVoteTimeout 内收到的回答;本节点停止时ok为false
+func (m *Members) askVoters(name string, voters []pkg.Address) (resps []VoteResp, ok bool) {
+	c := m.conflicts
+	c.lock.Lock()
+	c.seq++
+	seq := c.seq
+	p := &pendingVote{ch: make(chan VoteResp, len(voters)), voters: make(map[string]bool)}
+	for _, v := range voters {
+		p.voters[v.Addr] = true
+	}
+	c.pending[seq] = p
+	want := len(p.voters)
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, seq)
+		c.lock.Unlock()
+	}()
+
+	req := VoteReq{SeqNo: seq, Node: name}
+	for _, v := range voters {
+		if err := m.encodeAndSendMsg(v, VoteReqMsg, &req); err != nil {
+			m.Logger.Printf("[错误] memberlist: 发送冲突投票请求失败 %s: %s", v.Addr, err)
+		}
+	}
+
+	timeout := time.After(m.Config.ConflictVoteTimeout)
+	for len(resps) < want {
+		select {
+		case resp := <-p.ch:
+			resps = append(resps, resp)
+		case <-timeout:
+			return resps, true
+		case <-m.ShutdownCh:
+			return nil, false
+		}
+	}
+	return resps, true
+}
+
+// startConflictVote 在AliveNode中发现冲突时调用,持有NodeLock,不能阻塞
+func (m *Members) startConflictVote(existing, other Node) {
+	if !m.Config.ResolveConflicts {
+		return
+	}
+	// 投票结束后一段时间内不再为同一个名字投票,避免冒名者的消息反复触发
+	if !m.conflicts.cooldown(existing.Name, 10*m.Config.ConflictVoteTimeout) {
+		return
+	}
+	go m.resolveConflict(existing, other, nil)
+}
+
+// resolveConflict 询问一部分节点,多数认为拥有名字的地址胜出;平票时保留已有的地址。
+// voters为nil时随机选择
+func (m *Members) resolveConflict(existing, other Node, voters []Node) {
+	name := existing.Name
+	if voters == nil {
+		voters = m.conflictVoters(name)
+	}
+
+	addrs := make([]pkg.Address, 0, len(voters))
+	for _, v := range voters {
+		addrs = append(addrs, v.FullAddress())
+	}
+	resps, ok := m.askVoters(name, addrs)
+	if !ok {
+		return
+	}
+
+	// 本节点的看法也算一票
+	r := &ConflictResolution{Name: name, Winner: existing, Loser: other, WinnerVotes: 1}
+	r.Abstained = len(voters) - len(resps)
+	for _, resp := range resps {
+		switch {
+		case !resp.Known:
+			r.Abstained++
+		case sameAddr(resp.Addr, resp.Port, existing):
+			r.WinnerVotes++
+		case sameAddr(resp.Addr, resp.Port, other):
+			r.LoserVotes++
+		default:
+			r.Abstained++
+		}
+	}
+	if r.LoserVotes > r.WinnerVotes {
+		r.Winner, r.Loser = other, existing
+		r.WinnerVotes, r.LoserVotes = r.LoserVotes, r.WinnerVotes
+		m.applyConflictWinner(existing, other)
+	}
+	m.Logger.Printf("[INFO] memberlist: 名字冲突 %s 投票结果: %v:%d 胜出 (%d:%d, 弃权 %d)",
+		name, net.IP(r.Winner.Addr), r.Winner.Port, r.WinnerVotes, r.LoserVotes, r.Abstained)
+
+	lost := VoteLost{Node: name, Addr: r.Winner.Addr, Port: r.Winner.Port, Winner: r.Winner.Meta}
+	if name == m.Config.Name && m.isLocalAddr(r.Loser) {
+		m.conflictLost(&lost)
+	} else {
+		// 落败的节点与胜出的节点同名,只按地址发送
+		a := pkg.Address{Addr: r.Loser.Address()}
+		if err := m.encodeAndSendMsg(a, VoteLostMsg, &lost); err != nil {
+			m.Logger.Printf("[错误] memberlist: 通知冲突落败的节点失败 %s: %s", a.Addr, err)
+		}
+	}
+
+	if d, ok := m.Config.Conflict.(ConflictResolutionDelegate); ok {
+		d.NotifyConflictResolved(r)
+	}
+}
+
+// applyConflictWinner 采用多数节点的看法,只在本地改写地址,不增加incarnation也不广播:
+// 只有节点自己可以增加它的incarnation。随后通知胜出的节点,由它以更高的incarnation重新广播。
+// 本节点的地址不能被改写
+func (m *Members) applyConflictWinner(existing, winner Node) {
+	name := existing.Name
+	if name == m.Config.Name {
+		return
+	}
+	m.NodeLock.Lock()
+	state, ok := m.NodeMap[name]
+	if ok && sameAddr(state.Addr, state.Port, existing) {
+		state.Addr = winner.Addr
+		state.Port = winner.Port
+		state.Meta = winner.Meta
+		if len(winner.ID) > 0 {
+			state.ID = winner.ID
+		}
+		if m.Config.Events != nil {
+			m.Config.Events.NotifyUpdate(&state.Node)
+		}
+	}
+	m.NodeLock.Unlock()
+
+	// 发给胜者的 VoteLost 中胜出的地址就是它自己,它据此重新广播
+	lost := VoteLost{Node: name, Addr: winner.Addr, Port: winner.Port, Winner: winner.Meta}
+	a := pkg.Address{Addr: winner.Address(), Name: name}
+	if err := m.encodeAndSendMsg(a, VoteLostMsg, &lost); err != nil {
+		m.Logger.Printf("[错误] memberlist: 通知冲突胜出的节点失败 %s: %s", a.Addr, err)
+	}
+}
+
+// reannounce 本节点在冲突投票中胜出,以更高的incarnation重新广播;限制频率,避免伪造的包反复触发
+func (m *Members) reannounce() {
+	c := m.conflicts
+	c.lock.Lock()
+	if time.Now().Before(c.announce) {
+		c.lock.Unlock()
+		return
+	}
+	c.announce = time.Now().Add(10 * m.Config.ConflictVoteTimeout)
+	c.lock.Unlock()
+	m.broadcastSelf(nil)
+}
+
+// conflictVoters 随机选择投票的节点。KRandomNodes 在小集群里可能选不满,这里从全部候选中抽取
+func (m *Members) conflictVoters(name string) []Node {
+	m.NodeLock.RLock()
+	defer m.NodeLock.RUnlock()
+	var candidates []Node
+	for _, n := range m.Nodes {
+		if n.Name != m.Config.Name && n.Name != name && n.State == StateAlive {
+			candidates = append(candidates, n.Node)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > m.Config.ConflictVoters {
+		candidates = candidates[:m.Config.ConflictVoters]
+	}
+	return candidates
+}
+
+func sameAddr(addr []byte, port uint16, n Node) bool {
+	return bytes.Equal(addr, n.Addr) && port == n.Port
+}
+
+func (m *Members) isLocalAddr(n Node) bool {
+	addr, port := m.getAdvertise()
+	return sameAddr(addr, port, n)
+}
+
+// handleVoteReq 回答本节点认为拥有名字的地址
+func (m *Members) handleVoteReq(buf []byte, from net.Addr) {
+	if !m.Config.ResolveConflicts {
+		return
+	}
+	var req VoteReq
+	if err := Decode(buf, &req); err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码冲突投票请求失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	resp := VoteResp{SeqNo: req.SeqNo, Node: req.Node}
+	m.NodeLock.RLock()
+	if state, ok := m.NodeMap[req.Node]; ok && !state.DeadOrLeft() {
+		resp.Known = true
+		resp.Addr = state.Addr
+		resp.Port = state.Port
+	}
+	m.NodeLock.RUnlock()
+
+	if err := m.encodeAndSendMsg(pkg.Address{Addr: from.String()}, VoteRespMsg, &resp); err != nil {
+		m.Logger.Printf("[错误] memberlist: 发送冲突投票失败: %s %s", err, pkg.LogAddress(from))
+	}
+}
+
+func (m *Members) handleVoteResp(buf []byte, from net.Addr) {
+	if !m.Config.ResolveConflicts {
+		return
+	}
+	var resp VoteResp
+	if err := Decode(buf, &resp); err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码冲突投票失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	c := m.conflicts
+	c.lock.Lock()
+	p, ok := c.pending[resp.SeqNo]
+	if ok && from != nil {
+		// 每个被询问的地址只算一票
+		ok = p.voters[from.String()]
+		delete(p.voters, from.String())
+	}
+	c.lock.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case p.ch <- resp:
+	default:
+	}
+}
+
+func (m *Members) handleVoteLost(buf []byte, from net.Addr) {
+	if !m.Config.ResolveConflicts || from == nil {
+		return
+	}
+	var lost VoteLost
+	if err := Decode(buf, &lost); err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码冲突投票结果失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	// 只处理关于本节点的通知;胜出的地址是本节点时重新广播,让持有旧地址的节点更新
+	if lost.Node != m.Config.Name {
+		return
+	}
+	addr, port := m.getAdvertise()
+	if bytes.Equal(addr, lost.Addr) && port == lost.Port {
+		m.reannounce()
+		return
+	}
+	if !m.conflicts.cooldown(lost.Node, 10*m.Config.ConflictVoteTimeout) {
+		return
+	}
+	go m.confirmConflictLost(&lost, from)
+}
+
+// confirmConflictLost 落败通知只是一个提示:本节点自己询问发送者和已知的节点,
+// 多数认为名字属于胜出的地址时才算落败,单个未经询问的包不会让本节点停止
+func (m *Members) confirmConflictLost(lost *VoteLost, from net.Addr) {
+	voters := []pkg.Address{{Addr: from.String()}}
+	for _, v := range m.conflictVoters(lost.Node) {
+		if a := v.FullAddress(); a.Addr != from.String() {
+			voters = append(voters, a)
+		}
+	}
+	resps, ok := m.askVoters(lost.Node, voters)
+	if !ok {
+		return
+	}
+
+	winner := Node{Addr: lost.Addr, Port: lost.Port}
+	local := Node{}
+	local.Addr, local.Port = m.getAdvertise()
+	lose, keep := 0, 0
+	for _, resp := range resps {
+		switch {
+		case !resp.Known:
+		case sameAddr(resp.Addr, resp.Port, winner):
+			lose++
+		case sameAddr(resp.Addr, resp.Port, local):
+			keep++
+		}
+	}
+	if lose <= keep {
+		m.Logger.Printf("[WARN] memberlist: 忽略名字 %s 的冲突落败通知 %s,确认投票 %d:%d",
+			lost.Node, pkg.LogAddress(from), lose, keep)
+		return
+	}
+	m.conflictLost(lost)
+}
+
+// conflictLost 本节点落败:交给 ConflictLoser 处理,否则停止
+func (m *Members) conflictLost(lost *VoteLost) {
+	c := m.conflicts
+	c.lock.Lock()
+	if c.lost {
+		c.lock.Unlock()
+		return
+	}
+	c.lost = true
+	c.lock.Unlock()
+
+	winner := &Node{Name: lost.Node, Addr: lost.Addr, Port: lost.Port, Meta: lost.Winner}
+	m.Logger.Printf("[WARN] memberlist: 名字 %s 冲突投票落败,胜出的地址 %v:%d", lost.Node, net.IP(lost.Addr), lost.Port)
+	if d := m.Config.ConflictLoser; d != nil && d.NotifyConflictLost(winner) {
+		return
+	}
+	if err := m.SetShutdown(); err != nil {
+		m.Logger.Printf("[错误] memberlist: 冲突落败后停止失败: %s", err)
+	}
+}
@@ -1,6 +1,9 @@
 package memberlist
 
-import "time"
+import (
+	"net"
+	"time"
+)
 
 // Delegate is the interface that clients must implement if they want to hook
 // into the gossip layer of Members. All the methods must be thread-safe,
@@ -67,6 +70,43 @@ type AliveDelegate interface {
 	NotifyAlive(peer *Node) error
 }
 
+// RequestHandler 处理其他节点通过 Members.Request 发来的请求。
+// 和NotifyMsg一样在处理用户消息的goroutine中调用,不要长时间阻塞
+type RequestHandler interface {
+	// HandleRequest from是请求方的名字;返回的错误会作为请求方的错误返回
+	HandleRequest(from string, payload []byte) ([]byte, error)
+}
+
+// QueryHandler 处理通过 Members.Query 发起、匹配本节点的查询。
+// 在处理用户消息的goroutine中调用,不要长时间阻塞
+type QueryHandler interface {
+	// HandleQuery origin是发起查询的节点;返回nil表示不响应
+	HandleQuery(origin, name string, payload []byte) []byte
+}
+
+// MapDelegate 接收复制map的变化
+type MapDelegate interface {
+	// NotifyMapChange 键被写入或删除,并且胜过了本地的值时调用
+	NotifyMapChange(e MapEvent)
+}
+
+// AdmissionDelegate 用于处理被限流的来源
+type AdmissionDelegate interface {
+	// NotifyThrottled 在来源的某种消息被限流丢弃时调用,dropped是该来源的令牌桶上次补满以来被丢弃的该类型消息数;
+	// 返回大于0的时间,则在这段时间内丢弃该来源的全部入站流量
+	NotifyThrottled(from net.Addr, msgType MessageType, dropped uint64) time.Duration
+}
+
+// PartitionDelegate 接收分区检测的事件,在分区处理的goroutine中按顺序调用
+type PartitionDelegate interface {
+	NotifyPartition(e PartitionEvent)
+}
+
+// HealthDelegate 接收本节点健康分数(Awareness)的变化,可能在多个goroutine中并发调用
+type HealthDelegate interface {
+	NotifyHealth(old, new int)
+}
+
 // EventDelegate is a simpler delegate that is used only to receive
 // notifications about members joining and leaving. The methods in this
 // delegate may be called by multiple goroutines, but never concurrently.
@@ -94,6 +134,9 @@ type EventDelegate interface {
 // the channel, since this delegate will block until an event can be sent.
 type ChannelEventDelegate struct {
 	Ch chan<- NodeEvent
+
+	// Reap 为true时墓碑被移除也会发送 NodeReap 事件,默认不发送
+	Reap bool
 }
 
 // NodeEventType are the types of events that can be sent from the
@@ -104,6 +147,7 @@ const (
 	NodeJoin NodeEventType = iota
 	NodeLeave
 	NodeUpdate
+	NodeReap // 墓碑被移除,需要设置 ChannelEventDelegate.Reap
 )
 
 // NodeEvent is a single event related to node activity in the memberlist.
@@ -129,3 +173,11 @@ func (c *ChannelEventDelegate) NotifyUpdate(n *Node) {
 	node := *n
 	c.Ch <- NodeEvent{NodeUpdate, &node}
 }
+
+func (c *ChannelEventDelegate) NotifyReap(t *Tombstone) {
+	if !c.Reap {
+		return
+	}
+	node := t.Node
+	c.Ch <- NodeEvent{NodeReap, &node}
+}
@@ -0,0 +1,481 @@
+package memberlist
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist/broadcast_tree"
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// DeliveryMode 广播的送达跟踪方式
+type DeliveryMode int
+
+const (
+	// DeliverySent 只记录每次重传发给了哪些节点
+	DeliverySent DeliveryMode = iota
+	// DeliveryAck 接收方通过捎带的确认消息确认收到
+	DeliveryAck
+)
+
+// DeliveryAllAlive 作为 Delivery.Wait 的k,表示等待所有存活的节点
+const DeliveryAllAlive = 0
+
+const (
+	trackedMinProtocol = 6         // 认识 TrackedMsg 的最小协议版本(PMax)
+	trackedHeaderSize  = 1 + 8 + 2 // 标志 + ID + 来源节点名长度
+	trackedFlagAck     = 1 << 0
+	maxAcksPerPacket   = 64 // 一个数据包中最多捎带的确认数
+)
+
+// DeliveryAcks 对带跟踪的广播的确认,批量确认同一个来源的多条广播
+type DeliveryAcks struct {
+	From string
+	IDs  []uint64
+}
+
+// Delivery 一条广播的送达情况
+type Delivery struct {
+	ID   uint64
+	Mode DeliveryMode
+
+	m        *Members
+	lock     sync.Mutex
+	sent     map[string]int      // 节点 -> 发送次数
+	acked    map[string]struct{} // 确认收到的节点
+	finished bool                // 不再重传
+	closed   bool                // 不再接收确认
+	changeCh chan struct{}       // 每次变化时关闭并替换
+}
+
+// SentTo 返回每个节点被发送的次数
+func (d *Delivery) SentTo() map[string]int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	out := make(map[string]int, len(d.sent))
+	for k, v := range d.sent {
+		out[k] = v
+	}
+	return out
+}
+
+// AckedBy 返回确认收到的节点
+func (d *Delivery) AckedBy() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return sortedNames(d.acked)
+}
+
+// Seen 返回看到这条广播的节点:DeliveryAck 模式下是确认的节点,否则是发送过的节点
+func (d *Delivery) Seen() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.Mode == DeliveryAck {
+		return sortedNames(d.acked)
+	}
+	seen := make(map[string]struct{}, len(d.sent))
+	for k := range d.sent {
+		seen[k] = struct{}{}
+	}
+	return sortedNames(seen)
+}
+
+// Finished 是否已经不再重传
+func (d *Delivery) Finished() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.finished
+}
+
+// Wait 等待至少k个节点看到这条广播;k为 DeliveryAllAlive 时等待当前所有存活的其他节点。
+// 广播结束并且不再接收确认后仍然不满足时返回错误
+func (d *Delivery) Wait(ctx context.Context, k int) error {
+	poll := d.m.Config.GossipInterval
+	if poll <= 0 {
+		poll = 100 * time.Millisecond
+	}
+	for {
+		var alive []string
+		if k == DeliveryAllAlive {
+			alive = d.m.aliveOthers()
+		}
+
+		d.lock.Lock()
+		seen := d.sent
+		if d.Mode == DeliveryAck {
+			seen = make(map[string]int, len(d.acked))
+			for name := range d.acked {
+				seen[name] = 1
+			}
+		}
+		ok := len(seen) >= k
+		if k == DeliveryAllAlive {
+			for _, name := range alive {
+				if _, found := seen[name]; !found {
+					ok = false
+					break
+				}
+			}
+		}
+		num, closed, ch := len(seen), d.closed, d.changeCh
+		d.lock.Unlock()
+
+		if ok {
+			return nil
+		}
+		if closed {
+			return fmt.Errorf("广播 %d 已经结束,只有 %d 个节点看到", d.ID, num)
+		}
+		select {
+		case <-ch:
+		case <-time.After(poll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// changedLocked 唤醒等待的调用方。调用时持锁
+func (d *Delivery) changedLocked() {
+	close(d.changeCh)
+	d.changeCh = make(chan struct{})
+}
+
+func sortedNames(set map[string]struct{}) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// deliveries 本节点发出的带跟踪的广播,以及待发送给其他节点的确认
+type deliveries struct {
+	lock   sync.Mutex
+	seq    uint64
+	byID   map[uint64]*Delivery
+	notify map[chan struct{}]*Delivery // 正在入队的成员消息的通知通道 -> 跟踪
+	acks   map[string][]uint64         // 来源节点 -> 待确认的广播ID
+}
+
+func newDeliveries() *deliveries {
+	return &deliveries{
+		byID:   make(map[uint64]*Delivery),
+		notify: make(map[chan struct{}]*Delivery),
+		acks:   make(map[string][]uint64),
+	}
+}
+
+// newDelivery 创建一个跟踪,notify不为nil时,下一条使用该通知通道入队的成员消息会被跟踪
+func (m *Members) newDelivery(mode DeliveryMode, notify chan struct{}) *Delivery {
+	t := m.deliveries
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.seq++
+	d := &Delivery{
+		ID:       t.seq,
+		Mode:     mode,
+		m:        m,
+		sent:     make(map[string]int),
+		acked:    make(map[string]struct{}),
+		changeCh: make(chan struct{}),
+	}
+	t.byID[d.ID] = d
+	if notify != nil {
+		t.notify[notify] = d
+	}
+	return d
+}
+
+// takeNotify 取出与通知通道关联的跟踪
+func (m *Members) takeNotify(notify chan struct{}) *Delivery {
+	if notify == nil {
+		return nil
+	}
+	t := m.deliveries
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	d, ok := t.notify[notify]
+	if ok {
+		delete(t.notify, notify)
+	}
+	return d
+}
+
+func (m *Members) lookupDelivery(id uint64) *Delivery {
+	t := m.deliveries
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.byID[id]
+}
+
+// finishDelivery 广播不再重传;在 DeliveryAckTimeout 之后不再接收确认
+func (m *Members) finishDelivery(d *Delivery) {
+	d.lock.Lock()
+	if d.finished {
+		d.lock.Unlock()
+		return
+	}
+	d.finished = true
+	d.changedLocked()
+	d.lock.Unlock()
+
+	time.AfterFunc(m.Config.DeliveryAckTimeout, func() {
+		t := m.deliveries
+		t.lock.Lock()
+		delete(t.byID, d.ID)
+		t.lock.Unlock()
+
+		d.lock.Lock()
+		d.closed = true
+		d.changedLocked()
+		d.lock.Unlock()
+	})
+}
+
+// trackedNamed 带跟踪的成员消息,与 MemberlistBroadcast 一样按节点名失效
+type trackedNamed struct {
+	node   string
+	msg    []byte
+	notify chan struct{}
+	m      *Members
+	d      *Delivery
+}
+
+func (b *trackedNamed) Name() string {
+	return b.node
+}
+
+func (b *trackedNamed) Invalidates(other broadcast_tree.Broadcast) bool {
+	return false
+}
+
+func (b *trackedNamed) Message() []byte {
+	return b.msg
+}
+
+func (b *trackedNamed) Priority() broadcast_tree.Priority {
+	return broadcast_tree.PriorityHigh
+}
+
+func (b *trackedNamed) Finished() {
+	b.m.finishDelivery(b.d)
+	if b.notify != nil {
+		select {
+		case b.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// trackedUnique 带跟踪的用户数据
+type trackedUnique struct {
+	msg []byte
+	m   *Members
+	d   *Delivery
+}
+
+func (b *trackedUnique) UniqueBroadcast() {}
+
+func (b *trackedUnique) Invalidates(other broadcast_tree.Broadcast) bool {
+	return false
+}
+
+func (b *trackedUnique) Message() []byte {
+	return b.msg
+}
+
+func (b *trackedUnique) Finished() {
+	b.m.finishDelivery(b.d)
+}
+
+// encodeTracked 给消息加上跟踪头: 类型 | 标志 | ID | 来源节点名长度 | 来源节点名 | 原消息
+func encodeTracked(d *Delivery, origin string, inner []byte) []byte {
+	buf := make([]byte, 1+trackedHeaderSize, 1+trackedHeaderSize+len(origin)+len(inner))
+	buf[0] = byte(TrackedMsg)
+	if d.Mode == DeliveryAck {
+		buf[1] = trackedFlagAck
+	}
+	binary.BigEndian.PutUint64(buf[2:10], d.ID)
+	binary.BigEndian.PutUint16(buf[10:12], uint16(len(origin)))
+	buf = append(buf, origin...)
+	return append(buf, inner...)
+}
+
+// decodeTracked buf不包含类型字节
+func decodeTracked(buf []byte) (id uint64, ack bool, origin string, inner []byte, err error) {
+	if len(buf) < trackedHeaderSize {
+		return 0, false, "", nil, fmt.Errorf("跟踪头太短")
+	}
+	ack = buf[0]&trackedFlagAck != 0
+	id = binary.BigEndian.Uint64(buf[1:9])
+	n := int(binary.BigEndian.Uint16(buf[9:11]))
+	if len(buf) < trackedHeaderSize+n {
+		return 0, false, "", nil, fmt.Errorf("跟踪头被截断")
+	}
+	origin = string(buf[trackedHeaderSize : trackedHeaderSize+n])
+	return id, ack, origin, buf[trackedHeaderSize+n:], nil
+}
+
+// BroadcastTracked 向集群广播用户数据,接收方通过 Delegate.NotifyMsg 收到;返回的跟踪可以用于等待送达
+func (m *Members) BroadcastTracked(payload []byte, mode DeliveryMode) (*Delivery, error) {
+	if len(m.Config.Name) > 0xffff {
+		return nil, fmt.Errorf("节点名太长")
+	}
+	inner := make([]byte, 1, len(payload)+1)
+	inner[0] = byte(UserMsg)
+	inner = append(inner, payload...)
+
+	d := m.newDelivery(mode, nil)
+	m.Broadcasts.QueueBroadcast(&trackedUnique{msg: encodeTracked(d, m.Config.Name, inner), m: m, d: d})
+	return d, nil
+}
+
+// recordSent 记录发给peer的数据包中带跟踪的广播。peer 的协议版本不认识 TrackedMsg 时
+// 去掉跟踪头只发送原消息,这样老版本的节点仍然能收到 Alive、Dead;这些节点不会发送确认
+func (m *Members) recordSent(peer string, msgs [][]byte) [][]byte {
+	if peer == "" {
+		return msgs
+	}
+	m.NodeLock.RLock()
+	state, ok := m.NodeMap[peer]
+	tracking := ok && state.PMax >= trackedMinProtocol
+	m.NodeLock.RUnlock()
+
+	for i, msg := range msgs {
+		if len(msg) < 1 || MessageType(msg[0]) != TrackedMsg {
+			continue
+		}
+		id, _, _, inner, err := decodeTracked(msg[1:])
+		if err != nil {
+			continue
+		}
+		if !tracking {
+			msgs[i] = inner
+		}
+		if d := m.lookupDelivery(id); d != nil {
+			d.lock.Lock()
+			d.sent[peer]++
+			d.changedLocked()
+			d.lock.Unlock()
+		}
+	}
+	return msgs
+}
+
+// handleTracked 处理带跟踪的消息,需要时记下待发送的确认,然后按原消息处理
+func (m *Members) handleTracked(buf []byte, from net.Addr, timestamp time.Time) {
+	id, ack, origin, inner, err := decodeTracked(buf)
+	if err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码跟踪消息失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	if ack && origin != m.Config.Name {
+		t := m.deliveries
+		t.lock.Lock()
+		t.acks[origin] = append(t.acks[origin], id)
+		t.lock.Unlock()
+	}
+	m.HandleCommand(inner, from, timestamp)
+}
+
+// handleDeliveryAck 处理其他节点的确认
+func (m *Members) handleDeliveryAck(buf []byte, from net.Addr) {
+	var ack DeliveryAcks
+	if err := Decode(buf, &ack); err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码广播确认失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	for _, id := range ack.IDs {
+		d := m.lookupDelivery(id)
+		if d == nil {
+			continue
+		}
+		d.lock.Lock()
+		if _, ok := d.acked[ack.From]; !ok {
+			d.acked[ack.From] = struct{}{}
+			d.changedLocked()
+		}
+		d.lock.Unlock()
+	}
+}
+
+// takeDeliveryAcks 取出发给origin的确认,编码后用于捎带;没有时返回nil
+func (m *Members) takeDeliveryAcks(origin string) []byte {
+	t := m.deliveries
+	t.lock.Lock()
+	ids := t.acks[origin]
+	if len(ids) == 0 {
+		t.lock.Unlock()
+		return nil
+	}
+	if len(ids) > maxAcksPerPacket {
+		t.acks[origin] = ids[maxAcksPerPacket:]
+		ids = ids[:maxAcksPerPacket]
+	} else {
+		delete(t.acks, origin)
+	}
+	t.lock.Unlock()
+
+	buf, err := Encode(TrackAckMsg, &DeliveryAcks{From: m.Config.Name, IDs: ids})
+	if err != nil {
+		m.Logger.Printf("[错误] memberlist: 编码广播确认失败: %s", err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// flushDeliveryAcks 没有机会捎带的确认直接发送给来源节点
+func (m *Members) flushDeliveryAcks() {
+	t := m.deliveries
+	t.lock.Lock()
+	origins := make([]string, 0, len(t.acks))
+	for origin := range t.acks {
+		origins = append(origins, origin)
+	}
+	t.lock.Unlock()
+
+	for _, origin := range origins {
+		m.NodeLock.RLock()
+		// 离开的节点也需要确认,例如 LeaveTracked
+		state, ok := m.NodeMap[origin]
+		var node Node
+		if ok {
+			node = state.Node
+		}
+		m.NodeLock.RUnlock()
+
+		for {
+			buf := m.takeDeliveryAcks(origin)
+			if buf == nil {
+				break
+			}
+			if node.Name == "" {
+				continue // 不认识的来源,丢弃
+			}
+			if err := m.RawSendMsgPacket(node.FullAddress(), &node, buf); err != nil {
+				m.Logger.Printf("[错误] memberlist: 发送广播确认失败 %s: %s", node.Name, err)
+				break
+			}
+		}
+	}
+}
+
+// aliveOthers 返回其他存活节点的名字
+func (m *Members) aliveOthers() []string {
+	m.NodeLock.RLock()
+	defer m.NodeLock.RUnlock()
+	var out []string
+	for _, n := range m.Nodes {
+		if n.Name != m.Config.Name && n.State == StateAlive {
+			out = append(out, n.Name)
+		}
+	}
+	return out
+}
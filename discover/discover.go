@@ -0,0 +1,101 @@
+// Package discover 提供发现种子节点的方式,结果可以直接传给 Members.Join
+package discover
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// DefaultTimeout ctx没有设置超时时,每个 Provider 最多运行的时间
+const DefaultTimeout = 30 * time.Second
+
+// Provider 返回一组种子地址,格式与 Join 的参数相同: host、host:port 或 name/host:port
+type Provider interface {
+	Addrs(ctx context.Context) ([]string, error)
+	String() string
+}
+
+// Watcher Provider 可以额外实现这个接口,在结果可能变化时通知,不必等到下一次定期发现
+type Watcher interface {
+	// Watch 返回的channel在结果可能变化时收到通知,ctx结束后关闭
+	Watch(ctx context.Context) <-chan struct{}
+}
+
+// Static 固定的地址列表
+type Static []string
+
+func (s Static) Addrs(context.Context) ([]string, error) {
+	return append([]string(nil), s...), nil
+}
+
+func (s Static) String() string {
+	return fmt.Sprintf("static%v", []string(s))
+}
+
+// Discover 依次询问所有 Provider,合并去重。只要有一个成功就不返回错误。
+// ctx没有设置超时时每个 Provider 使用 DefaultTimeout
+func Discover(ctx context.Context, providers ...Provider) ([]string, error) {
+	var out []string
+	var errs error
+	seen := make(map[string]struct{})
+	ok := false
+	for _, p := range providers {
+		pctx, cancel := withDefaultTimeout(ctx, DefaultTimeout)
+		addrs, err := p.Addrs(pctx)
+		cancel()
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", p, err))
+			continue
+		}
+		ok = true
+		for _, a := range addrs {
+			if _, dup := seen[a]; dup {
+				continue
+			}
+			seen[a] = struct{}{}
+			out = append(out, a)
+		}
+	}
+	if ok {
+		errs = nil
+	}
+	return out, errs
+}
+
+// withDefaultTimeout ctx没有设置超时时加上d
+func withDefaultTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// parse 解析文件或命令输出: JSON字符串数组,或者以空白分隔的地址,#开头的行是注释
+func parse(data []byte) ([]string, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var addrs []string
+		if err := json.Unmarshal(data, &addrs); err != nil {
+			return nil, fmt.Errorf("解析JSON失败: %v", err)
+		}
+		return addrs, nil
+	}
+
+	var addrs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, strings.Fields(line)...)
+	}
+	return addrs, scanner.Err()
+}
@@ -0,0 +1,163 @@
+package discover
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	addrs, err := parse([]byte(`["a:1", "node/b:2"]`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"a:1", "node/b:2"}, addrs)
+
+	addrs, err = parse([]byte("# seeds\na:1 b:2\n\n  c\n"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"a:1", "b:2", "c"}, addrs)
+
+	_, err = parse([]byte(`["a:1",`))
+	require.Error(t, err)
+}
+
+func TestDiscover_MergeAndErrors(t *testing.T) {
+	missing := &File{Path: filepath.Join(os.TempDir(), "does-not-exist-seeds")}
+	addrs, err := Discover(context.Background(), Static{"a", "b"}, missing, Static{"b", "c"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, addrs)
+
+	_, err = Discover(context.Background(), missing)
+	require.Error(t, err)
+}
+
+func TestFile_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seeds")
+	require.NoError(t, ioutil.WriteFile(path, []byte("a:1\n"), 0644))
+
+	f := &File{Path: path, PollInterval: 10 * time.Millisecond}
+	addrs, err := f.Addrs(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"a:1"}, addrs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := f.Watch(ctx)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`["a:1","b:2"]`), 0644))
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("no change notification")
+	}
+	addrs, err = f.Addrs(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"a:1", "b:2"}, addrs)
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestExec(t *testing.T) {
+	e := &Exec{Command: "sh", Args: []string{"-c", "echo a:1; echo b:2"}}
+	addrs, err := e.Addrs(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"a:1", "b:2"}, addrs)
+
+	e = &Exec{Command: "sh", Args: []string{"-c", "echo boom >&2; exit 3"}}
+	_, err = e.Addrs(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "boom")
+
+	// 命令不结束时超时返回
+	e = &Exec{Command: "sleep", Args: []string{"10"}, Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err = e.Addrs(context.Background())
+	require.Error(t, err)
+	require.True(t, time.Since(start) < 5*time.Second)
+}
+
+// blockProvider 直到ctx结束才返回
+type blockProvider struct{}
+
+func (blockProvider) Addrs(ctx context.Context) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockProvider) String() string { return "block" }
+
+func TestDiscover_DefaultTimeout(t *testing.T) {
+	ctx, cancel := withDefaultTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, ok := ctx.Deadline()
+	require.True(t, ok)
+
+	// 已有的超时不会被延长
+	parent, cancelParent := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelParent()
+	ctx, cancel = withDefaultTimeout(parent, time.Hour)
+	defer cancel()
+	d, _ := ctx.Deadline()
+	pd, _ := parent.Deadline()
+	require.Equal(t, pd, d)
+
+	addrs, err := Discover(parent, blockProvider{}, Static{"a"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, addrs)
+}
+
+func TestSRV(t *testing.T) {
+	var queries int32
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		q := req.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		switch q.Qtype {
+		case dns.TypeSRV:
+			resp.Answer = append(resp.Answer,
+				&dns.SRV{
+					Hdr:      dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 60},
+					Priority: 20, Weight: 1, Port: 7947, Target: "b.example.test.",
+				},
+				&dns.SRV{
+					Hdr:      dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 60},
+					Priority: 10, Weight: 1, Port: 7946, Target: "a.example.test.",
+				})
+			resp.Extra = append(resp.Extra,
+				&dns.A{Hdr: dns.RR_Header{Name: "a.example.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(10, 0, 0, 1)},
+				&dns.A{Hdr: dns.RR_Header{Name: "b.example.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(10, 0, 0, 2)})
+		}
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	s := &SRV{
+		Service: "memberlist",
+		Proto:   "tcp",
+		Name:    "example.test",
+		Server:  l.Addr().String(),
+	}
+	addrs, err := s.Addrs(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1:7946", "10.0.0.2:7947"}, addrs)
+	require.Equal(t, "srv:_memberlist._tcp.example.test", s.String())
+
+	// 结果按TTL缓存
+	addrs, err = s.Addrs(context.Background())
+	require.NoError(t, err)
+	require.Len(t, addrs, 2)
+	require.Equal(t, int32(1), atomic.LoadInt32(&queries))
+}
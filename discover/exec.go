@@ -0,0 +1,44 @@
+package discover
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Exec 运行一个命令,从标准输出读取地址,格式与 File 相同
+type Exec struct {
+	Command string
+	Args    []string
+
+	// Timeout 超时后杀掉命令,为0时使用 DefaultTimeout
+	Timeout time.Duration
+}
+
+func (e *Exec) Addrs(ctx context.Context) ([]string, error) {
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Command, e.Args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return parse(out)
+}
+
+func (e *Exec) String() string {
+	return "exec:" + strings.Join(append([]string{e.Command}, e.Args...), " ")
+}
@@ -0,0 +1,71 @@
+package discover
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// DefaultPollInterval File 检查文件变化的默认间隔
+const DefaultPollInterval = 5 * time.Second
+
+// File 从文件中读取地址,内容是JSON字符串数组或每行一个地址
+type File struct {
+	Path string
+
+	// PollInterval 检查文件变化的间隔,为0时使用 DefaultPollInterval
+	PollInterval time.Duration
+}
+
+func (f *File) Addrs(context.Context) ([]string, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(data)
+}
+
+func (f *File) String() string {
+	return "file:" + f.Path
+}
+
+// Watch 定期检查文件的修改时间和大小,变化时通知
+func (f *File) Watch(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	interval := f.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	// 在返回前记录当前状态,之后的修改都会被通知
+	var lastMod time.Time
+	var lastSize int64 = -1
+	if fi, err := os.Stat(f.Path); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+	go func() {
+		defer close(ch)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+			fi, err := os.Stat(f.Path)
+			if err != nil {
+				continue
+			}
+			if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+				continue
+			}
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,80 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// SRV 通过DNS SRV记录发现种子节点,端口取自记录。与 srv:// 种子地址使用同一个解析器:
+// 通过TCP查询,按优先级和权重(RFC 2782)排序,结果按TTL缓存
+type SRV struct {
+	Service string // 例如 "memberlist",为空时直接查询 Name
+	Proto   string // "tcp" 或 "udp"
+	Name    string // 域名
+
+	// Server DNS服务器 host:port,为空时使用 DNSConfigPath 中的第一个
+	Server string
+
+	// DNSConfigPath 为空时使用 /etc/resolv.conf
+	DNSConfigPath string
+
+	once  sync.Once
+	cache *pkg.DNSCache
+}
+
+func (s *SRV) Addrs(ctx context.Context) ([]string, error) {
+	s.once.Do(func() { s.cache = pkg.NewDNSCache() })
+
+	name := s.query()
+	ips, ok := s.cache.Get(name)
+	if !ok {
+		server, err := s.server()
+		if err != nil {
+			return nil, err
+		}
+		var ttl uint32
+		ips, ttl, err = pkg.TcpLookupSRVContext(ctx, name, server)
+		if err != nil {
+			return nil, err
+		}
+		s.cache.Put(name, ips, ttl)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, pkg.JoinHostPort(ip.IP.String(), ip.Port))
+	}
+	return addrs, nil
+}
+
+func (s *SRV) server() (string, error) {
+	if s.Server != "" {
+		return pkg.EnsurePort(s.Server, 53), nil
+	}
+	path := s.DNSConfigPath
+	if path == "" {
+		path = "/etc/resolv.conf"
+	}
+	server, err := pkg.ConfigDNSServer(path)
+	if err != nil {
+		return "", err
+	}
+	if server == "" {
+		return "", fmt.Errorf("%s 中没有DNS服务器", path)
+	}
+	return server, nil
+}
+
+func (s *SRV) query() string {
+	if s.Service == "" {
+		return s.Name
+	}
+	return fmt.Sprintf("_%s._%s.%s", s.Service, s.Proto, strings.TrimSuffix(s.Name, "."))
+}
+
+func (s *SRV) String() string {
+	return "srv:" + s.query()
+}
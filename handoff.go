@@ -0,0 +1,196 @@
+package memberlist
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// HandoffClass 移交队列中消息的类别
+type HandoffClass int
+
+const (
+	// HandoffMembership Alive、Suspect、Dead 消息;类别内 Alive 先出队,使节点对怀疑的反驳不会排在怀疑消息后面
+	HandoffMembership HandoffClass = iota
+	// HandoffUser 用户消息、请求、查询、用户事件、应用广播、复制map
+	HandoffUser
+	numHandoffClasses
+)
+
+// ClassOf 返回消息类型所属的类别
+func ClassOf(msgType MessageType) HandoffClass {
+	switch msgType {
+	case UserMsg, RequestMsg, QueryMsg, UserEventMsg, AppMsg, MapMsg:
+		return HandoffUser
+	}
+	return HandoffMembership
+}
+
+// OverflowPolicy 队列满时的丢弃策略
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest 丢弃新到达的消息
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest 丢弃同类别队列中最旧的消息,为新消息腾出位置
+	OverflowDropOldest
+	// OverflowDropUserFirst 用户消息队列满时丢弃新到达的用户消息;成员消息总能入队,队列满时丢弃最旧的成员消息。
+	// 两类队列的深度各自独立,丢弃用户消息腾不出成员消息的位置
+	OverflowDropUserFirst
+)
+
+// HandoffMsg 用于在goroutine之间消息传递
+type HandoffMsg struct {
+	MsgType MessageType
+	Buf     []byte
+	From    net.Addr
+}
+
+// HandoffStats 移交队列的深度和丢弃统计
+type HandoffStats struct {
+	MembershipDepth   int
+	UserDepth         int
+	MembershipDropped uint64
+	UserDropped       uint64
+
+	// DispatchDropped 出队后因为用户消息worker繁忙而被丢弃的消息数,由Members填充
+	DispatchDropped uint64
+}
+
+// HandoffScheduler 决定UDP收到的消息在交给PacketHandler之前如何排队、溢出时丢弃哪条消息以及出队顺序。
+// 方法会被并发调用,实现需要保证并发安全
+type HandoffScheduler interface {
+	// Push 放入一条消息,返回false表示这条消息被丢弃
+	Push(msg HandoffMsg) bool
+
+	// Pop 返回下一条要处理的消息,队列为空时返回false
+	Pop() (HandoffMsg, bool)
+
+	// Stats 返回队列深度和丢弃统计
+	Stats() HandoffStats
+}
+
+// FairHandoffScheduler 默认的移交调度器;每个类别一个有界队列,类别内先进先出,类别之间按权重轮转出队。
+// 成员类别中的 Alive 消息单独排队并优先出队,与原来的高优先级队列一致;Alive 之间、Suspect/Dead 之间保持到达顺序
+type FairHandoffScheduler struct {
+	lock    sync.Mutex
+	policy  OverflowPolicy
+	depth   [numHandoffClasses]int
+	weight  [numHandoffClasses]int
+	credit  [numHandoffClasses]int
+	queues  [numHandoffClasses]*list.List
+	alive   *list.List // 成员类别中的 Alive 消息,计入成员类别的深度
+	dropped [numHandoffClasses]uint64
+}
+
+// NewFairHandoffScheduler 根据配置创建默认的移交调度器
+func NewFairHandoffScheduler(conf *Config) *FairHandoffScheduler {
+	s := &FairHandoffScheduler{policy: conf.HandoffOverflow}
+	s.depth[HandoffMembership] = conf.HandoffQueueDepth
+	s.depth[HandoffUser] = conf.HandoffUserQueueDepth
+	if s.depth[HandoffUser] <= 0 {
+		s.depth[HandoffUser] = conf.HandoffQueueDepth
+	}
+	s.weight[HandoffMembership] = conf.HandoffMembershipWeight
+	s.weight[HandoffUser] = conf.HandoffUserWeight
+	for c := range s.queues {
+		if s.weight[c] < 1 {
+			s.weight[c] = 1
+		}
+		s.credit[c] = s.weight[c]
+		s.queues[c] = list.New()
+	}
+	s.alive = list.New()
+	return s
+}
+
+// classLen 类别中排队的消息数
+func (s *FairHandoffScheduler) classLen(c HandoffClass) int {
+	if c == HandoffMembership {
+		return s.queues[c].Len() + s.alive.Len()
+	}
+	return s.queues[c].Len()
+}
+
+// oldest 类别中最先被丢弃的消息;成员类别先丢弃 Suspect、Dead,最后才丢弃 Alive
+func (s *FairHandoffScheduler) oldest(c HandoffClass) (*list.List, *list.Element) {
+	if q := s.queues[c]; q.Len() > 0 {
+		return q, q.Front()
+	}
+	if c == HandoffMembership && s.alive.Len() > 0 {
+		return s.alive, s.alive.Front()
+	}
+	return nil, nil
+}
+
+// See HandoffScheduler.
+func (s *FairHandoffScheduler) Push(msg HandoffMsg) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := ClassOf(msg.MsgType)
+	q := s.queues[c]
+	if msg.MsgType == AliveMsg {
+		q = s.alive
+	}
+	if s.classLen(c) < s.depth[c] {
+		q.PushBack(msg)
+		return true
+	}
+
+	switch {
+	case s.policy == OverflowDropOldest && s.classLen(c) > 0,
+		s.policy == OverflowDropUserFirst && c != HandoffUser && s.classLen(c) > 0:
+		old, el := s.oldest(c)
+		old.Remove(el)
+		s.dropped[c]++
+		q.PushBack(msg)
+		return true
+	}
+
+	s.dropped[c]++
+	return false
+}
+
+// See HandoffScheduler.
+func (s *FairHandoffScheduler) Pop() (HandoffMsg, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// 所有非空队列的额度都用完后重置额度,再轮转一次
+	for pass := 0; pass < 2; pass++ {
+		for c, q := range s.queues {
+			if c == int(HandoffMembership) && s.alive.Len() > 0 {
+				q = s.alive
+			}
+			if s.credit[c] > 0 && q.Len() > 0 {
+				s.credit[c]--
+				el := q.Front()
+				q.Remove(el)
+				return el.Value.(HandoffMsg), true
+			}
+		}
+		s.credit = s.weight
+	}
+	return HandoffMsg{}, false
+}
+
+// See HandoffScheduler.
+func (s *FairHandoffScheduler) Stats() HandoffStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return HandoffStats{
+		MembershipDepth:   s.classLen(HandoffMembership),
+		UserDepth:         s.queues[HandoffUser].Len(),
+		MembershipDropped: s.dropped[HandoffMembership],
+		UserDropped:       s.dropped[HandoffUser],
+	}
+}
+
+// HandoffStats 返回移交队列的深度和丢弃统计
+func (m *Members) HandoffStats() HandoffStats {
+	stats := m.HandoffQueue.Stats()
+	stats.DispatchDropped = atomic.LoadUint64(&m.dispatchDropped)
+	return stats
+}
@@ -0,0 +1,261 @@
+package memberlist
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthMetaSize 开启 HealthAdvertise 时附加在节点元信息末尾的字节数
+const HealthMetaSize = 4
+
+var healthMetaMagic = [3]byte{0xff, 'h', 's'}
+
+// HealthCheck 本地健康检查。检查失败时增加 Awareness 的惩罚分数,使本节点在错过ack之前就放慢探测、延长超时;
+// 惩罚与探测分数分开计算,探测成功不会抵消它
+type HealthCheck struct {
+	Name string
+
+	// Check 返回 error 表示不健康
+	Check func(ctx context.Context) error
+
+	// Interval 检查间隔,默认 ProbeInterval
+	Interval time.Duration
+
+	// Timeout 单次检查的超时,超时视为失败,默认 Interval
+	Timeout time.Duration
+
+	// Penalty 从健康变为失败时增加的分数,默认1;连续失败不再增加,恢复或注销时减去同样的分数
+	Penalty int
+}
+
+// HealthCheckStatus 健康检查的最近一次结果
+type HealthCheckStatus struct {
+	Name     string
+	Failing  bool
+	Failures int // 连续失败次数
+	Err      error
+	LastRun  time.Time
+}
+
+type healthCheck struct {
+	HealthCheck
+	status HealthCheckStatus
+	stop   chan struct{}
+}
+
+// health 管理本地健康检查以及分数的广播
+type health struct {
+	lock   sync.Mutex
+	checks map[string]*healthCheck
+
+	advertiseCh chan struct{}
+	advertised  int
+}
+
+func newHealth() *health {
+	return &health{
+		checks:      make(map[string]*healthCheck),
+		advertiseCh: make(chan struct{}, 1),
+		advertised:  -1,
+	}
+}
+
+// RegisterHealthCheck 注册一个本地健康检查并开始定期执行,返回的函数用于注销;节点停止时也会结束
+func (m *Members) RegisterHealthCheck(c HealthCheck) (deregister func(), err error) {
+	if c.Name == "" || c.Check == nil {
+		return nil, fmt.Errorf("健康检查必须有名字和检查函数")
+	}
+	if c.Interval <= 0 {
+		c.Interval = m.Config.ProbeInterval
+	}
+	if c.Interval <= 0 {
+		return nil, fmt.Errorf("健康检查 %q 的间隔必须大于0", c.Name)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = c.Interval
+	}
+	if c.Penalty <= 0 {
+		c.Penalty = 1
+	}
+
+	h := m.health
+	h.lock.Lock()
+	if _, ok := h.checks[c.Name]; ok {
+		h.lock.Unlock()
+		return nil, fmt.Errorf("健康检查 %q 已经注册", c.Name)
+	}
+	hc := &healthCheck{HealthCheck: c, status: HealthCheckStatus{Name: c.Name}, stop: make(chan struct{})}
+	h.checks[c.Name] = hc
+	h.lock.Unlock()
+
+	go m.runHealthCheck(hc)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { m.deregisterHealthCheck(hc) })
+	}, nil
+}
+
+func (m *Members) deregisterHealthCheck(hc *healthCheck) {
+	h := m.health
+	h.lock.Lock()
+	delete(h.checks, hc.Name)
+	close(hc.stop)
+	failing := hc.status.Failing
+	h.lock.Unlock()
+
+	// 注销失败中的检查时把它造成的分数还回去
+	if failing {
+		m.Awareness.ApplyPenalty(-hc.Penalty)
+	}
+}
+
+// HealthChecks 返回所有健康检查的最近结果,按名字排序
+func (m *Members) HealthChecks() []HealthCheckStatus {
+	h := m.health
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	out := make([]HealthCheckStatus, 0, len(h.checks))
+	for _, hc := range h.checks {
+		out = append(out, hc.status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (m *Members) runHealthCheck(hc *healthCheck) {
+	t := time.NewTicker(hc.Interval)
+	defer t.Stop()
+	for {
+		m.healthCheckOnce(hc)
+		select {
+		case <-t.C:
+		case <-hc.stop:
+			return
+		case <-m.ShutdownCh:
+			return
+		}
+	}
+}
+
+func (m *Members) healthCheckOnce(hc *healthCheck) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	errCh := make(chan error, 1)
+	go func() { errCh <- hc.Check(ctx) }()
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = fmt.Errorf("健康检查超时: %v", ctx.Err())
+	}
+	cancel()
+
+	h := m.health
+	h.lock.Lock()
+	// 已经注销的检查不再影响分数
+	select {
+	case <-hc.stop:
+		h.lock.Unlock()
+		return
+	default:
+	}
+	wasFailing := hc.status.Failing
+	hc.status.LastRun = time.Now()
+	hc.status.Err = err
+	hc.status.Failing = err != nil
+	if err != nil {
+		hc.status.Failures++
+	} else {
+		hc.status.Failures = 0
+	}
+	h.lock.Unlock()
+
+	switch {
+	case err != nil && !wasFailing:
+		m.Logger.Printf("[WARN] memberlist: 健康检查 %q 失败: %v", hc.Name, err)
+		m.Awareness.ApplyPenalty(hc.Penalty)
+	case err == nil && wasFailing:
+		m.Logger.Printf("[INFO] memberlist: 健康检查 %q 恢复", hc.Name)
+		m.Awareness.ApplyPenalty(-hc.Penalty)
+	}
+}
+
+// healthChanged Awareness 分数变化时调用
+func (m *Members) healthChanged(old, new int) {
+	if d := m.Config.Health; d != nil {
+		d.NotifyHealth(old, new)
+	}
+	if m.Config.HealthAdvertise {
+		select {
+		case m.health.advertiseCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// healthAdvertiseLoop 分数变化后重新广播本节点的元信息,两次广播之间至少间隔 HealthAdvertiseInterval
+func (m *Members) healthAdvertiseLoop() {
+	h := m.health
+	for {
+		select {
+		case <-h.advertiseCh:
+		case <-m.ShutdownCh:
+			return
+		}
+
+		m.NodeLock.RLock()
+		_, alive := m.NodeMap[m.Config.Name]
+		m.NodeLock.RUnlock()
+		if score := m.GetHealthScore(); alive && score != h.advertised && !m.hasLeft() {
+			h.advertised = score
+			m.broadcastSelf(nil)
+		}
+
+		select {
+		case <-time.After(m.Config.HealthAdvertiseInterval):
+		case <-m.ShutdownCh:
+			return
+		}
+	}
+}
+
+// localMeta 返回本节点要广播的元信息,开启 HealthAdvertise 时在末尾附加健康分数
+func (m *Members) localMeta() []byte {
+	limit := MetaMaxSize
+	if m.Config.HealthAdvertise {
+		limit -= HealthMetaSize
+	}
+	var meta []byte
+	if m.Config.Delegate != nil {
+		meta = m.Config.Delegate.NodeMeta(limit)
+		if len(meta) > limit {
+			panic("节点元数据长度超过限制")
+		}
+	}
+	if m.Config.HealthAdvertise {
+		score := m.GetHealthScore()
+		if score > 0xff {
+			score = 0xff
+		}
+		meta = append(append(meta[:len(meta):len(meta)], healthMetaMagic[:]...), byte(score))
+	}
+	return meta
+}
+
+// SplitHealthMeta 拆分开启 HealthAdvertise 的节点的元信息,返回应用的元信息和健康分数
+func SplitHealthMeta(meta []byte) (app []byte, score int, ok bool) {
+	n := len(meta) - HealthMetaSize
+	if n < 0 || meta[n] != healthMetaMagic[0] || meta[n+1] != healthMetaMagic[1] || meta[n+2] != healthMetaMagic[2] {
+		return meta, 0, false
+	}
+	return meta[:n], int(meta[n+3]), true
+}
+
+// HealthScore 返回节点在元信息中广播的健康分数,没有广播时 ok 为 false
+func (n *Node) HealthScore() (score int, ok bool) {
+	_, score, ok = SplitHealthMeta(n.Meta)
+	return
+}
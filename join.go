@@ -0,0 +1,374 @@
+package memberlist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+var (
+	errRemoteEncrypted    = errors.New("远端状态是加密的，但本机加密信息没有配置")
+	errRemoteNotEncrypted = errors.New("加密信息已配置,但远程的state没有加密")
+	errNoDecryptKey       = errors.New("没有安装的密钥可以解密信息")
+	errLabelMismatch      = errors.New("流标签不一致")
+)
+
+// remoteError 对方通过 ErrMsg 返回的错误
+type remoteError struct {
+	msg string
+}
+
+func (e *remoteError) Error() string {
+	return "remote error: " + e.msg
+}
+
+// protocolMismatchError VerifyProtocol 失败,对方的协议版本与集群不兼容
+type protocolMismatchError struct {
+	err error
+}
+
+func (e *protocolMismatchError) Error() string {
+	return e.err.Error()
+}
+
+// JoinMismatch 加入失败时检测到的配置不一致
+type JoinMismatch int
+
+const (
+	MismatchNone       JoinMismatch = iota
+	MismatchProtocol                // 协议或委托版本不兼容
+	MismatchEncryption              // 一方加密另一方没有,或者密钥不同
+	MismatchLabel                   // 对方因为流标签不一致拒绝了连接
+)
+
+func (j JoinMismatch) String() string {
+	switch j {
+	case MismatchProtocol:
+		return "protocol"
+	case MismatchEncryption:
+		return "encryption"
+	case MismatchLabel:
+		return "label"
+	default:
+		return "none"
+	}
+}
+
+// classifyJoinError 根据本地和对方返回的错误判断是哪一种不一致。只认确定的证据:
+// 本地的类型化错误,或者对方通过 ErrMsg 返回的已知错误;连接被关闭、重置等都不算
+func classifyJoinError(err error) JoinMismatch {
+	var remote string
+	switch e := err.(type) {
+	case nil:
+		return MismatchNone
+	case *protocolMismatchError:
+		return MismatchProtocol
+	case *remoteError:
+		remote = e.msg
+	}
+	if err == errLabelMismatch || remote == errLabelMismatch.Error() {
+		return MismatchLabel
+	}
+	for _, e := range []error{errRemoteEncrypted, errRemoteNotEncrypted, errNoDecryptKey} {
+		if err == e || remote == e.Error() {
+			return MismatchEncryption
+		}
+	}
+	return MismatchNone
+}
+
+// JoinOptions JoinWithReport 的选项
+type JoinOptions struct {
+	// Concurrency 同时解析和 push/pull 的数量,小于等于1时按顺序进行
+	Concurrency int
+}
+
+// AddrReport 一个解析出的地址的 push/pull 结果
+type AddrReport struct {
+	Addr     pkg.Address
+	Err      error
+	Mismatch JoinMismatch
+	Node     string   // 回应的节点名字,成功并且能在对方的状态中找到时记录
+	Nodes    []string // 对方知道的节点,只在成功时记录
+	Duration time.Duration
+}
+
+// SeedReport 一个种子的加入结果
+type SeedReport struct {
+	Seed       string
+	ResolveErr error
+	Resolved   []pkg.IpPort
+	Addrs      []*AddrReport
+	Duration   time.Duration // 解析和全部 push/pull 的时间
+}
+
+// Succeeded 成功 push/pull 的地址数
+func (s *SeedReport) Succeeded() int {
+	n := 0
+	for _, a := range s.Addrs {
+		if a.Err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// JoinReport JoinWithReport 的结果,Seeds 与传入的种子顺序相同
+type JoinReport struct {
+	Seeds      []*SeedReport
+	NumSuccess int
+	Duration   time.Duration
+}
+
+// Err 与 Join 返回的错误相同:只要有一个地址成功就是nil
+func (r *JoinReport) Err() error {
+	if r.NumSuccess > 0 {
+		return nil
+	}
+	var errs error
+	for _, s := range r.Seeds {
+		if s.ResolveErr != nil {
+			errs = multierror.Append(errs, fmt.Errorf("解析地址失败 %s: %v", s.Seed, s.ResolveErr))
+			continue
+		}
+		for _, a := range s.Addrs {
+			if a.Err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("加入失败 %s: %v", a.Addr.Addr, a.Err))
+			}
+		}
+	}
+	return errs
+}
+
+// Nodes 所有成功的地址报告的节点,去重
+func (r *JoinReport) Nodes() []string {
+	var out []string
+	seen := make(map[string]struct{})
+	for _, s := range r.Seeds {
+		for _, a := range s.Addrs {
+			for _, n := range a.Nodes {
+				if _, ok := seen[n]; !ok {
+					seen[n] = struct{}{}
+					out = append(out, n)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// JoinWithReport 与 Join 相同,但返回每个种子的解析结果、每个地址的 push/pull 结果、
+// 检测到的配置不一致和耗时。opts.Concurrency 大于1时同时联系多个地址
+func (m *Members) JoinWithReport(existing []string, opts *JoinOptions) *JoinReport {
+	return m.joinWithReport(context.Background(), existing, opts)
+}
+
+// joinWithReport ctx结束后不再开始新的 push/pull,进行中的连接也会被关闭
+func (m *Members) joinWithReport(ctx context.Context, existing []string, opts *JoinOptions) *JoinReport {
+	start := time.Now()
+	concurrency := 1
+	if opts != nil && opts.Concurrency > 1 {
+		concurrency = opts.Concurrency
+	}
+	sem := make(chan struct{}, concurrency)
+
+	r := &JoinReport{Seeds: make([]*SeedReport, len(existing))}
+	var wg sync.WaitGroup
+	for i, seed := range existing {
+		s := &SeedReport{Seed: seed}
+		r.Seeds[i] = s
+		wg.Add(1)
+		run := func() {
+			defer wg.Done()
+			m.joinSeed(ctx, s, sem)
+		}
+		if concurrency == 1 {
+			run()
+		} else {
+			go run()
+		}
+	}
+	wg.Wait()
+
+	for _, s := range r.Seeds {
+		r.NumSuccess += s.Succeeded()
+	}
+	r.Duration = time.Since(start)
+	if r.NumSuccess > 0 {
+		m.partition.setSeeds(existing)
+	}
+	return r
+}
+
+// joinSeed 解析一个种子并与每个地址 push/pull,sem 限制同时进行的数量
+func (m *Members) joinSeed(ctx context.Context, s *SeedReport, sem chan struct{}) {
+	start := time.Now()
+	defer func() { s.Duration = time.Since(start) }()
+
+	sem <- struct{}{}
+	s.Resolved, s.ResolveErr = m.ResolveAddr(s.Seed)
+	<-sem
+	if s.ResolveErr != nil {
+		m.Logger.Printf("[WARN] memberlist: 解析地址失败 %s: %v", s.Seed, s.ResolveErr)
+		return
+	}
+
+	s.Addrs = make([]*AddrReport, len(s.Resolved))
+	var wg sync.WaitGroup
+	for i, ip := range s.Resolved {
+		a := &AddrReport{Addr: pkg.Address{Addr: pkg.JoinHostPort(ip.IP.String(), ip.Port), Name: ip.NodeName}}
+		s.Addrs[i] = a
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			m.joinAddr(ctx, a)
+		}()
+		if cap(sem) == 1 {
+			wg.Wait()
+		}
+	}
+	wg.Wait()
+}
+
+func (m *Members) joinAddr(ctx context.Context, a *AddrReport) {
+	start := time.Now()
+	remote, err := m.pushPullNode(ctx, a.Addr, true)
+	a.Duration = time.Since(start)
+	a.Err = err
+	a.Mismatch = classifyJoinError(err)
+	if err != nil {
+		// 合并失败时对方的节点没有被接受,不记录
+		m.Logger.Printf("[DEBUG] memberlist: 加入失败 %s: %v", a.Addr.Addr, err)
+		return
+	}
+	for _, n := range remote {
+		a.Nodes = append(a.Nodes, n.Name)
+		if a.Addr.Name != "" {
+			if n.Name == a.Addr.Name {
+				a.Node = n.Name
+			}
+		} else if a.Node == "" && pkg.JoinHostPort(net.IP(n.Addr).String(), n.Port) == a.Addr.Addr {
+			a.Node = n.Name
+		}
+	}
+}
+
+// JoinRetryOptions JoinWithRetry 的选项
+type JoinRetryOptions struct {
+	// MinContacted 至少成功 push/pull 的不同节点数(按节点名字,同一个节点的多个地址只算一个),默认1
+	MinContacted int
+
+	// InitialBackoff 第一次重试前的等待,默认1s;之后每次翻倍,不超过 MaxBackoff(默认30s)。
+	// 实际等待在 [backoff/2, backoff) 之间随机,避免同时启动的节点一起重试
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Concurrency 同 JoinOptions.Concurrency
+	Concurrency int
+
+	// Progress 每一轮尝试后调用
+	Progress func(p *JoinProgress)
+}
+
+// JoinProgress 一轮尝试后的进度
+type JoinProgress struct {
+	Attempt   int
+	Contacted []string    // 到目前为止成功 push/pull 的节点名字,找不到名字时是地址
+	Report    *JoinReport // 这一轮的结果
+	NextRetry time.Duration
+}
+
+// JoinWithRetry 反复 Join 有地址失败的种子(每次重新解析),直到成功联系到 MinContacted 个不同的节点,
+// 或者ctx结束。所有种子都成功但节点数不够时重新尝试全部种子。每一轮之间指数退避并加入随机抖动
+func (m *Members) JoinWithRetry(ctx context.Context, existing []string, opts *JoinRetryOptions) (*JoinProgress, error) {
+	var o JoinRetryOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.MinContacted <= 0 {
+		o.MinContacted = 1
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = time.Second
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+
+	contacted := make(map[string]struct{})
+	pending := append([]string(nil), existing...)
+	backoff := o.InitialBackoff
+	p := &JoinProgress{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return p, fmt.Errorf("只联系到 %d/%d 个节点: %v", len(contacted), o.MinContacted, err)
+		}
+		p.Attempt++
+		p.Report = m.joinWithReport(ctx, pending, &JoinOptions{Concurrency: o.Concurrency})
+		selfAddr, selfPort := m.getAdvertise()
+
+		// 重试解析失败或者有地址失败的种子
+		var retry []string
+		for _, s := range p.Report.Seeds {
+			for _, a := range s.Addrs {
+				if a.Err != nil {
+					continue
+				}
+				// 种子里可能有本节点自己,不能算作联系到的节点
+				if a.Node == m.Config.Name || a.Addr.Addr == pkg.JoinHostPort(selfAddr.String(), selfPort) {
+					continue
+				}
+				id := a.Node
+				if id == "" {
+					id = a.Addr.Addr
+				}
+				if _, ok := contacted[id]; !ok {
+					contacted[id] = struct{}{}
+					p.Contacted = append(p.Contacted, id)
+				}
+			}
+			if s.ResolveErr != nil || len(s.Addrs) == 0 || s.Succeeded() < len(s.Addrs) {
+				retry = append(retry, s.Seed)
+			}
+		}
+		pending = retry
+		if len(pending) == 0 {
+			// 种子背后可能有新的地址
+			pending = append([]string(nil), existing...)
+		}
+
+		done := len(contacted) >= o.MinContacted
+		p.NextRetry = 0
+		if !done {
+			p.NextRetry = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		}
+		if o.Progress != nil {
+			o.Progress(p)
+		}
+		if done {
+			return p, nil
+		}
+
+		m.Logger.Printf("[DEBUG] memberlist: 已联系 %d/%d 个节点, %s 后重试 %d 个种子",
+			len(contacted), o.MinContacted, p.NextRetry, len(pending))
+		select {
+		case <-time.After(p.NextRetry):
+		case <-ctx.Done():
+			return p, fmt.Errorf("只联系到 %d/%d 个节点: %v; 最后一次: %v", len(contacted), o.MinContacted, ctx.Err(), p.Report.Err())
+		case <-m.ShutdownCh:
+			return p, fmt.Errorf("节点已停止")
+		}
+		if backoff *= 2; backoff > o.MaxBackoff {
+			backoff = o.MaxBackoff
+		}
+	}
+}
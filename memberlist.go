@@ -2,7 +2,6 @@
 package memberlist
 
 import (
-	"container/list"
 	"errors"
 	"fmt"
 	"github.com/hashicorp/memberlist/broadcast_tree"
@@ -15,7 +14,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	multierror "github.com/hashicorp/go-multierror"
 	sockAddr "github.com/hashicorp/go-sockaddr"
 )
 
@@ -41,6 +39,9 @@ type Members struct {
 	numNodes    uint32 // 已知节点数(估计)
 	PushPullReq uint32 // push/pull 请求数
 
+	dispatchDropped uint64 // 用户消息worker繁忙而被丢弃的消息数
+	userWorkerNext  uint32 // 轮询分配用户消息的计数器
+
 	advertiseLock sync.RWMutex
 	advertiseAddr net.IP
 	advertisePort uint16
@@ -54,11 +55,10 @@ type Members struct {
 	ShutdownLock sync.Mutex
 	leaveLock    sync.Mutex
 
-	Transport            NodeAwareTransport
-	HandoffCh            chan struct{} // 通知有待处理的信息
-	HighPriorityMsgQueue *list.List
-	LowPriorityMsgQueue  *list.List
-	msgQueueLock         sync.Mutex
+	Transport    NodeAwareTransport
+	HandoffCh    chan struct{}    // 通知有待处理的信息
+	HandoffQueue HandoffScheduler // 待处理的信息
+	userWorkers  []chan HandoffMsg
 
 	NodeLock   sync.RWMutex
 	probeIndex int                   // 节点探活索引  与nodes对应
@@ -74,8 +74,27 @@ type Members struct {
 	AckLock     sync.Mutex
 	AckHandlers map[uint32]*AckHandler
 
+	reqLock     sync.Mutex
+	reqHandlers map[uint32]*pendingRequest // 等待响应的请求
+
+	queryLock      sync.Mutex
+	queryResponses map[uint32]*QueryResponse // 本节点发起的、还没有结束的查询
+	querySeen      map[queryKey]time.Time    // 处理过的查询 -> 过期时间
+
+	userEvents *userEvents
+	deliveries *deliveries
+	appLog     *appLog
+	replMap    *ReplicatedMap
+	conflicts  *conflicts
+	reconnects *reconnects
+	partition  *partitionDetector
+	dnsCache   *pkg.DNSCache
+	health     *health
+
 	Broadcasts *broadcast_tree.TransmitLimitedQueue
 
+	admission *admission // 入站准入控制
+
 	Logger *log.Logger
 }
 
@@ -93,25 +112,10 @@ func (m *Members) Leave(timeout time.Duration) error {
 	}
 
 	if !m.hasLeft() {
-		atomic.StoreInt32(&m.leave, 1)
-		m.NodeLock.Lock()
-		state, ok := m.NodeMap[m.Config.Name]
-		m.NodeLock.Unlock()
-		if !ok {
-			m.Logger.Printf("[WARN] memberlist: Leave 但是自己不再NodeMap中.")
+		if !m.broadcastLeave() {
 			return nil
 		}
 
-		// 这个死亡信息很特别，因为Node和From是一样的。
-		// 这有助于其他节点弄清一个节点是故意离开的。
-		// 当Node等于From时，其他节点肯定知道这个节点已经离开了。
-		d := Dead{
-			Incarnation: state.Incarnation,
-			Node:        state.Name,
-			From:        state.Name,
-		}
-		m.DeadNode(&d)
-
 		// 存在任何活着的节点   阻止直到广播出去、或者超时
 		if m.anyAlive() {
 			var timeoutCh <-chan time.Time
@@ -129,6 +133,52 @@ func (m *Members) Leave(timeout time.Duration) error {
 	return nil
 }
 
+// LeaveTracked 与 Leave 一样广播离开消息,但不等待,返回的跟踪用于等待送达
+func (m *Members) LeaveTracked(mode DeliveryMode) (*Delivery, error) {
+	m.leaveLock.Lock()
+	defer m.leaveLock.Unlock()
+
+	if m.hasSetShutdown() {
+		panic("在停止后离开")
+	}
+	if m.hasLeft() {
+		return nil, fmt.Errorf("已经离开")
+	}
+
+	d := m.newDelivery(mode, m.LeaveBroadcast)
+	ok := m.broadcastLeave()
+	m.takeNotify(m.LeaveBroadcast)
+	if !ok {
+		m.finishDelivery(d)
+		return nil, fmt.Errorf("自己不在NodeMap中")
+	}
+	return d, nil
+}
+
+// broadcastLeave 标记离开并广播死亡消息;自己不在NodeMap中时返回false。调用时持有leaveLock
+func (m *Members) broadcastLeave() bool {
+	atomic.StoreInt32(&m.leave, 1)
+	m.NodeLock.Lock()
+	state, ok := m.NodeMap[m.Config.Name]
+	m.NodeLock.Unlock()
+	if !ok {
+		m.Logger.Printf("[WARN] memberlist: Leave 但是自己不再NodeMap中.")
+		return false
+	}
+
+	// 这个死亡信息很特别，因为Node和From是一样的。
+	// 这有助于其他节点弄清一个节点是故意离开的。
+	// 当Node等于From时，其他节点肯定知道这个节点已经离开了。
+	d := Dead{
+		Incarnation: state.Incarnation,
+		Node:        state.Name,
+		From:        state.Name,
+		ID:          state.ID,
+	}
+	m.DeadNode(&d)
+	return true
+}
+
 // SetAlive 用于将此节点标记为活动节点。这就像我们自己的network channel收到一个Alive通知一样。
 func (m *Members) SetAlive() error {
 	Addr, port, err := m.RefreshAdvertise()
@@ -153,13 +203,7 @@ func (m *Members) SetAlive() error {
 	}
 
 	// 判断元数据的大小。
-	var meta []byte
-	if m.Config.Delegate != nil {
-		meta = m.Config.Delegate.NodeMeta(MetaMaxSize)
-		if len(meta) > MetaMaxSize {
-			panic("节点元数据长度超过限制")
-		}
-	}
+	meta := m.localMeta()
 
 	a := Alive{
 		Incarnation: m.NextIncarnation(), // 1 周期性的full state sync，使用incarnation number去调协
@@ -168,6 +212,7 @@ func (m *Members) SetAlive() error {
 		Port:        uint16(port),
 		Meta:        meta,
 		Vsn:         m.Config.BuildVsnArray(),
+		ID:          m.Config.NodeID,
 	}
 	m.AliveNode(&a, nil, true) // 存储节点state,广播自己存活消息
 
@@ -275,6 +320,11 @@ func (m *Members) RefreshAdvertise() (net.IP, int, error) {
 
 // ResolveAddr 解析hostStr、可以是域名 ,返回IpPort
 func (m *Members) ResolveAddr(hostStr string) ([]pkg.IpPort, error) {
+	// srv://_service._proto.domain 形式的种子,端口取自SRV记录
+	if strings.HasPrefix(hostStr, SRVPrefix) {
+		return m.resolveSRV(strings.TrimPrefix(hostStr, SRVPrefix))
+	}
+
 	// 首先去掉任何leading节点名称。这是可选的。
 	nodeName := ""
 	slashIdx := strings.Index(hostStr, "/") // 127.0.0.1:8000       -1
@@ -284,6 +334,9 @@ func (m *Members) ResolveAddr(hostStr string) ([]pkg.IpPort, error) {
 		}
 		nodeName = hostStr[0:slashIdx]
 		hostStr = hostStr[slashIdx+1:]
+		if strings.HasPrefix(hostStr, SRVPrefix) {
+			return nil, fmt.Errorf("SRV种子不支持节点名前缀: %q", nodeName)
+		}
 	}
 
 	// 这将捕获所提供的端口，或默认的端口。
@@ -304,7 +357,17 @@ func (m *Members) ResolveAddr(hostStr string) ([]pkg.IpPort, error) {
 		}, nil
 	}
 	// 尝试使用tcp 解析
-	ips, err := pkg.TcpLookupIP(host, port, nodeName, m.Config.DNSConfigPath)
+	key := nodeName + "/" + hostStr
+	if ips, ok := m.dnsCache.Get(key); ok {
+		return ips, nil
+	}
+	var ips []pkg.IpPort
+	server, err := m.dnsServer()
+	if err == nil && server != "" {
+		var ttl uint32
+		ips, ttl, err = pkg.TcpLookupIPServer(host, port, nodeName, server)
+		m.dnsCache.Put(key, ips, ttl)
+	}
 	if err != nil {
 		m.Logger.Printf("[DEBUG] memberlist: TCP-first lookup 失败'%s', falling back to UDP: %s", hostStr, err)
 	}
@@ -320,34 +383,8 @@ func (m *Members) ResolveAddr(hostStr string) ([]pkg.IpPort, error) {
 // 最初，成员只包含我们自己的状态，所以这样做将导致远程节点警觉到这个节点的存在，有效地加入集群。
 // 这将返回成功联系到的主机的数量，如果没有联系到，则返回错误。如果返回错误，说明该节点没有成功加入集群。
 func (m *Members) Join(existing []string) (int, error) {
-	numSuccess := 0
-	var errs error
-	for _, exist := range existing {
-		Addrs, err := m.ResolveAddr(exist)
-		if err != nil {
-			err = fmt.Errorf("解析地址失败 %s: %v", exist, err)
-			errs = multierror.Append(errs, err)
-			m.Logger.Printf("[WARN] memberlist: %v", err)
-			continue
-		}
-
-		for _, Addr := range Addrs {
-			hp := pkg.JoinHostPort(Addr.IP.String(), Addr.Port)
-			a := pkg.Address{Addr: hp, Name: Addr.NodeName}
-			if err := m.PushPullNode(a, true); err != nil {
-				err = fmt.Errorf("加入失败 %s: %v", a.Addr, err)
-				errs = multierror.Append(errs, err)
-				m.Logger.Printf("[DEBUG] memberlist: %v", err)
-				continue
-			} // 建立tcp 链接
-			numSuccess++
-		}
-
-	}
-	if numSuccess > 0 {
-		errs = nil
-	}
-	return numSuccess, errs
+	r := m.JoinWithReport(existing, nil)
+	return r.NumSuccess, r.Err()
 }
 
 // SendToAddress UDP发送UserMsg
@@ -5,17 +5,200 @@ import (
 	"fmt"
 	"github.com/hashicorp/memberlist/pkg"
 	"io"
+	"math/rand"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
+// mockPacketBuffer is the number of packets a MockTransport buffers, like a
+// socket receive buffer. Without it two transports writing to each other
+// from their packet handlers deadlock.
+const mockPacketBuffer = 64
+
 // MockNetwork is used as a factory that produces MockTransport instances which
 // are uniquely Addressed and wired up to talk to each other.
+//
+// By default every link is perfect. SetLink and the helpers built on it
+// change how traffic flows between two transports, identified by the name
+// given to NewTransport, so tests can reproduce partitions, packet loss and
+// asymmetric connectivity without any OS networking.
 type MockNetwork struct {
 	TransportsByAddr map[string]*MockTransport
 	TransportsByName map[string]*MockTransport
 	port             int
+
+	// Seed seeds the random source used for packet drops and jitter. It must be set
+	// before the first packet is sent.
+	Seed int64
+
+	linkLock    sync.Mutex
+	links       map[mockLinkKey]MockLink
+	defaultLink MockLink
+	rng         *rand.Rand
+}
+
+// MockLink describes one direction of the link between two transports. The
+// zero value is a perfect link.
+type MockLink struct {
+	// Blocked drops every packet and fails every dial over the link.
+	Blocked bool
+
+	// DropRate is the probability, between 0 and 1, that a packet is
+	// silently dropped. Streams are not affected.
+	DropRate float64
+
+	// Delay is added before a packet is delivered. Dials wait for the
+	// round trip, the sum of the delays in both directions.
+	Delay time.Duration
+
+	// Jitter adds a random extra delay in [0, Jitter) to each packet on
+	// top of Delay. Dials ignore it.
+	Jitter time.Duration
+
+	// DialFail makes stream dials over the link fail while packets still
+	// flow.
+	DialFail bool
+}
+
+type mockLinkKey struct {
+	from, to string
+}
+
+// SetLink configures traffic sent from one transport to another. Traffic
+// in the opposite direction is not changed.
+func (n *MockNetwork) SetLink(from, to string, l MockLink) {
+	n.linkLock.Lock()
+	defer n.linkLock.Unlock()
+
+	if n.links == nil {
+		n.links = make(map[mockLinkKey]MockLink)
+	}
+	k := mockLinkKey{from, to}
+	if l == n.defaultLink {
+		delete(n.links, k)
+		return
+	}
+	n.links[k] = l
+}
+
+// SetLinkBoth configures traffic in both directions between a and b.
+func (n *MockNetwork) SetLinkBoth(a, b string, l MockLink) {
+	n.SetLink(a, b, l)
+	n.SetLink(b, a, l)
+}
+
+// Link returns the current configuration of the link from one transport to
+// another.
+func (n *MockNetwork) Link(from, to string) MockLink {
+	n.linkLock.Lock()
+	defer n.linkLock.Unlock()
+	return n.linkLocked(from, to)
+}
+
+func (n *MockNetwork) linkLocked(from, to string) MockLink {
+	if l, ok := n.links[mockLinkKey{from, to}]; ok {
+		return l
+	}
+	return n.defaultLink
+}
+
+// SetDefaultLink configures every link that has not been given its own
+// configuration with SetLink, e.g. to add loss and latency to the whole
+// network.
+func (n *MockNetwork) SetDefaultLink(l MockLink) {
+	n.linkLock.Lock()
+	defer n.linkLock.Unlock()
+	n.defaultLink = l
+}
+
+// Block drops all traffic sent from one transport to another, keeping the
+// rest of the link configuration.
+func (n *MockNetwork) Block(from, to string) {
+	l := n.Link(from, to)
+	l.Blocked = true
+	n.SetLink(from, to, l)
+}
+
+// Unblock undoes Block.
+func (n *MockNetwork) Unblock(from, to string) {
+	l := n.Link(from, to)
+	l.Blocked = false
+	n.SetLink(from, to, l)
+}
+
+// Partition splits the network so that transports in different groups can't
+// reach each other, in either direction. Links inside a group are not
+// changed.
+func (n *MockNetwork) Partition(groups ...[]string) {
+	for i, a := range groups {
+		for _, b := range groups[i+1:] {
+			for _, x := range a {
+				for _, y := range b {
+					n.Block(x, y)
+					n.Block(y, x)
+				}
+			}
+		}
+	}
+}
+
+// Heal resets every link back to the default link, perfect delivery unless
+// SetDefaultLink was called.
+func (n *MockNetwork) Heal() {
+	n.linkLock.Lock()
+	defer n.linkLock.Unlock()
+	n.links = nil
+}
+
+// route reports whether a packet from one transport to another gets
+// delivered, and after what delay.
+func (n *MockNetwork) route(from, to string) (time.Duration, bool) {
+	n.linkLock.Lock()
+	defer n.linkLock.Unlock()
+
+	l := n.linkLocked(from, to)
+	if l.Blocked {
+		return 0, false
+	}
+	if n.rng == nil && (l.DropRate > 0 || l.Jitter > 0) {
+		n.rng = rand.New(rand.NewSource(n.Seed))
+	}
+	if l.DropRate > 0 && n.rng.Float64() < l.DropRate {
+		return 0, false
+	}
+	delay := l.Delay
+	if l.Jitter > 0 {
+		delay += time.Duration(n.rng.Int63n(int64(l.Jitter)))
+	}
+	return delay, true
+}
+
+// dial applies the link model to a stream dial, waiting for the round trip.
+func (n *MockNetwork) dial(from, to string, a pkg.Address, timeout time.Duration) error {
+	n.linkLock.Lock()
+	fwd := n.linkLocked(from, to)
+	rev := n.linkLocked(to, from)
+	n.linkLock.Unlock()
+
+	if fwd.Blocked || rev.Blocked {
+		if timeout > 0 {
+			time.Sleep(timeout)
+		}
+		return fmt.Errorf("dial %s: i/o timeout", a)
+	}
+	if fwd.DialFail {
+		return fmt.Errorf("dial %s: connection refused", a)
+	}
+	if rtt := fwd.Delay + rev.Delay; rtt > 0 {
+		if timeout > 0 && rtt > timeout {
+			time.Sleep(timeout)
+			return fmt.Errorf("dial %s: i/o timeout", a)
+		}
+		time.Sleep(rtt)
+	}
+	return nil
 }
 
 // NewTransport returns a new MockTransport with a unique Address, wired up to
@@ -24,10 +207,11 @@ func (n *MockNetwork) NewTransport(name string) *MockTransport {
 	n.port += 1
 	Addr := fmt.Sprintf("127.0.0.1:%d", n.port)
 	Transport := &MockTransport{
-		net:      n,
-		Addr:     &MockAddress{Addr, name},
-		packetCh: make(chan *Packet),
-		StreamCh: make(chan net.Conn),
+		net:        n,
+		Addr:       &MockAddress{Addr, name},
+		packetCh:   make(chan *Packet, mockPacketBuffer),
+		StreamCh:   make(chan net.Conn),
+		shutdownCh: make(chan struct{}),
 	}
 
 	if n.TransportsByAddr == nil {
@@ -66,6 +250,9 @@ type MockTransport struct {
 	Addr     *MockAddress
 	packetCh chan *Packet
 	StreamCh chan net.Conn
+
+	shutdownOnce sync.Once
+	shutdownCh   chan struct{}
 }
 
 var _ NodeAwareTransport = (*MockTransport)(nil)
@@ -103,15 +290,44 @@ func (t *MockTransport) WriteToAddress(b []byte, a pkg.Address) (time.Time, erro
 		return time.Time{}, err
 	}
 
+	// Like UDP, a dropped packet is not an error for the sender.
 	now := time.Now()
-	dest.packetCh <- &Packet{
+	delay, ok := t.net.route(t.Addr.name, dest.Addr.name)
+	if !ok {
+		return now, nil
+	}
+
+	if delay > 0 {
+		buf := make([]byte, len(b))
+		copy(buf, b)
+		time.AfterFunc(delay, func() {
+			t.deliver(dest, &Packet{
+				Buf:       buf,
+				From:      t.Addr,
+				Timestamp: time.Now(),
+			})
+		})
+		return now, nil
+	}
+
+	t.deliver(dest, &Packet{
 		Buf:       b,
 		From:      t.Addr,
 		Timestamp: now,
-	}
+	})
 	return now, nil
 }
 
+// deliver puts a packet into dest's buffer, giving up once either end has
+// been shut down so senders never block forever on a full buffer.
+func (t *MockTransport) deliver(dest *MockTransport, p *Packet) {
+	select {
+	case dest.packetCh <- p:
+	case <-dest.shutdownCh:
+	case <-t.shutdownCh:
+	}
+}
+
 // See Transport.
 func (t *MockTransport) PacketCh() <-chan *Packet {
 	return t.packetCh
@@ -158,11 +374,25 @@ func (t *MockTransport) DialAddressTimeout(a pkg.Address, timeout time.Duration)
 		return nil, err
 	}
 
+	if err := t.net.dial(t.Addr.name, dest.Addr.name, a, timeout); err != nil {
+		return nil, err
+	}
+
 	p1, p2 := net.Pipe()
-	dest.StreamCh <- p1
-	return p2, nil
+	dest.StreamCh <- &mockConn{Conn: p1, local: dest.Addr, remote: t.Addr}
+	return &mockConn{Conn: p2, local: t.Addr, remote: dest.Addr}, nil
+}
+
+// mockConn reports the transports' addresses instead of the pipe's, like a
+// real stream would.
+type mockConn struct {
+	net.Conn
+	local, remote *MockAddress
 }
 
+func (c *mockConn) LocalAddr() net.Addr  { return c.local }
+func (c *mockConn) RemoteAddr() net.Addr { return c.remote }
+
 // See Transport.
 func (t *MockTransport) GetStreamCh() <-chan net.Conn {
 	return t.StreamCh
@@ -176,6 +406,7 @@ func (t *MockTransport) IngestStream(conn net.Conn) error {
 
 // See Transport.
 func (t *MockTransport) SetShutdown() error {
+	t.shutdownOnce.Do(func() { close(t.shutdownCh) })
 	return nil
 }
 
@@ -17,7 +17,7 @@ import (
 const (
 	ProtocolVersionMin         uint8 = 1 // 协议版本
 	ProtocolVersion2Compatible       = 2
-	ProtocolVersionMax               = 5
+	ProtocolVersionMax               = 6 // 6: 认识 TrackedMsg
 )
 
 // MessageType 一个字节的大小，消息类型
@@ -26,18 +26,30 @@ type MessageType uint8
 const (
 	PingMsg MessageType = iota
 	IndirectPingMsg
-	AckRespMsg  // PING 确认
-	SuspectMsg  // 怀疑消息
-	AliveMsg    // 存活消息
-	DeadMsg     // 死亡消息
-	PushPullMsg // 推拉消息
-	CompoundMsg // 复合消息
-	UserMsg     // 用户消息、不处理
-	CompressMsg // 压缩消息
-	EncryptMsg  // 加密消息
-	NAckRespMsg // 没有收到确认消息
-	HasCrcMsg   // 校验消息
-	ErrMsg      // 错误消息
+	AckRespMsg   // PING 确认
+	SuspectMsg   // 怀疑消息
+	AliveMsg     // 存活消息
+	DeadMsg      // 死亡消息
+	PushPullMsg  // 推拉消息
+	CompoundMsg  // 复合消息
+	UserMsg      // 用户消息、不处理
+	CompressMsg  // 压缩消息
+	EncryptMsg   // 加密消息
+	NAckRespMsg  // 没有收到确认消息
+	HasCrcMsg    // 校验消息
+	ErrMsg       // 错误消息
+	RequestMsg   // 请求消息
+	ResponseMsg  // 响应消息
+	QueryMsg     // 查询消息
+	QueryRespMsg // 查询的确认、响应
+	UserEventMsg // 用户事件
+	TrackedMsg   // 带送达跟踪的广播
+	TrackAckMsg  // 对带跟踪广播的确认
+	AppMsg       // 应用广播
+	MapMsg       // 复制map的写入
+	VoteReqMsg   // 名字冲突投票请求
+	VoteRespMsg  // 名字冲突投票
+	VoteLostMsg  // 名字冲突落败通知
 )
 
 const (
@@ -157,6 +169,8 @@ type Alive struct {
 	// protocol/delegate各个版本、按照如下排序
 	// pmin, pmax, pcur, dmin, dmax, dcur
 	Vsn []uint8
+
+	ID []byte // 可选的稳定节点ID
 }
 
 // Dead is broadcast when we confirm a node is Dead
@@ -165,13 +179,20 @@ type Dead struct {
 	Incarnation uint32
 	Node        string
 	From        string // Include who is Suspecting
+	ID          []byte // 被宣布死亡的节点ID,为空时只按名字匹配
 }
 
-// PushPullHeader 用来通知对方我们要转移多少个state
+// PushPullHeader 用来通知对方我们要转移多少个state。
+// 应用广播和复制map的项跟在用户状态之后,旧版本只读到用户状态为止,不会受影响
 type PushPullHeader struct {
-	Nodes        int  // 节点数量
-	UserStateLen int  // 节点状态数据长度
-	Join         bool // 是否加入集群
+	Nodes        int                   // 节点数量
+	UserStateLen int                   // 节点状态数据长度
+	Join         bool                  // 是否加入集群
+	AppLog       bool                  // 发送方启用了应用广播日志,对方只在这时回复它缺少的应用广播
+	AppVersions  map[string]AppVersion // 应用广播的版本向量
+	AppEntries   int                   // 对方缺少的应用广播数量
+	MapDigest    []uint64              // 发送方复制map每个桶的摘要,为空表示没有启用复制map
+	MapEntries   int                   // 摘要与对方不同的桶中的复制map项数
 }
 
 // UserMsgHeader is used to encapsulate a UserMsg
@@ -188,6 +209,7 @@ type PushNodeState struct {
 	Incarnation uint32
 	State       NodeStateType
 	Vsn         []uint8 // 协议版本
+	ID          []byte  // 可选的稳定节点ID
 }
 
 // Compress  包装数据、压缩算法
@@ -196,13 +218,6 @@ type Compress struct {
 	Buf  []byte
 }
 
-// msgHandoff 用于在goroutine之间消息传递
-type msgHandoff struct {
-	msgType MessageType
-	buf     []byte
-	from    net.Addr
-}
-
 // ------------------------------------------ OVER ---------------------------------------
 
 // SendPingAndWaitForAck TCP与给定的地址建立一个流连接，发送 Ping，并等待Ack。所有这些都是在给定的Deadline下，以一系列阻塞操作的方式完成的。
@@ -298,8 +313,18 @@ func (m *Members) sendMsg(a pkg.Address, msg []byte) error {
 	if m.Config.EncryptionEnabled() && m.Config.GossipVerifyOutgoing {
 		bytesAvail -= encryptOverhead(m.EncryptionVersion()) // Version: 1, IV: 12, Tag: 16   // 29
 	}
+	// 捎带给目标节点的确认
+	ack := m.takeDeliveryAcks(a.Name)
+	if ack != nil {
+		bytesAvail -= len(ack) + CompoundOverhead
+	}
+
 	// 额外可以发送的消息，再一次UDP发包过程中
 	extra := m.getBroadcasts(CompoundOverhead, bytesAvail) // 2  1303
+	extra = m.recordSent(a.Name, extra)
+	if ack != nil {
+		extra = append(extra, ack)
+	}
 
 	// Fast path if nothing to piggypack
 	if len(extra) == 0 {
@@ -506,21 +531,9 @@ func (m *Members) DecryptRemoteState(bufConn io.Reader, streamLabel string) ([]b
 	return DecryptPayload(keys, cipherBytes, dataBytes)
 }
 
-// getNextMessage 使用LIFO，按优先级顺序返回下一个要处理的消息
-func (m *Members) getNextMessage() (msgHandoff, bool) {
-	m.msgQueueLock.Lock()
-	defer m.msgQueueLock.Unlock()
-
-	if el := m.HighPriorityMsgQueue.Back(); el != nil {
-		m.HighPriorityMsgQueue.Remove(el)
-		msg := el.Value.(msgHandoff)
-		return msg, true
-	} else if el := m.LowPriorityMsgQueue.Back(); el != nil {
-		m.LowPriorityMsgQueue.Remove(el)
-		msg := el.Value.(msgHandoff)
-		return msg, true
-	}
-	return msgHandoff{}, false
+// getNextMessage 按调度器决定的顺序返回下一个要处理的消息
+func (m *Members) getNextMessage() (HandoffMsg, bool) {
+	return m.HandoffQueue.Pop()
 }
 
 // ensureCanConnect 确保IP能够链接
@@ -3,10 +3,12 @@ package memberlist
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/memberlist/pkg"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync/atomic"
 	"time"
@@ -31,6 +33,10 @@ func (m *Members) handleConn(conn net.Conn) {
 	defer conn.Close()
 	m.Logger.Printf("[DEBUG] memberlist: 流连接 %s", pkg.LogConn(conn))
 
+	if !m.admitSource(conn.RemoteAddr()) {
+		return
+	}
+
 	conn.SetDeadline(time.Now().Add(m.Config.TCPTimeout))
 
 	var (
@@ -46,6 +52,7 @@ func (m *Members) handleConn(conn net.Conn) {
 	if m.Config.SkipInboundLabelCheck {
 		if streamLabel != "" {
 			m.Logger.Printf("[错误] memberlist: 意外的流标签头: %s", pkg.LogConn(conn))
+			m.rejectLabel(conn, streamLabel)
 			return
 		}
 		streamLabel = m.Config.Label
@@ -53,6 +60,7 @@ func (m *Members) handleConn(conn net.Conn) {
 
 	if m.Config.Label != streamLabel {
 		m.Logger.Printf("[错误] memberlist: 丢弃带有不可接受的标签的流 %q: %s", streamLabel, pkg.LogConn(conn))
+		m.rejectLabel(conn, streamLabel)
 		return
 	}
 
@@ -77,6 +85,11 @@ func (m *Members) handleConn(conn net.Conn) {
 		return
 	}
 
+	if !m.admit(conn.RemoteAddr(), msgType) {
+		m.Logger.Printf("[DEBUG] memberlist: 流被限流 (%d) %s", msgType, pkg.LogConn(conn))
+		return
+	}
+
 	switch msgType {
 	case UserMsg:
 		if err := m.readUserMsg(bufConn, dec); err != nil {
@@ -92,13 +105,13 @@ func (m *Members) handleConn(conn net.Conn) {
 			return
 		}
 
-		join, remoteNodes, userState, err := m.readRemoteState(bufConn, dec)
+		join, remoteNodes, userState, app, err := m.readRemoteState(bufConn, dec)
 		if err != nil {
 			m.Logger.Printf("[错误] memberlist: 读取远端state失败: %s %s", err, pkg.LogConn(conn))
 			return
 		}
 
-		if err := m.sendLocalState(conn, join, streamLabel); err != nil {
+		if err := m.sendLocalState(conn, join, streamLabel, app); err != nil {
 			m.Logger.Printf("[错误] memberlist:发送本地state失败: %s %s", err, pkg.LogConn(conn))
 			return
 		}
@@ -107,6 +120,18 @@ func (m *Members) handleConn(conn net.Conn) {
 			m.Logger.Printf("[错误] memberlist: Failed push/pull merge: %s %s", err, pkg.LogConn(conn))
 			return
 		}
+		m.mergeAppState(app)
+	case RequestMsg:
+		if err := m.readRequestStream(conn, bufConn, dec, streamLabel); err != nil {
+			m.Logger.Printf("[错误] memberlist: 处理请求失败: %s %s", err, pkg.LogConn(conn))
+		}
+	case ResponseMsg:
+		h, payload, err := decodeRequestFrame(bufConn, dec)
+		if err != nil {
+			m.Logger.Printf("[错误] memberlist: 解码响应失败: %s %s", err, pkg.LogConn(conn))
+			return
+		}
+		m.deliverResponse(h, payload, conn.RemoteAddr(), true)
 	case PingMsg: // ✅ ,使用TCP 接收ping消息
 		var p Ping
 		if err := dec.Decode(&p); err != nil {
@@ -136,6 +161,26 @@ func (m *Members) handleConn(conn net.Conn) {
 	}
 }
 
+// rejectLabel 告诉对方流标签不一致。同时读完对方发送的数据,既不会让对方阻塞在写上,
+// 也避免关闭时的RST把错误消息冲掉;对方关闭连接或者超时后返回
+func (m *Members) rejectLabel(conn net.Conn, streamLabel string) {
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(drained)
+	}()
+	defer func() { <-drained }()
+
+	out, err := Encode(ErrMsg, &errResp{errLabelMismatch.Error()})
+	if err != nil {
+		m.Logger.Printf("[错误] memberlist: 响应编码失败: %s", err)
+		return
+	}
+	if err := m.RawSendMsgStream(conn, out.Bytes(), streamLabel); err != nil {
+		m.Logger.Printf("[错误] memberlist: 发送失败: %s %s", err, pkg.LogConn(conn))
+	}
+}
+
 // ----------------------------------------- CLIENT -------------------------------------------------
 
 // PushPull is invoked periodically to randomly perform a complete state
@@ -165,71 +210,105 @@ func (m *Members) PushPull() {
 
 // PushPullNode 与一个特定的节点进行完整的状态交换。
 func (m *Members) PushPullNode(a pkg.Address, join bool) error {
+	_, err := m.pushPullNode(context.Background(), a, join)
+	return err
+}
 
-	remote, userState, err := m.sendAndReceiveState(a, join)
+// pushPullNode 与 PushPullNode 相同,并返回对方的节点状态;ctx结束时放弃
+func (m *Members) pushPullNode(ctx context.Context, a pkg.Address, join bool) ([]PushNodeState, error) {
+	remote, userState, app, err := m.sendAndReceiveState(ctx, a, join)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if err := m.mergeRemoteState(join, remote, userState); err != nil {
-		return err
+		return remote, err
 	}
-	return nil
+	m.mergeAppState(app)
+	// 发起方只发送了摘要,对方缺少的部分在这里补发
+	if app.Supported && m.appLogEnabled() {
+		m.repairAppLog(a, app.Versions)
+	}
+	if app.MapDigest != nil && m.Config.EnableReplicatedMap {
+		m.repairMap(a, app.MapDigest)
+	}
+	return remote, nil
 }
 
-// OK 发送本机数据、接收远端数据
-func (m *Members) sendAndReceiveState(a pkg.Address, join bool) ([]PushNodeState, []byte, error) {
+// OK 发送本机数据、接收远端数据。超时不超过ctx的截止时间,ctx结束时关闭连接
+func (m *Members) sendAndReceiveState(ctx context.Context, a pkg.Address, join bool) ([]PushNodeState, []byte, *appState, error) {
 	if a.Name == "" && m.Config.RequireNodeNames {
-		return nil, nil, errNodeNamesAreRequired
+		return nil, nil, nil, errNodeNamesAreRequired
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	timeout := m.Config.TCPTimeout
+	if d, ok := ctx.Deadline(); ok && time.Until(d) < timeout {
+		timeout = time.Until(d)
 	}
-	conn, err := m.Transport.DialAddressTimeout(a, m.Config.TCPTimeout)
+	conn, err := m.Transport.DialAddressTimeout(a, timeout)
 
 	if err != nil {
-		return nil, nil, err
+		if ctx.Err() != nil {
+			return nil, nil, nil, ctx.Err()
+		}
+		return nil, nil, nil, err
 	}
 	defer conn.Close()
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-done:
+			}
+		}()
+	}
 	m.Logger.Printf("[DEBUG] memberlist: 初始化 push/pull 同步和: %s %s", a.Name, conn.RemoteAddr())
 
 	// 发送自身状态,发送数据本身也设置了 TCP Timeout
 	// over_net.go:234 ReadStream
-	if err := m.sendLocalState(conn, join, m.Config.Label); err != nil {
-		return nil, nil, err
+	if err := m.sendLocalState(conn, join, m.Config.Label, nil); err != nil {
+		return nil, nil, nil, err
 	}
 	//sendLocalState、ReadStream 一个发、一个收
 	conn.SetDeadline(time.Now().Add(m.Config.TCPTimeout))
 	//over_net.go:276 sendLocalState
 	msgType, bufConn, dec, err := m.ReadStream(conn, m.Config.Label)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	if msgType == ErrMsg {
 		// 说明sendLocalState 发送过去的数据不对
 		var resp errResp
 		if err := dec.Decode(&resp); err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
-		return nil, nil, fmt.Errorf("remote error: %v", resp.Error)
+		return nil, nil, nil, &remoteError{resp.Error}
 	}
 
 	if msgType != PushPullMsg {
 		err := fmt.Errorf("无效的消息类型 (%d), 期待 PushPullMsg (%d) %s", msgType, PushPullMsg, pkg.LogConn(conn))
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	_, remoteNodes, userState, err := m.readRemoteState(bufConn, dec)
-	return remoteNodes, userState, err
+	_, remoteNodes, userState, app, err := m.readRemoteState(bufConn, dec)
+	return remoteNodes, userState, app, err
 }
 
 // ----------------------------------------- COMMON -------------------------------------------------
 
 // readRemoteState 从链接中读取远程状态
-func (m *Members) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (bool, []PushNodeState, []byte, error) {
+func (m *Members) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (bool, []PushNodeState, []byte, *appState, error) {
 	// PushPullHeader + localNodes + userData
 	// 读 the push/pull 头
 	var header PushPullHeader
 	if err := dec.Decode(&header); err != nil {
-		return false, nil, nil, err
+		return false, nil, nil, nil, err
 	}
 
 	remoteNodes := make([]PushNodeState, header.Nodes)
@@ -237,7 +316,7 @@ func (m *Members) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (bool,
 	// localNodes
 	for i := 0; i < header.Nodes; i++ {
 		if err := dec.Decode(&remoteNodes[i]); err != nil {
-			return false, nil, nil, err
+			return false, nil, nil, nil, err
 		}
 	}
 	// userData == UserState
@@ -249,10 +328,27 @@ func (m *Members) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (bool,
 			err = fmt.Errorf("读取userData 失败 (%d / %d)", bytes, header.UserStateLen)
 		}
 		if err != nil {
-			return false, nil, nil, err
+			return false, nil, nil, nil, err
 		}
 	}
 
+	// 用户状态之后是本地缺少的应用广播和复制map
+	app := &appState{Supported: header.AppLog, Versions: header.AppVersions, MapDigest: header.MapDigest}
+	for i := 0; i < header.AppEntries; i++ {
+		var e AppBroadcast
+		if err := dec.Decode(&e); err != nil {
+			return false, nil, nil, nil, err
+		}
+		app.Entries = append(app.Entries, &e)
+	}
+	for i := 0; i < header.MapEntries; i++ {
+		var e MapEntry
+		if err := dec.Decode(&e); err != nil {
+			return false, nil, nil, nil, err
+		}
+		app.Map = append(app.Map, &e)
+	}
+
 	// 当前版本是2 ,下边可以忽略了
 	for idx := range remoteNodes {
 		if m.ProtocolVersion() < 2 || remoteNodes[idx].Port == 0 {
@@ -260,13 +356,13 @@ func (m *Members) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (bool,
 		}
 	}
 
-	return header.Join, remoteNodes, userBuf, nil
+	return header.Join, remoteNodes, userBuf, app, nil
 }
 
 // mergeRemoteState 合并远程数据到本机
 func (m *Members) mergeRemoteState(join bool, remoteNodes []PushNodeState, userBuf []byte) error {
 	if err := m.VerifyProtocol(remoteNodes); err != nil {
-		return err
+		return &protocolMismatchError{err}
 	}
 
 	// 如果有的话，调用合并委托。
@@ -300,8 +396,9 @@ func (m *Members) mergeRemoteState(join bool, remoteNodes []PushNodeState, userB
 	return nil
 }
 
-// sendLocalState 发送本地状态
-func (m *Members) sendLocalState(conn net.Conn, join bool, streamLabel string) error {
+// sendLocalState 发送本地状态。remote是对方发来的应用广播版本向量和复制map摘要,据此只回复对方缺少的部分;
+// 发起方还不知道对方的状态,传nil,只发送版本向量和摘要
+func (m *Members) sendLocalState(conn net.Conn, join bool, streamLabel string, remote *appState) error {
 	// 设置超时时间
 	conn.SetDeadline(time.Now().Add(m.Config.TCPTimeout))
 
@@ -314,6 +411,7 @@ func (m *Members) sendLocalState(conn net.Conn, join bool, streamLabel string) e
 		localNodes[idx].Incarnation = n.Incarnation
 		localNodes[idx].State = n.State
 		localNodes[idx].Meta = n.Meta
+		localNodes[idx].ID = n.ID
 		localNodes[idx].Vsn = []uint8{
 			n.PMin, n.PMax, n.PCur,
 			n.DMin, n.DMax, n.DCur,
@@ -327,9 +425,31 @@ func (m *Members) sendLocalState(conn net.Conn, join bool, streamLabel string) e
 		userData = m.Config.Delegate.LocalState(join)
 	}
 
-	bufConn := bytes.NewBuffer(nil)
+	header := PushPullHeader{
+		Nodes:        len(localNodes),
+		UserStateLen: len(userData),
+		Join:         join,
+	}
+	// 本地没有启用或者对方不支持的功能什么都不发
+	var app []*AppBroadcast
+	if m.appLogEnabled() {
+		header.AppLog = true
+		header.AppVersions = m.appLog.versions()
+		if remote != nil && remote.Supported {
+			app = m.appLog.missing(remote.Versions)
+		}
+	}
+	var mapEntries []*MapEntry
+	if m.Config.EnableReplicatedMap {
+		header.MapDigest = m.replMap.digest()
+		if remote != nil && remote.MapDigest != nil {
+			mapEntries = m.replMap.delta(remote.MapDigest)
+		}
+	}
+	header.AppEntries = len(app)
+	header.MapEntries = len(mapEntries)
 
-	header := PushPullHeader{Nodes: len(localNodes), UserStateLen: len(userData), Join: join}
+	bufConn := bytes.NewBuffer(nil)
 	hd := codec.MsgpackHandle{}
 	enc := codec.NewEncoder(bufConn, &hd)
 
@@ -345,16 +465,45 @@ func (m *Members) sendLocalState(conn net.Conn, join bool, streamLabel string) e
 			return err
 		}
 	}
-
 	if userData != nil {
 		if _, err := bufConn.Write(userData); err != nil {
 			return err
 		}
 	}
 
+	for _, e := range app {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	for _, e := range mapEntries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
 	return m.RawSendMsgStream(conn, bufConn.Bytes(), streamLabel) // m.Config.Label
 }
 
+// appState push/pull中交换的应用层状态:对方的应用广播版本向量、本地缺少的广播,以及复制map
+type appState struct {
+	Supported bool // 对方启用了应用广播日志
+	Versions  map[string]AppVersion
+	Entries   []*AppBroadcast
+	MapDigest []uint64 // 对方复制map的摘要,为空表示对方没有启用
+	Map       []*MapEntry
+}
+
+// mergeAppState 合并push/pull收到的应用广播和复制map,本地没有启用的功能直接忽略
+func (m *Members) mergeAppState(app *appState) {
+	if m.appLogEnabled() {
+		m.mergeAppLog(app.Versions, app.Entries)
+	}
+	if m.Config.EnableReplicatedMap {
+		m.mergeMapState(app.Map)
+	}
+}
+
 // ReadStream 解密、解压缩消息
 func (m *Members) ReadStream(conn net.Conn, streamLabel string) (MessageType, io.Reader, *codec.Decoder, error) {
 	var bufConn io.Reader = bufio.NewReader(conn)
@@ -368,7 +517,7 @@ func (m *Members) ReadStream(conn net.Conn, streamLabel string) (MessageType, io
 
 	if msgType == EncryptMsg {
 		if !m.Config.EncryptionEnabled() {
-			return 0, nil, nil, fmt.Errorf("远端状态是加密的，但本机加密信息没有配置")
+			return 0, nil, nil, errRemoteEncrypted
 		}
 
 		plain, err := m.DecryptRemoteState(bufConn, streamLabel)
@@ -379,7 +528,7 @@ func (m *Members) ReadStream(conn net.Conn, streamLabel string) (MessageType, io
 		msgType = MessageType(plain[0])
 		bufConn = bytes.NewReader(plain[1:])
 	} else if m.Config.EncryptionEnabled() && m.Config.GossipVerifyIncoming {
-		return 0, nil, nil, fmt.Errorf("加密信息已配置,但远程的state没有加密")
+		return 0, nil, nil, errRemoteNotEncrypted
 	}
 
 	hd := codec.MsgpackHandle{}
@@ -132,6 +132,10 @@ func (m *Members) PacketListen() {
 
 // HandleIngestPacket 接收包,解密、校验
 func (m *Members) HandleIngestPacket(buf []byte, from net.Addr, timestamp time.Time) {
+	if !m.admitSource(from) {
+		return
+	}
+
 	var (
 		packetLabel string
 		err         error
@@ -196,6 +200,11 @@ func (m *Members) HandleCommand(buf []byte, from net.Addr, timestamp time.Time)
 	msgType := MessageType(buf[0])
 	buf = buf[1:]
 
+	// 复合、压缩、带跟踪的消息拆开后再逐条检查
+	if msgType != CompoundMsg && msgType != CompressMsg && msgType != TrackedMsg && !m.admit(from, msgType) {
+		return
+	}
+
 	switch msgType {
 	case CompoundMsg: // ✅组合消息
 		m.handleCompound(buf, from, timestamp)
@@ -217,21 +226,11 @@ func (m *Members) HandleCommand(buf []byte, from net.Addr, timestamp time.Time)
 		fallthrough
 	case DeadMsg: // ✅ 死亡消息
 		fallthrough
-	case UserMsg: // ✅ 用户消息
-		// 优先Alive
-		queue := m.LowPriorityMsgQueue
-		if msgType == AliveMsg {
-			queue = m.HighPriorityMsgQueue
-		}
-
-		// 检查是否有溢出，如果没有满，则进行追加。
-		m.msgQueueLock.Lock()
-		if queue.Len() >= m.Config.HandoffQueueDepth {
+	case UserMsg, RequestMsg, QueryMsg, UserEventMsg, AppMsg, MapMsg: // ✅ 用户消息、请求、查询、事件、应用广播、复制map
+		// 由调度器决定排队和溢出时的丢弃
+		if !m.HandoffQueue.Push(HandoffMsg{msgType, buf, from}) {
 			m.Logger.Printf("[WARN] memberlist: 队列溢出 (%d) %s", msgType, pkg.LogAddress(from))
-		} else {
-			queue.PushBack(msgHandoff{msgType, buf, from}) // 移交消息
 		}
-		m.msgQueueLock.Unlock()
 
 		// 通知有待处理的信息
 		select {
@@ -239,6 +238,21 @@ func (m *Members) HandleCommand(buf []byte, from net.Addr, timestamp time.Time)
 		default:
 		}
 
+	case ResponseMsg:
+		m.handleResponse(buf, from)
+	case QueryRespMsg:
+		m.handleQueryResp(buf, from)
+	case TrackedMsg:
+		m.handleTracked(buf, from, timestamp)
+	case TrackAckMsg:
+		m.handleDeliveryAck(buf, from)
+	case VoteReqMsg:
+		m.handleVoteReq(buf, from)
+	case VoteRespMsg:
+		m.handleVoteResp(buf, from)
+	case VoteLostMsg:
+		m.handleVoteLost(buf, from)
+
 	default:
 		m.Logger.Printf("[错误] memberlist: 消息类型不支持 (%d) %s", msgType, pkg.LogAddress(from))
 	}
@@ -606,9 +620,23 @@ func (m *Members) Gossip() {
 	// 1 --> b
 	// 2 --> c
 	// 3 --> d
+	// 没有机会捎带的确认在本轮结束后直接发送
+	defer m.flushDeliveryAcks()
+
 	for _, node := range kNodes {
+		// 捎带给该节点的确认
+		ack := m.takeDeliveryAcks(node.Name)
+		avail := bytesAvail
+		if ack != nil {
+			avail -= len(ack) + CompoundOverhead
+		}
+
 		// 获取任何未完成的广播节目
-		msgs := m.getBroadcasts(CompoundOverhead, bytesAvail)
+		msgs := m.getBroadcasts(CompoundOverhead, avail)
+		msgs = m.recordSent(node.Name, msgs)
+		if ack != nil {
+			msgs = append(msgs, ack)
+		}
 		if len(msgs) == 0 {
 			return
 		}
@@ -2,9 +2,15 @@ package memberlist
 
 import (
 	"github.com/hashicorp/memberlist/pkg"
+	"hash/fnv"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
+// defaultUserMsgWorkerQueue 每个用户消息worker默认的队列长度
+const defaultUserMsgWorkerQueue = 64
+
 // ----------------------------------------- OK -------------------------------------------------
 
 // PacketHandler 从listener解耦出来,避免阻塞 ,导致ping\ack延迟
@@ -17,9 +23,9 @@ func (m *Members) PacketHandler() {
 				if !ok {
 					break
 				}
-				msgType := msg.msgType
-				buf := msg.buf
-				from := msg.from
+				msgType := msg.MsgType
+				buf := msg.Buf
+				from := msg.From
 				switch msgType {
 				case SuspectMsg: // ✅
 					m.handleSuspect(buf, from)
@@ -27,8 +33,8 @@ func (m *Members) PacketHandler() {
 					m.handleAlive(buf, from)
 				case DeadMsg: // ✅
 					m.handleDead(buf, from)
-				case UserMsg: // ✅
-					m.handleUser(buf, from)
+				case UserMsg, RequestMsg, QueryMsg, UserEventMsg, AppMsg, MapMsg: // ✅
+					m.dispatchUser(msg)
 				default:
 					m.Logger.Printf("[错误] memberlist: 消息类型不支持 (%d) 不支持 %s (packet handler)", msgType, pkg.LogAddress(from))
 				}
@@ -39,6 +45,94 @@ func (m *Members) PacketHandler() {
 	}
 }
 
+// startUserWorkers 根据配置启动处理用户消息的worker;没有配置时用户消息在PacketHandler中直接处理
+func (m *Members) startUserWorkers() {
+	n := m.Config.UserMsgWorkers
+	if n <= 0 {
+		return
+	}
+	depth := m.Config.UserMsgWorkerQueue
+	if depth <= 0 {
+		depth = defaultUserMsgWorkerQueue
+	}
+	m.userWorkers = make([]chan HandoffMsg, n)
+	for i := range m.userWorkers {
+		ch := make(chan HandoffMsg, depth)
+		m.userWorkers[i] = ch
+		go m.userWorker(ch)
+	}
+}
+
+// userWorker 处理分配给它的用户消息,慢的NotifyMsg只会阻塞这个worker
+func (m *Members) userWorker(ch chan HandoffMsg) {
+	for {
+		select {
+		case msg := <-ch:
+			m.handleUserClass(msg)
+		case <-m.ShutdownCh:
+			return
+		}
+	}
+}
+
+// dispatchUser 把用户消息交给worker;worker队列满时最多等待 UserMsgDispatchTimeout,
+// 超时则丢弃,保证成员消息的处理不会被NotifyMsg拖慢
+func (m *Members) dispatchUser(msg HandoffMsg) {
+	if len(m.userWorkers) == 0 {
+		m.handleUserClass(msg)
+		return
+	}
+
+	var idx int
+	if m.Config.UserMsgShardBySender && msg.From != nil {
+		// 同一个发送方总是落在同一个worker上,保持发送方内的顺序
+		h := fnv.New32a()
+		h.Write([]byte(msg.From.String()))
+		idx = int(h.Sum32() % uint32(len(m.userWorkers)))
+	} else {
+		idx = int(atomic.AddUint32(&m.userWorkerNext, 1) % uint32(len(m.userWorkers)))
+	}
+	ch := m.userWorkers[idx]
+
+	select {
+	case ch <- msg:
+		return
+	default:
+	}
+
+	if wait := m.Config.UserMsgDispatchTimeout; wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case ch <- msg:
+			return
+		case <-timer.C:
+		case <-m.ShutdownCh:
+			return
+		}
+	}
+	atomic.AddUint64(&m.dispatchDropped, 1)
+	m.Logger.Printf("[WARN] memberlist: 用户消息worker繁忙,丢弃消息 %s", pkg.LogAddress(msg.From))
+}
+
+// handleUserClass 处理用户类别的消息
+func (m *Members) handleUserClass(msg HandoffMsg) {
+	switch msg.MsgType {
+	case RequestMsg:
+		m.handleRequest(msg.Buf, msg.From)
+	case QueryMsg:
+		m.handleQuery(msg.Buf, msg.From)
+	case UserEventMsg:
+		m.handleUserEvent(msg.Buf, msg.From)
+	case AppMsg:
+		m.handleAppBroadcast(msg.Buf, msg.From)
+	case MapMsg:
+		m.handleMapEntry(msg.Buf, msg.From)
+	default:
+		m.handleUser(msg.Buf, msg.From)
+	}
+}
+
 // OK
 func (m *Members) handleSuspect(buf []byte, from net.Addr) {
 	var sus Suspect
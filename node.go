@@ -57,6 +57,7 @@ func (m *Members) SuspectNode(s *Suspect) {
 	state.State = StateSuspect
 	changeTime := time.Now()
 	state.StateChange = changeTime
+	m.recordFailure(state.Name)
 
 	// Setup a Suspicion timer. Given that we don't have any known phase
 	// relationship with our peers, we set up k such that we hit the nominal
@@ -75,7 +76,7 @@ func (m *Members) SuspectNode(s *Suspect) {
 	}
 
 	// Compute the timeouts based on the size of the cluster.
-	min := SuspicionTimeout(m.Config.SuspicionMult, n, m.Config.ProbeInterval)
+	min := SuspicionTimeout(m.Config.SuspicionMult, n, m.Config.ProbeInterval) * m.suspicionScale()
 	max := time.Duration(m.Config.SuspicionMaxTimeoutMult) * min
 	fn := func(numConfirmations int) { // 超时 时收到的确认数
 		var d *Dead
@@ -84,7 +85,7 @@ func (m *Members) SuspectNode(s *Suspect) {
 		state, ok := m.NodeMap[s.Node]
 		timeout := ok && state.State == StateSuspect && state.StateChange == changeTime
 		if timeout {
-			d = &Dead{Incarnation: state.Incarnation, Node: state.Name, From: m.Config.Name}
+			d = &Dead{Incarnation: state.Incarnation, Node: state.Name, From: m.Config.Name, ID: state.ID}
 		}
 		m.NodeLock.Unlock()
 
@@ -110,13 +111,36 @@ func (m *Members) LocalNode() *Node {
 
 // UpdateNode 重新发送广播本地节点的信息
 func (m *Members) UpdateNode(timeout time.Duration) error {
-	var meta []byte
-	if m.Config.Delegate != nil {
-		meta = m.Config.Delegate.NodeMeta(MetaMaxSize)
-		if len(meta) > MetaMaxSize {
-			panic("元信息超过了最大长度限制")
+	notifyCh := make(chan struct{})
+	m.broadcastSelf(notifyCh)
+
+	// 等待广播消息、或者超时
+	if m.anyAlive() {
+		var timeoutCh <-chan time.Time
+		if timeout > 0 {
+			timeoutCh = time.After(timeout)
+		}
+		select {
+		case <-notifyCh:
+		case <-timeoutCh:
+			return fmt.Errorf("广播更新超时")
 		}
 	}
+	return nil
+}
+
+// UpdateNodeTracked 与 UpdateNode 一样重新广播本地节点的信息,但不等待,返回的跟踪用于等待送达
+func (m *Members) UpdateNodeTracked(mode DeliveryMode) *Delivery {
+	notifyCh := make(chan struct{}, 1)
+	d := m.newDelivery(mode, notifyCh)
+	m.broadcastSelf(notifyCh)
+	m.takeNotify(notifyCh)
+	return d
+}
+
+// broadcastSelf 增加incarnation并广播本地节点的Alive消息
+func (m *Members) broadcastSelf(notifyCh chan struct{}) {
+	meta := m.localMeta()
 
 	m.NodeLock.RLock()
 	state := m.NodeMap[m.Config.Name]
@@ -129,23 +153,9 @@ func (m *Members) UpdateNode(timeout time.Duration) error {
 		Port:        state.Port,
 		Meta:        meta,
 		Vsn:         m.Config.BuildVsnArray(),
+		ID:          state.ID,
 	}
-	notifyCh := make(chan struct{})
 	m.AliveNode(&a, notifyCh, true) // 发送成功,会给notifyCh发消息
-
-	// 等待广播消息、或者超时
-	if m.anyAlive() {
-		var timeoutCh <-chan time.Time
-		if timeout > 0 {
-			timeoutCh = time.After(timeout)
-		}
-		select {
-		case <-notifyCh:
-		case <-timeoutCh:
-			return fmt.Errorf("广播更新超时")
-		}
-	}
-	return nil
 }
 
 // Members returns 返回已知的存活节点,返回的结构体不能被修改。
@@ -203,11 +213,12 @@ func (m *Members) MergeState(remote []PushNodeState) {
 				Port:        r.Port,
 				Meta:        r.Meta,
 				Vsn:         r.Vsn,
+				ID:          r.ID,
 			}
 			//m.AliveNode(&a, nil, true) // 存储节点state,广播存活消息
 			m.AliveNode(&a, nil, false)
 		case StateLeft:
-			d := Dead{Incarnation: r.Incarnation, Node: r.Name, From: r.Name}
+			d := Dead{Incarnation: r.Incarnation, Node: r.Name, From: r.Name, ID: r.ID}
 			m.DeadNode(&d)
 		case StateDead:
 			// 如果远程节点认为某个节点已经Dead，我们更愿意Suspect该节点，而不是立即宣布其死亡。
@@ -279,6 +290,7 @@ func (m *Members) AliveNode(a *Alive, notify chan struct{}, bootstrap bool) {
 				Addr: a.Addr,
 				Port: a.Port, // 8000
 				Meta: a.Meta, // nil
+				ID:   a.ID,
 			},
 			State: StateDead,
 		}
@@ -304,6 +316,7 @@ func (m *Members) AliveNode(a *Alive, notify chan struct{}, bootstrap bool) {
 		// 更新节点数
 		atomic.AddUint32(&m.numNodes, 1)
 	} else {
+		sameID, otherID := compareNodeID(state.ID, a.ID)
 		// Check if this Address is different than the existing node unless the old node is Dead.
 		if !bytes.Equal([]byte(state.Addr), a.Addr) || state.Port != a.Port {
 			errCon := m.Config.IPAllowed(a.Addr)
@@ -316,10 +329,26 @@ func (m *Members) AliveNode(a *Alive, notify chan struct{}, bootstrap bool) {
 				time.Since(state.StateChange) > m.Config.DeadNodeReclaimTime)
 
 			// Allow the Address to be updated if a Dead node is being replaced.
-			if state.State == StateLeft || (state.State == StateDead && canReclaim) {
+			// 不同的节点ID说明是另一台机器接替了死亡节点的名字,不必等待 DeadNodeReclaimTime
+			if state.State == StateLeft || (state.State == StateDead && (canReclaim || otherID)) {
 				m.Logger.Printf("[INFO] memberlist: Updating Address for left or failed node %s from %v:%d to %v:%d",
 					state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port)
 				updatesNode = true
+			} else if sameID {
+				// 同一个节点换了地址重新上线,重启后incarnation可能更低,死亡的记录也不必等待 DeadNodeReclaimTime。
+				// 接受新的地址并以更高的incarnation广播;旧地址上迟到的消息只有incarnation更高时才接受
+				if sameAddr(a.Addr, a.Port, state.movedFrom) && a.Incarnation <= state.Incarnation {
+					return
+				}
+				m.Logger.Printf("[DEBUG] memberlist: 节点 %s 的地址从 %v:%d 变为 %v:%d (ID %x)",
+					state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port, a.ID)
+				if a.Incarnation <= state.Incarnation {
+					moved := *a
+					moved.Incarnation = state.Incarnation + 1
+					a = &moved
+				}
+				state.movedFrom = Node{Addr: state.Addr, Port: state.Port}
+				updatesNode = true
 			} else {
 				m.Logger.Printf("[错误] memberlist: Conflicting Address for %s. Mine: %v:%d Theirs: %v:%d Old state: %v",
 					state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port, state.State)
@@ -334,8 +363,12 @@ func (m *Members) AliveNode(a *Alive, notify chan struct{}, bootstrap bool) {
 					}
 					m.Config.Conflict.NotifyConflict(&state.Node, &other)
 				}
+				m.startConflictVote(state.Node, Node{Name: a.Node, Addr: a.Addr, Port: a.Port, Meta: a.Meta})
 				return
 			}
+		} else if otherID && state.DeadOrLeft() {
+			// 同一个地址上换了一台机器,incarnation重新开始
+			updatesNode = true
 		}
 	}
 
@@ -360,6 +393,7 @@ func (m *Members) AliveNode(a *Alive, notify chan struct{}, bootstrap bool) {
 
 	oldState := state.State
 	oldMeta := state.Meta
+	oldAddr, oldPort := state.Addr, state.Port
 
 	if !bootstrap && isLocalNode { // 运行初是     true,true,不会走这里
 		versions := []uint8{
@@ -395,10 +429,14 @@ func (m *Members) AliveNode(a *Alive, notify chan struct{}, bootstrap bool) {
 		state.Meta = a.Meta
 		state.Addr = a.Addr
 		state.Port = a.Port
+		if len(a.ID) > 0 {
+			state.ID = a.ID
+		}
 		if state.State != StateAlive {
 			// 初始状态是StateDead
 			state.State = StateAlive
 			state.StateChange = time.Now()
+			state.DeclaredBy = ""
 		}
 	}
 
@@ -407,7 +445,7 @@ func (m *Members) AliveNode(a *Alive, notify chan struct{}, bootstrap bool) {
 		if oldState == StateDead || oldState == StateLeft {
 			// Dead/Left -> Alive, notify of join
 			m.Config.Events.NotifyJoin(&state.Node)
-		} else if !bytes.Equal(oldMeta, state.Meta) {
+		} else if !bytes.Equal(oldMeta, state.Meta) || !bytes.Equal(oldAddr, state.Addr) || oldPort != state.Port {
 			m.Config.Events.NotifyUpdate(&state.Node)
 		}
 	}
@@ -423,6 +461,11 @@ func (m *Members) DeadNode(d *Dead) {
 		return
 	}
 
+	// 关于同名的另一个节点ID的死亡消息,与当前的节点无关
+	if _, otherID := compareNodeID(state.ID, d.ID); otherID {
+		return
+	}
+
 	// 忽略旧的Incarnation号
 	if d.Incarnation < state.Incarnation {
 		return
@@ -455,8 +498,10 @@ func (m *Members) DeadNode(d *Dead) {
 		state.State = StateLeft
 	} else {
 		state.State = StateDead
+		m.recordFailure(state.Name)
 	}
 	state.StateChange = time.Now()
+	state.DeclaredBy = d.From
 
 	if m.Config.Events != nil {
 		m.Config.Events.NotifyLeave(&state.Node)
@@ -0,0 +1,35 @@
+package memberlist
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+)
+
+// NodeIDSize 节点ID的长度
+const NodeIDSize = 16
+
+// GenerateNodeID 生成一个随机的128位节点ID。调用方应持久化它,重启后使用同一个ID
+func GenerateNodeID() ([]byte, error) {
+	id := make([]byte, NodeIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("生成节点ID失败: %v", err)
+	}
+	return id, nil
+}
+
+func validateNodeID(id []byte) error {
+	if len(id) != 0 && len(id) != NodeIDSize {
+		return fmt.Errorf("节点ID必须是 %d 字节, 实际 %d", NodeIDSize, len(id))
+	}
+	return nil
+}
+
+// compareNodeID 双方都带有ID时才能比较;任何一方没有ID都返回false,false,按名字处理
+func compareNodeID(mine, theirs []byte) (same, other bool) {
+	if len(mine) == 0 || len(theirs) == 0 {
+		return false, false
+	}
+	same = bytes.Equal(mine, theirs)
+	return same, !same
+}
@@ -0,0 +1,160 @@
+package memberlist
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// partitionMinLost 至少有这么多节点在窗口内失败,才可能判定为分区
+const partitionMinLost = 2
+
+// PartitionEvent 分区检测的事件
+type PartitionEvent struct {
+	Partitioned bool      // true 表示检测到分区,false 表示分区结束
+	Lost        []string  // 检测到分区时是失联的节点;结束时是没有回来的节点
+	Time        time.Time // 事件发生的时间
+}
+
+// partitionDetector 记录窗口内的 suspect/dead 转换
+type partitionDetector struct {
+	lock        sync.Mutex
+	transitions map[string]time.Time
+	partitioned bool
+	lost        map[string]struct{}
+	seeds       []string
+}
+
+func newPartitionDetector() *partitionDetector {
+	return &partitionDetector{transitions: make(map[string]time.Time)}
+}
+
+// setSeeds 记录第一次成功加入时使用的种子节点,分区期间用于重新加入
+func (p *partitionDetector) setSeeds(seeds []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.seeds) == 0 {
+		p.seeds = append([]string(nil), seeds...)
+	}
+}
+
+// Partitioned 是否处于检测到的分区中
+func (m *Members) Partitioned() bool {
+	p := m.partition
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.partitioned
+}
+
+// suspicionScale 分区期间放慢宣布死亡,返回怀疑超时的倍数
+func (m *Members) suspicionScale() time.Duration {
+	if m.Config.PartitionSuspicionMult > 1 && m.Partitioned() {
+		return time.Duration(m.Config.PartitionSuspicionMult)
+	}
+	return 1
+}
+
+// recordFailure 在节点变为 suspect/dead 时调用,持有NodeLock
+func (m *Members) recordFailure(name string) {
+	if m.Config.PartitionThreshold <= 0 || name == m.Config.Name {
+		return
+	}
+	p := m.partition
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	if p.partitioned {
+		p.lost[name] = struct{}{}
+		return
+	}
+	p.transitions[name] = now
+	for n, at := range p.transitions {
+		if now.Sub(at) > m.Config.PartitionWindow {
+			delete(p.transitions, n)
+		}
+	}
+
+	lost := len(p.transitions)
+	if lost < partitionMinLost || float64(lost) < m.Config.PartitionThreshold*float64(m.EstNumNodes()) {
+		return
+	}
+
+	p.partitioned = true
+	p.lost = make(map[string]struct{}, lost)
+	for n := range p.transitions {
+		p.lost[n] = struct{}{}
+	}
+	p.transitions = make(map[string]time.Time)
+	m.Logger.Printf("[WARN] memberlist: 检测到网络分区, %d/%d 个节点在 %s 内失联", lost, m.EstNumNodes(), m.Config.PartitionWindow)
+	go m.partitionLoop()
+}
+
+// lostNames 返回分区中失联的节点
+func (p *partitionDetector) lostNames() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	names := make([]string, 0, len(p.lost))
+	for n := range p.lost {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// partitionLoop 通知分区,定期尝试重新加入种子节点,直到失联的节点回来
+func (m *Members) partitionLoop() {
+	p := m.partition
+	m.notifyPartition(PartitionEvent{Partitioned: true, Lost: p.lostNames(), Time: time.Now()})
+
+	t := time.NewTicker(m.Config.PartitionRejoinInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-m.ShutdownCh:
+			return
+		}
+
+		p.lock.Lock()
+		seeds := p.seeds
+		p.lock.Unlock()
+		if len(seeds) > 0 {
+			if _, err := m.Join(seeds); err != nil {
+				m.Logger.Printf("[DEBUG] memberlist: 分区期间重新加入种子节点失败: %s", err)
+			}
+		}
+
+		// 失联的节点都回来了,或者已经被遗忘,分区结束
+		var missing []string
+		returned := 0
+		m.NodeLock.RLock()
+		for _, name := range p.lostNames() {
+			state, ok := m.NodeMap[name]
+			switch {
+			case !ok:
+				missing = append(missing, name)
+			case !state.DeadOrLeft():
+				returned++
+			}
+		}
+		m.NodeLock.RUnlock()
+		if returned+len(missing) < len(p.lostNames()) {
+			continue
+		}
+
+		p.lock.Lock()
+		p.partitioned = false
+		p.lost = nil
+		p.lock.Unlock()
+		m.Logger.Printf("[INFO] memberlist: 网络分区结束, %d 个节点回来", returned)
+		m.notifyPartition(PartitionEvent{Lost: missing, Time: time.Now()})
+		return
+	}
+}
+
+func (m *Members) notifyPartition(e PartitionEvent) {
+	if m.Config.Partition != nil {
+		m.Config.Partition.NotifyPartition(e)
+	}
+}
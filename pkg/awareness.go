@@ -11,8 +11,12 @@ type Awareness struct {
 	sync.RWMutex
 	// max 超时范围的上限阈值是多少 ( 0 <= score < max).
 	max int
-	// 感知分数、低值是健康的>=0
+	// 感知分数、低值是健康的>=0;只由探测结果调整
 	score int
+	// penalty 本地健康检查的惩罚分数之和,与探测分数分开保存,探测成功不会抵消它
+	penalty int
+	// notify 分数变化时在锁外调用
+	notify func(old, new int)
 }
 
 // NewAwareness 节点健康对象
@@ -26,19 +30,63 @@ func NewAwareness(max int) *Awareness {
 // ApplyDelta 以线程安全的方式获取给定的delta并将其应用到分数上。它还强制执行零的下限和最大的上限，因此，如果delta是在其中一个极端的轨道上，它可能不会改变总分。
 func (a *Awareness) ApplyDelta(delta int) {
 	a.Lock()
+	old := a.healthLocked()
 	a.score += delta
 	if a.score < 0 {
 		a.score = 0
 	} else if a.score > (a.max - 1) {
 		a.score = a.max - 1
 	}
+	score, notify := a.healthLocked(), a.notify
 	a.Unlock()
+
+	if score != old && notify != nil {
+		notify(old, score)
+	}
+}
+
+// ApplyPenalty 增加或减少健康检查的惩罚分数。惩罚不参与探测分数的上下限,
+// 只在计算总分时与探测分数相加后限制一次,所以检查恢复时减去同样的分数总能回到原来的状态
+func (a *Awareness) ApplyPenalty(delta int) {
+	a.Lock()
+	old := a.healthLocked()
+	a.penalty += delta
+	if a.penalty < 0 {
+		a.penalty = 0
+	}
+	score, notify := a.healthLocked(), a.notify
+	a.Unlock()
+
+	if score != old && notify != nil {
+		notify(old, score)
+	}
+}
+
+// healthLocked 探测分数与惩罚分数之和,不超过上限;调用方持有锁
+func (a *Awareness) healthLocked() int {
+	score := a.score + a.penalty
+	if score > a.max-1 {
+		score = a.max - 1
+	}
+	return score
+}
+
+// SetNotify 设置分数变化时的回调,回调可能在多个goroutine中被调用
+func (a *Awareness) SetNotify(fn func(old, new int)) {
+	a.Lock()
+	a.notify = fn
+	a.Unlock()
+}
+
+// Max 分数的上限(不包含)
+func (a *Awareness) Max() int {
+	return a.max
 }
 
 // GetHealthScore 节点的健康程度 数字越小越好，而零意味着 "完全健康"。
 func (a *Awareness) GetHealthScore() int {
 	a.RLock()
-	score := a.score
+	score := a.healthLocked()
 	a.RUnlock()
 	return score
 }
@@ -46,7 +94,7 @@ func (a *Awareness) GetHealthScore() int {
 // ScaleTimeout 根据当前的分数读取持续时间。健康程度较低将导致更长的超时。
 func (a *Awareness) ScaleTimeout(timeout time.Duration) time.Duration {
 	a.RLock()
-	score := a.score
+	score := a.healthLocked()
 	a.RUnlock()
 	return timeout * (time.Duration(score) + 1)
 }
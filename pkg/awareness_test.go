@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAwareness_Notify(t *testing.T) {
+	a := NewAwareness(3)
+	var got [][2]int
+	a.SetNotify(func(old, new int) { got = append(got, [2]int{old, new}) })
+
+	a.ApplyDelta(1)
+	a.ApplyDelta(5) // 到达上限
+	a.ApplyDelta(1) // 不变,不通知
+	a.ApplyDelta(-10)
+	want := [][2]int{{0, 1}, {1, 2}, {2, 0}}
+	if len(got) != len(want) {
+		t.Fatalf("bad: %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("bad: %v", got)
+		}
+	}
+	if d := a.ScaleTimeout(time.Second); d != time.Second {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestAwareness_Penalty(t *testing.T) {
+	a := NewAwareness(8)
+	var got [][2]int
+	a.SetNotify(func(old, new int) { got = append(got, [2]int{old, new}) })
+
+	a.ApplyPenalty(3)
+	a.ApplyDelta(-1) // 探测成功不会抵消惩罚
+	if s := a.GetHealthScore(); s != 3 {
+		t.Fatalf("bad: %d", s)
+	}
+	a.ApplyDelta(6) // 总分到达上限
+	if s := a.GetHealthScore(); s != 7 {
+		t.Fatalf("bad: %d", s)
+	}
+	a.ApplyPenalty(-3) // 恢复后只剩探测分数
+	if s := a.GetHealthScore(); s != 6 {
+		t.Fatalf("bad: %d", s)
+	}
+	a.ApplyDelta(-10)
+	a.ApplyPenalty(-1) // 不会小于0
+	want := [][2]int{{0, 3}, {3, 7}, {7, 6}, {6, 0}}
+	if len(got) != len(want) {
+		t.Fatalf("bad: %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("bad: %v", got)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrClockDrift 远端时间超前本地物理时钟超过 HybridClock.MaxDrift
+var ErrClockDrift = errors.New("远端时间超前太多")
+
+// HLC 混合逻辑时钟的时间:物理时间(纳秒)加上逻辑计数,物理时间相同时用逻辑计数排序
+type HLC struct {
+	Wall    int64
+	Logical uint32
+}
+
+// Less 是否早于o
+func (t HLC) Less(o HLC) bool {
+	if t.Wall != o.Wall {
+		return t.Wall < o.Wall
+	}
+	return t.Logical < o.Logical
+}
+
+// IsZero 是否是零值
+func (t HLC) IsZero() bool {
+	return t.Wall == 0 && t.Logical == 0
+}
+
+// HybridClock 并发安全的混合逻辑时钟。时间单调递增,并且大于所有见过的远端时间,
+// 同时尽量接近物理时间
+type HybridClock struct {
+	// Now 物理时钟,为nil时使用time.Now
+	Now func() time.Time
+
+	// MaxDrift 远端时间最多超前本地物理时钟多久,超过时 Update 拒绝它;为0时不限制。
+	// 否则一个时钟错误的节点会把所有节点的时钟推向未来,它的写入也会一直胜出
+	MaxDrift time.Duration
+
+	lock sync.Mutex
+	last HLC
+}
+
+func (c *HybridClock) wall() int64 {
+	if c.Now != nil {
+		return c.Now().UnixNano()
+	}
+	return time.Now().UnixNano()
+}
+
+// Tick 返回一个新的本地时间,用于本地事件
+func (c *HybridClock) Tick() HLC {
+	wall := c.wall()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if wall > c.last.Wall {
+		c.last = HLC{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update 收到远端时间后更新时钟,返回更新后的时间;远端时间超前超过MaxDrift时时钟不变,返回 ErrClockDrift
+func (c *HybridClock) Update(remote HLC) (HLC, error) {
+	wall := c.wall()
+	if c.MaxDrift > 0 && remote.Wall-wall > int64(c.MaxDrift) {
+		return c.Last(), ErrClockDrift
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch {
+	case wall > c.last.Wall && wall > remote.Wall:
+		c.last = HLC{Wall: wall}
+	case remote.Wall > c.last.Wall:
+		c.last = HLC{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	}
+	return c.last, nil
+}
+
+// Last 返回最近一次的时间
+func (c *HybridClock) Last() HLC {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.last
+}
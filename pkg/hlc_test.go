@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHybridClock_Tick(t *testing.T) {
+	now := time.Unix(100, 0)
+	c := &HybridClock{Now: func() time.Time { return now }}
+
+	a := c.Tick()
+	b := c.Tick()
+	if !a.Less(b) || a.Wall != b.Wall || b.Logical != 1 {
+		t.Fatalf("bad: %v %v", a, b)
+	}
+
+	// 物理时钟回拨时仍然单调
+	now = time.Unix(99, 0)
+	if d := c.Tick(); !b.Less(d) {
+		t.Fatalf("not monotonic: %v %v", b, d)
+	}
+
+	now = time.Unix(101, 0)
+	if d := c.Tick(); d.Wall != now.UnixNano() || d.Logical != 0 {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestHybridClock_Update(t *testing.T) {
+	now := time.Unix(100, 0)
+	c := &HybridClock{Now: func() time.Time { return now }}
+	local := c.Tick()
+
+	// 远端时间超前
+	remote := HLC{Wall: time.Unix(200, 0).UnixNano(), Logical: 5}
+	got, err := c.Update(remote)
+	if err != nil || !remote.Less(got) || got.Wall != remote.Wall {
+		t.Fatalf("bad: %v", got)
+	}
+	if next := c.Tick(); !got.Less(next) {
+		t.Fatalf("not monotonic: %v %v", got, next)
+	}
+
+	// 远端时间落后不会让时钟倒退
+	last := c.Last()
+	if got, _ := c.Update(local); !last.Less(got) {
+		t.Fatalf("bad: %v %v", last, got)
+	}
+
+	// 物理时钟超过所有时间
+	now = time.Unix(300, 0)
+	if got, _ := c.Update(remote); got.Wall != now.UnixNano() || got.Logical != 0 {
+		t.Fatalf("bad: %v", got)
+	}
+}
+
+func TestHybridClock_MaxDrift(t *testing.T) {
+	now := time.Unix(100, 0)
+	c := &HybridClock{Now: func() time.Time { return now }, MaxDrift: time.Second}
+	local := c.Tick()
+
+	// 超前太多的时间被拒绝,时钟不变
+	far := HLC{Wall: time.Unix(200, 0).UnixNano()}
+	if got, err := c.Update(far); err != ErrClockDrift || got != local {
+		t.Fatalf("bad: %v %v", got, err)
+	}
+	if next := c.Tick(); next.Wall != local.Wall {
+		t.Fatalf("clock moved: %v", next)
+	}
+
+	// 在范围内的时间照常合并
+	near := HLC{Wall: now.Add(500 * time.Millisecond).UnixNano()}
+	if got, err := c.Update(near); err != nil || !near.Less(got) {
+		t.Fatalf("bad: %v %v", got, err)
+	}
+}
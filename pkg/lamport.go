@@ -0,0 +1,35 @@
+package pkg
+
+import "sync/atomic"
+
+// LamportTime Lamport逻辑时钟的时间
+type LamportTime uint64
+
+// LamportClock 并发安全的Lamport时钟
+type LamportClock struct {
+	counter uint64
+}
+
+// Time 返回当前时间
+func (l *LamportClock) Time() LamportTime {
+	return LamportTime(atomic.LoadUint64(&l.counter))
+}
+
+// Increment 时钟加一并返回新的时间
+func (l *LamportClock) Increment() LamportTime {
+	return LamportTime(atomic.AddUint64(&l.counter, 1))
+}
+
+// Witness 收到其他节点的时间v后更新本地时钟,保证本地时间大于v
+func (l *LamportClock) Witness(v LamportTime) {
+	for {
+		cur := atomic.LoadUint64(&l.counter)
+		other := uint64(v)
+		if other < cur {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&l.counter, cur, other+1) {
+			return
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package pkg
+
+import "testing"
+
+func TestLamportClock(t *testing.T) {
+	l := &LamportClock{}
+
+	if l.Time() != 0 {
+		t.Fatalf("bad time value")
+	}
+	if l.Increment() != 1 || l.Time() != 1 {
+		t.Fatalf("bad time value")
+	}
+
+	l.Witness(41)
+	if l.Time() != 42 {
+		t.Fatalf("bad time value")
+	}
+
+	// 更旧的时间不会让时钟倒退
+	l.Witness(41)
+	if l.Time() != 42 {
+		t.Fatalf("bad time value")
+	}
+	l.Witness(30)
+	if l.Time() != 42 {
+		t.Fatalf("bad time value")
+	}
+}
@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := NewTokenBucket(10, 2, now)
+
+	if !b.Allow(now) || !b.Allow(now) {
+		t.Fatalf("burst should be allowed")
+	}
+	if b.Allow(now) {
+		t.Fatalf("bucket should be empty")
+	}
+	if b.Full(now) {
+		t.Fatalf("bucket should not be full")
+	}
+
+	// 100ms 补充一个令牌
+	now = now.Add(100 * time.Millisecond)
+	if !b.Allow(now) {
+		t.Fatalf("should have refilled one token")
+	}
+	if b.Allow(now) {
+		t.Fatalf("bucket should be empty")
+	}
+
+	// 不会超过burst
+	now = now.Add(time.Hour)
+	if !b.Full(now) {
+		t.Fatalf("bucket should be full")
+	}
+	for i := 0; i < 2; i++ {
+		if !b.Allow(now) {
+			t.Fatalf("burst should be allowed")
+		}
+	}
+	if b.Allow(now) {
+		t.Fatalf("burst should be capped")
+	}
+}
+
+func TestTokenBucket_MinBurst(t *testing.T) {
+	now := time.Now()
+	b := NewTokenBucket(1, 0, now)
+	if !b.Allow(now) {
+		t.Fatalf("burst should be at least one")
+	}
+	if b.Allow(now) {
+		t.Fatalf("bucket should be empty")
+	}
+}
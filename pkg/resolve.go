@@ -1,7 +1,7 @@
 package pkg
 
 import (
-	"fmt"
+	"context"
 	"github.com/miekg/dns"
 	"net"
 	"strings"
@@ -18,58 +18,60 @@ type IpPort struct {
 // 内置的Go解析器将首先进行UDP查询，只有在响应设置了truncate bit时才会使用TCP，这在像Consul的DNS服务器上并不常见。
 // 通过直接进行TCP查询，我们得到了最大的主机列表加入的最佳机会。由于加入是相对罕见的事件，所以做这个相当昂贵的操作是可以的。
 func TcpLookupIP(host string, defaultPort uint16, nodeName string, DNSConfigPath string) ([]IpPort, error) {
-	// Don't attempt any TCP lookups against non-fully qualified domain
-	// names, since those will likely come from the resolv.conf file.
 	if !strings.Contains(host, ".") {
 		return nil, nil
 	}
-
-	// Make sure the domain name is terminated with a dot (we know there's
-	// at least one character at this point).
-	dn := host
-	if dn[len(dn)-1] != '.' {
-		dn = dn + "."
+	// See if we can find a server to try.
+	server, err := ConfigDNSServer(DNSConfigPath)
+	if err != nil || server == "" {
+		return nil, err
 	}
+	ips, _, err := TcpLookupIPServer(host, defaultPort, nodeName, server)
+	return ips, err
+}
 
-	// See if we can find a server to try.
+// ConfigDNSServer 返回DNS配置文件中的第一个服务器 host:port,没有时返回空
+func ConfigDNSServer(DNSConfigPath string) (string, error) {
 	cc, err := dns.ClientConfigFromFile(DNSConfigPath)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	if len(cc.Servers) == 0 {
+		return "", nil
+	}
+	// We support host:Port in the DNS Config, but need to add the
+	// default Port if one is not supplied.
+	server := cc.Servers[0]
+	if !HasPort(server) {
+		server = net.JoinHostPort(server, cc.Port)
 	}
-	if len(cc.Servers) > 0 {
-		// We support host:Port in the DNS Config, but need to add the
-		// default Port if one is not supplied.
-		server := cc.Servers[0]
-		if !HasPort(server) {
-			server = net.JoinHostPort(server, cc.Port)
-		}
+	return server, nil
+}
 
-		// Do the lookup.
-		c := new(dns.Client)
-		c.Net = "tcp"
-		msg := new(dns.Msg)
-		msg.SetQuestion(dn, dns.TypeANY)
-		in, _, err := c.Exchange(msg, server)
-		if err != nil {
-			return nil, err
-		}
+// TcpLookupIPServer 与 TcpLookupIP 相同,但使用指定的DNS服务器,并返回应答中最小的TTL(秒)
+func TcpLookupIPServer(host string, defaultPort uint16, nodeName string, server string) ([]IpPort, uint32, error) {
+	// Don't attempt any TCP lookups against non-fully qualified domain
+	// names, since those will likely come from the resolv.conf file.
+	if !strings.Contains(host, ".") {
+		return nil, 0, nil
+	}
 
-		// Handle any IPs we get back that we can attempt to join.
-		var ips []IpPort
-		for _, r := range in.Answer {
-			switch rr := r.(type) {
-			case *dns.A:
-				ips = append(ips, IpPort{IP: rr.A, Port: defaultPort, NodeName: nodeName})
-			case *dns.AAAA:
-				ips = append(ips, IpPort{IP: rr.AAAA, Port: defaultPort, NodeName: nodeName})
-			case *dns.CNAME:
-				fmt.Println("[DEBUG] memberlist: 在TCP优先应答中忽略CNAME RR，", host)
-			}
-		}
-		return ips, nil
+	// Make sure the domain name is terminated with a dot (we know there's
+	// at least one character at this point).
+	dn := dns.Fqdn(host)
+
+	// 分别查询A和AAAA,很多解析器拒绝或者精简ANY查询(RFC 8482)
+	addrs, ttl, err := tcpLookupAddrs(context.Background(), dn, server)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return nil, nil
+	// Handle any IPs we get back that we can attempt to join.
+	ips := make([]IpPort, 0, len(addrs))
+	for _, ip := range addrs {
+		ips = append(ips, IpPort{IP: ip, Port: defaultPort, NodeName: nodeName})
+	}
+	return ips, ttl, nil
 }
 
 func UdpLookupIP(host string, defaultPort uint16, nodeName string) ([]IpPort, error) {
@@ -0,0 +1,223 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TcpLookupSRV 通过TCP向server查询SRV记录,按优先级和权重(RFC 2782)排序,
+// 端口取自记录,目标的地址优先使用附加段中的A/AAAA记录,解析失败的目标被跳过。返回应答中最小的TTL(秒)
+func TcpLookupSRV(name string, server string) ([]IpPort, uint32, error) {
+	return TcpLookupSRVContext(context.Background(), name, server)
+}
+
+// TcpLookupSRVContext 与 TcpLookupSRV 相同,ctx结束时停止查询
+func TcpLookupSRVContext(ctx context.Context, name string, server string) ([]IpPort, uint32, error) {
+	c := new(dns.Client)
+	c.Net = "tcp"
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeSRV)
+	in, _, err := c.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, 0, fmt.Errorf("查询SRV %s 失败: %s", name, dns.RcodeToString[in.Rcode])
+	}
+
+	var records []*dns.SRV
+	for _, r := range in.Answer {
+		if srv, ok := r.(*dns.SRV); ok {
+			records = append(records, srv)
+		}
+	}
+	if len(records) == 0 {
+		return nil, 0, fmt.Errorf("没有SRV记录: %s", name)
+	}
+	ttl := minTTL(in.Answer)
+
+	// 附加段中的地址
+	extra := make(map[string][]net.IP)
+	for _, r := range in.Extra {
+		switch rr := r.(type) {
+		case *dns.A:
+			extra[strings.ToLower(rr.Hdr.Name)] = append(extra[strings.ToLower(rr.Hdr.Name)], rr.A)
+		case *dns.AAAA:
+			extra[strings.ToLower(rr.Hdr.Name)] = append(extra[strings.ToLower(rr.Hdr.Name)], rr.AAAA)
+		}
+	}
+
+	var ips []IpPort
+	var lastErr error
+	for _, srv := range OrderSRV(records) {
+		target := strings.ToLower(dns.Fqdn(srv.Target))
+		addrs, ok := extra[target]
+		if !ok {
+			var t uint32
+			addrs, t, err = tcpLookupAddrs(ctx, target, server)
+			if err != nil {
+				// 一个目标解析失败不影响其他目标
+				lastErr = fmt.Errorf("解析SRV目标 %s 失败: %v", srv.Target, err)
+				continue
+			}
+			if len(addrs) > 0 && t < ttl {
+				ttl = t
+			}
+		}
+		for _, ip := range addrs {
+			ips = append(ips, IpPort{IP: ip, Port: srv.Port})
+		}
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+// tcpLookupAddrs 分别查询目标的A和AAAA记录,其中一个查询失败时仍返回另一个的结果
+func tcpLookupAddrs(ctx context.Context, target string, server string) ([]net.IP, uint32, error) {
+	c := new(dns.Client)
+	c.Net = "tcp"
+	var ips []net.IP
+	var rrs []dns.RR
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(target, qtype)
+		in, _, err := c.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		for _, r := range in.Answer {
+			switch rr := r.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			default:
+				continue
+			}
+			rrs = append(rrs, r)
+		}
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return ips, minTTL(rrs), nil
+}
+
+// OrderSRV 按 RFC 2782 排序:优先级小的在前,同一优先级内按权重随机选择顺序
+func OrderSRV(records []*dns.SRV) []*dns.SRV {
+	sorted := append([]*dns.SRV(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	out := make([]*dns.SRV, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		group := sorted[start:end]
+		// 权重为0的记录放在前面,使它们也有很小的机会被先选中
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Weight == 0 && group[j].Weight != 0
+		})
+		for len(group) > 0 {
+			total := 0
+			for _, r := range group {
+				total += int(r.Weight)
+			}
+			pick := 0
+			if total > 0 {
+				n := rand.Intn(total + 1)
+				sum := 0
+				for i, r := range group {
+					sum += int(r.Weight)
+					if sum >= n {
+						pick = i
+						break
+					}
+				}
+			}
+			out = append(out, group[pick])
+			group = append(group[:pick:pick], group[pick+1:]...)
+		}
+		start = end
+	}
+	return out
+}
+
+func minTTL(rrs []dns.RR) uint32 {
+	var ttl uint32
+	for i, r := range rrs {
+		if t := r.Header().Ttl; i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	return ttl
+}
+
+// DNSCache 按记录的TTL缓存解析结果
+type DNSCache struct {
+	lock    sync.Mutex
+	entries map[string]dnsEntry
+	Now     func() time.Time // 用于测试,默认 time.Now
+}
+
+type dnsEntry struct {
+	ips     []IpPort
+	expires time.Time
+}
+
+func NewDNSCache() *DNSCache {
+	return &DNSCache{entries: make(map[string]dnsEntry)}
+}
+
+func (c *DNSCache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// Get 返回未过期的结果
+func (c *DNSCache) Get(key string) ([]IpPort, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return append([]IpPort(nil), e.ips...), true
+}
+
+// Put 缓存ttl秒,ttl为0时不缓存
+func (c *DNSCache) Put(key string, ips []IpPort, ttl uint32) {
+	if ttl == 0 || len(ips) == 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = dnsEntry{
+		ips:     append([]IpPort(nil), ips...),
+		expires: c.now().Add(time.Duration(ttl) * time.Second),
+	}
+}
@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func srvRecord(priority, weight, port uint16, target string) *dns.SRV {
+	return &dns.SRV{
+		Hdr:      dns.RR_Header{Name: "_m._tcp.example.test.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 30},
+		Priority: priority,
+		Weight:   weight,
+		Port:     port,
+		Target:   target,
+	}
+}
+
+func TestOrderSRV(t *testing.T) {
+	records := []*dns.SRV{
+		srvRecord(20, 1, 3, "c."),
+		srvRecord(10, 0, 2, "b."),
+		srvRecord(10, 3, 1, "a."),
+	}
+	heavyFirst := 0
+	for i := 0; i < 400; i++ {
+		out := OrderSRV(records)
+		require.Len(t, out, 3)
+		require.Equal(t, "c.", out[2].Target)
+		if out[0].Target == "a." {
+			heavyFirst++
+		}
+	}
+	// 权重越大越可能排在前面,权重为0的记录也会出现
+	// a 排在前面的概率是 3/4
+	require.True(t, heavyFirst > 250 && heavyFirst < 350, "heavy first %d/400", heavyFirst)
+}
+
+func TestDNSCache(t *testing.T) {
+	now := time.Unix(100, 0)
+	c := NewDNSCache()
+	c.Now = func() time.Time { return now }
+
+	ips := []IpPort{{IP: net.IPv4(127, 0, 0, 1), Port: 1}}
+	c.Put("a", ips, 0)
+	_, ok := c.Get("a")
+	require.False(t, ok)
+
+	c.Put("a", ips, 10)
+	got, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, ips, got)
+
+	now = now.Add(10 * time.Second)
+	_, ok = c.Get("a")
+	require.False(t, ok)
+}
+
+func startDNS(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{Listener: l, Handler: handler}
+	go server.ActivateAndServe()
+	return l.Addr().String(), func() { server.Shutdown() }
+}
+
+func TestTcpLookupSRV(t *testing.T) {
+	var queries int32
+	addr, stop := startDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		q := req.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		switch {
+		case q.Qtype == dns.TypeSRV:
+			resp.Answer = []dns.RR{
+				srvRecord(20, 1, 7947, "b.example.test."),
+				srvRecord(10, 1, 7946, "a.example.test."),
+				srvRecord(30, 1, 7948, "c.example.test."),
+			}
+			// 只有a的地址在附加段中
+			resp.Extra = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: "a.example.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 0, 1),
+			}}
+		case q.Qtype == dns.TypeA && q.Name == "b.example.test.":
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 5},
+				A:   net.IPv4(10, 0, 0, 2),
+			}}
+		case q.Qtype == dns.TypeAAAA && q.Name == "b.example.test.":
+			// b的AAAA查询失败,不影响它的A记录
+			w.Close()
+			return
+		case q.Name == "c.example.test.":
+			// c 解析失败
+			w.Close()
+			return
+		}
+		w.WriteMsg(resp)
+	})
+	defer stop()
+
+	ips, ttl, err := TcpLookupSRV("_m._tcp.example.test", addr)
+	require.NoError(t, err)
+	require.Len(t, ips, 2)
+	require.Equal(t, "10.0.0.1", ips[0].IP.String())
+	require.Equal(t, uint16(7946), ips[0].Port)
+	require.Equal(t, "10.0.0.2", ips[1].IP.String())
+	require.Equal(t, uint16(7947), ips[1].Port)
+	require.Equal(t, uint32(5), ttl)
+	// SRV + b的A和AAAA + c的A和AAAA,c被跳过
+	require.Equal(t, int32(5), atomic.LoadInt32(&queries))
+}
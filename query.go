@@ -0,0 +1,400 @@
+package memberlist
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist/broadcast_tree"
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// QueryReq 通过gossip在集群中传播的查询
+type QueryReq struct {
+	ID      uint32
+	Origin  string // 发起查询的节点
+	Addr    []byte // 发起方的地址,响应直接发回这里
+	Port    uint16
+	Name    string
+	Payload []byte
+
+	FilterNodes []string `codec:",omitempty"` // 只有这些节点响应
+	FilterMeta  string   `codec:",omitempty"` // 只有Meta匹配该正则的节点响应
+	RequestAck  bool
+	Timeout     time.Duration
+	// TTL 发送时剩余的有效期,每一跳从收到的时间开始换算成本地的截止时间,不依赖节点之间的时钟同步;
+	// 过期后不再传播和响应。为0时按旧版本处理,从收到的时间开始算 Timeout
+	TTL time.Duration `codec:",omitempty"`
+}
+
+// deadline 查询在本地的截止时间
+func (q *QueryReq) deadline(now time.Time) time.Time {
+	if q.TTL != 0 {
+		return now.Add(q.TTL)
+	}
+	return now.Add(q.Timeout)
+}
+
+// QueryResp 节点直接发回给查询发起方的确认或响应
+type QueryResp struct {
+	ID      uint32
+	From    string
+	Ack     bool
+	Payload []byte
+}
+
+// QueryParam 查询的过滤条件和超时
+type QueryParam struct {
+	// FilterNodes 非空时只有这些节点响应
+	FilterNodes []string
+
+	// FilterMeta 非空时只有Meta匹配该正则的节点响应
+	FilterMeta string
+
+	// RequestAck 匹配的节点收到查询后立即回复确认
+	RequestAck bool
+
+	// Timeout 查询的有效期,0表示使用 DefaultQueryTimeout
+	Timeout time.Duration
+}
+
+// NodeResponse 一个节点对查询的响应
+type NodeResponse struct {
+	From    string
+	Payload []byte
+}
+
+// QueryResponse 收集查询的确认和响应;每个节点的确认和响应最多各收到一次,超时后两个通道都会被关闭
+type QueryResponse struct {
+	id       uint32
+	deadline time.Time
+
+	lock      sync.Mutex
+	closed    bool
+	acks      map[string]struct{}
+	responses map[string]struct{}
+	ackCh     chan string
+	respCh    chan NodeResponse
+}
+
+// AckCh 返回确认的节点名,只有设置了RequestAck时才有
+func (r *QueryResponse) AckCh() <-chan string {
+	return r.ackCh
+}
+
+// ResponseCh 返回节点的响应
+func (r *QueryResponse) ResponseCh() <-chan NodeResponse {
+	return r.respCh
+}
+
+// Deadline 查询结束的时间
+func (r *QueryResponse) Deadline() time.Time {
+	return r.deadline
+}
+
+// Finished 查询是否已经结束
+func (r *QueryResponse) Finished() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+// Close 提前结束查询,之后收到的响应都会被丢弃
+func (r *QueryResponse) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.ackCh)
+	close(r.respCh)
+}
+
+// deliver 去重后放入对应的通道,通道满时丢弃
+func (r *QueryResponse) deliver(resp *QueryResp) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return false
+	}
+
+	if resp.Ack {
+		if _, ok := r.acks[resp.From]; ok {
+			return false
+		}
+		select {
+		case r.ackCh <- resp.From:
+			r.acks[resp.From] = struct{}{}
+			return true
+		default:
+			return false
+		}
+	}
+
+	if _, ok := r.responses[resp.From]; ok {
+		return false
+	}
+	select {
+	case r.respCh <- NodeResponse{From: resp.From, Payload: resp.Payload}:
+		r.responses[resp.From] = struct{}{}
+		return true
+	default:
+		return false
+	}
+}
+
+type queryKey struct {
+	origin string
+	id     uint32
+}
+
+// queryBroadcast 查询不会使其他广播失效,过了截止时间就不再传播
+type queryBroadcast struct {
+	q       QueryReq
+	msg     []byte // 入队时的编码,重新编码失败时使用
+	expires time.Time
+}
+
+func (b *queryBroadcast) ExpiresAt() time.Time {
+	return b.expires
+}
+
+func (b *queryBroadcast) Invalidates(broadcast_tree.Broadcast) bool {
+	return false
+}
+
+// Message 每次发送时用剩余的有效期重新编码。TTL只会变小,编码不会比入队时更长
+func (b *queryBroadcast) Message() []byte {
+	q := b.q
+	q.TTL = time.Until(b.expires)
+	if q.TTL <= 0 {
+		// 0 表示旧版本,用负数表示已经过期
+		q.TTL = -1
+	}
+	buf, err := Encode(QueryMsg, &q)
+	if err != nil {
+		return b.msg
+	}
+	return buf.Bytes()
+}
+
+func (b *queryBroadcast) Finished() {}
+
+func (b *queryBroadcast) UniqueBroadcast() {}
+
+// DefaultQueryTimeout 根据集群规模计算查询的默认有效期
+func (m *Members) DefaultQueryTimeout() time.Duration {
+	n := m.EstNumNodes()
+	scale := math.Ceil(math.Log10(float64(n + 1)))
+	if scale < 1 {
+		scale = 1
+	}
+	return time.Duration(float64(m.Config.GossipInterval) * float64(m.Config.QueryTimeoutMult) * scale)
+}
+
+// Query 向集群发起查询;查询通过gossip传播,匹配过滤条件的节点(包括本节点)调用 Config.Queries 并把响应直接发回
+func (m *Members) Query(name string, payload []byte, params *QueryParam) (*QueryResponse, error) {
+	if params == nil {
+		params = &QueryParam{}
+	}
+	if params.FilterMeta != "" {
+		if _, err := regexp.Compile(params.FilterMeta); err != nil {
+			return nil, fmt.Errorf("无效的Meta过滤条件: %v", err)
+		}
+	}
+	timeout := params.Timeout
+	if timeout <= 0 {
+		timeout = m.DefaultQueryTimeout()
+	}
+
+	addr, port := m.getAdvertise()
+	deadline := time.Now().Add(timeout)
+	q := QueryReq{
+		ID:          m.NextSeqNo(),
+		Origin:      m.Config.Name,
+		Addr:        addr,
+		Port:        port,
+		Name:        name,
+		Payload:     payload,
+		FilterNodes: params.FilterNodes,
+		FilterMeta:  params.FilterMeta,
+		RequestAck:  params.RequestAck,
+		Timeout:     timeout,
+		TTL:         timeout,
+	}
+	buf, err := Encode(QueryMsg, &q)
+	if err != nil {
+		return nil, err
+	}
+	if limit := m.Config.QuerySizeLimit; limit > 0 && buf.Len() > limit {
+		return nil, fmt.Errorf("查询太大 (%d > %d)", buf.Len(), limit)
+	}
+
+	n := m.NumMembers()
+	resp := &QueryResponse{
+		id:        q.ID,
+		deadline:  deadline,
+		acks:      make(map[string]struct{}),
+		responses: make(map[string]struct{}),
+		ackCh:     make(chan string, n),
+		respCh:    make(chan NodeResponse, n),
+	}
+	m.queryLock.Lock()
+	m.queryResponses[q.ID] = resp
+	m.queryLock.Unlock()
+	time.AfterFunc(timeout, func() {
+		m.queryLock.Lock()
+		delete(m.queryResponses, q.ID)
+		m.queryLock.Unlock()
+		resp.Close()
+	})
+
+	m.markQuerySeen(&q)
+	m.Broadcasts.QueueBroadcast(&queryBroadcast{q: q, msg: buf.Bytes(), expires: deadline})
+	m.answerQuery(&q)
+	return resp, nil
+}
+
+// markQuerySeen 记录已经处理过的查询,返回false表示之前已经见过;过期的记录顺便清理
+func (m *Members) markQuerySeen(q *QueryReq) bool {
+	now := time.Now()
+	k := queryKey{q.Origin, q.ID}
+
+	m.queryLock.Lock()
+	defer m.queryLock.Unlock()
+	if until, ok := m.querySeen[k]; ok && now.Before(until) {
+		return false
+	}
+	for key, until := range m.querySeen {
+		if now.After(until) {
+			delete(m.querySeen, key)
+		}
+	}
+	m.querySeen[k] = q.deadline(now)
+	return true
+}
+
+// handleQuery 处理gossip收到的查询:去重、继续传播、检查过滤条件并响应
+func (m *Members) handleQuery(buf []byte, from net.Addr) {
+	var q QueryReq
+	if err := Decode(buf, &q); err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码查询失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	// 已经过期的查询发起方不再等待响应,也不用继续传播
+	deadline := q.deadline(time.Now())
+	if !time.Now().Before(deadline) {
+		m.Logger.Printf("[DEBUG] memberlist: 丢弃过期的查询 %s from %s", q.Name, q.Origin)
+		return
+	}
+	if !m.markQuerySeen(&q) {
+		return
+	}
+
+	// 继续传播,发送时换算成剩余的有效期
+	msg := make([]byte, 1, len(buf)+1)
+	msg[0] = byte(QueryMsg)
+	msg = append(msg, buf...)
+	m.Broadcasts.QueueBroadcast(&queryBroadcast{q: q, msg: msg, expires: deadline})
+
+	m.answerQuery(&q)
+}
+
+// answerQuery 本节点匹配过滤条件时发送确认和响应
+func (m *Members) answerQuery(q *QueryReq) {
+	if !m.queryMatches(q) {
+		return
+	}
+
+	if q.RequestAck {
+		m.sendQueryResp(q, &QueryResp{ID: q.ID, From: m.Config.Name, Ack: true})
+	}
+
+	h := m.Config.Queries
+	if h == nil {
+		return
+	}
+	out := h.HandleQuery(q.Origin, q.Name, q.Payload)
+	if out == nil {
+		return
+	}
+	if limit := m.Config.QueryResponseSizeLimit; limit > 0 && len(out) > limit {
+		m.Logger.Printf("[错误] memberlist: 查询 %s 的响应太大 (%d > %d)", q.Name, len(out), limit)
+		return
+	}
+	m.sendQueryResp(q, &QueryResp{ID: q.ID, From: m.Config.Name, Payload: out})
+}
+
+func (m *Members) queryMatches(q *QueryReq) bool {
+	if len(q.FilterNodes) > 0 {
+		found := false
+		for _, name := range q.FilterNodes {
+			if name == m.Config.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.FilterMeta != "" {
+		re, err := regexp.Compile(q.FilterMeta)
+		if err != nil {
+			m.Logger.Printf("[WARN] memberlist: 无效的Meta过滤条件 %q: %v", q.FilterMeta, err)
+			return false
+		}
+		var meta []byte
+		m.NodeLock.RLock()
+		if ns, ok := m.NodeMap[m.Config.Name]; ok {
+			meta = ns.Meta
+		}
+		m.NodeLock.RUnlock()
+		if !re.Match(meta) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendQueryResp 把确认或响应直接发给查询发起方,发起方是本节点时直接投递
+func (m *Members) sendQueryResp(q *QueryReq, resp *QueryResp) {
+	if q.Origin == m.Config.Name {
+		m.deliverQueryResp(resp)
+		return
+	}
+
+	a := pkg.Address{
+		Addr: pkg.JoinHostPort(net.IP(q.Addr).String(), q.Port),
+		Name: q.Origin,
+	}
+	if err := m.encodeAndSendMsg(a, QueryRespMsg, resp); err != nil {
+		m.Logger.Printf("[错误] memberlist: 发送查询响应失败: %s", err)
+	}
+}
+
+// handleQueryResp 处理发回给本节点的确认和响应
+func (m *Members) handleQueryResp(buf []byte, from net.Addr) {
+	var resp QueryResp
+	if err := Decode(buf, &resp); err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码查询响应失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	m.deliverQueryResp(&resp)
+}
+
+func (m *Members) deliverQueryResp(resp *QueryResp) {
+	m.queryLock.Lock()
+	r, ok := m.queryResponses[resp.ID]
+	m.queryLock.Unlock()
+	if !ok {
+		m.Logger.Printf("[DEBUG] memberlist: 查询 %d 已经结束,丢弃 %s 的响应", resp.ID, resp.From)
+		return
+	}
+	r.deliver(resp)
+}
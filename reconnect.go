@@ -0,0 +1,89 @@
+package memberlist
+
+import (
+	"sync"
+	"time"
+)
+
+// reconnectMaxBackoff 连续失败时退避的上限,是 ReconnectInterval 的倍数
+const reconnectMaxBackoff = 16
+
+// reconnects 记录每个失败节点的重连退避
+type reconnects struct {
+	lock  sync.Mutex
+	nodes map[string]*reconnectState
+}
+
+type reconnectState struct {
+	failures int
+	next     time.Time
+}
+
+func newReconnects() *reconnects {
+	return &reconnects{nodes: make(map[string]*reconnectState)}
+}
+
+// Reconnect 选择一个最近失败、且不在退避中的节点,尝试与它 push/pull。
+// 网络分区恢复后,双方在 push/pull 中看到自己被宣布死亡会反驳,之后的交换就会把对方恢复为存活
+func (m *Members) Reconnect() {
+	now := time.Now()
+	r := m.reconnects
+
+	m.NodeLock.RLock()
+	r.lock.Lock()
+	var candidates []Node
+	failed := make(map[string]bool)
+	for _, n := range m.Nodes {
+		// 主动离开的节点不重连
+		if n.State != StateDead || n.Name == m.Config.Name {
+			continue
+		}
+		if m.Config.ReconnectTimeout > 0 && now.Sub(n.StateChange) > m.Config.ReconnectTimeout {
+			continue
+		}
+		failed[n.Name] = true
+		if s, ok := r.nodes[n.Name]; ok && now.Before(s.next) {
+			continue
+		}
+		candidates = append(candidates, n.Node)
+	}
+	// 清理已经恢复或被移除的节点
+	for name := range r.nodes {
+		if !failed[name] {
+			delete(r.nodes, name)
+		}
+	}
+	r.lock.Unlock()
+	m.NodeLock.RUnlock()
+
+	if len(candidates) == 0 {
+		return
+	}
+	node := candidates[RandomOffset(len(candidates))]
+
+	m.Logger.Printf("[DEBUG] memberlist: 尝试重新连接失败的节点 %s (%s)", node.Name, node.Address())
+	err := m.PushPullNode(node.FullAddress(), false)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s, ok := r.nodes[node.Name]
+	if !ok {
+		s = &reconnectState{}
+		r.nodes[node.Name] = s
+	}
+	if err != nil {
+		// 指数退避
+		s.failures++
+		backoff := m.Config.ReconnectInterval << uint(s.failures)
+		if max := m.Config.ReconnectInterval * reconnectMaxBackoff; backoff > max || backoff <= 0 {
+			backoff = max
+		}
+		s.next = time.Now().Add(backoff)
+		m.Logger.Printf("[DEBUG] memberlist: 重新连接 %s 失败 (%d 次), %s 后重试: %s", node.Name, s.failures, backoff, err)
+		return
+	}
+	// 交换成功但对方可能还没有反驳,下一轮继续
+	s.failures = 0
+	s.next = time.Time{}
+	m.Logger.Printf("[INFO] memberlist: 已与失败的节点 %s 交换状态", node.Name)
+}
@@ -0,0 +1,348 @@
+package memberlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/memberlist/broadcast_tree"
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// mapDigestBuckets push/pull时按键的哈希把复制map分成的桶数,只交换摘要不同的桶
+const mapDigestBuckets = 64
+
+var errMapDisabled = errors.New("复制map没有启用")
+
+// MapEntry 复制map中的一项,写入时gossip,push/pull时交换摘要不同的桶
+type MapEntry struct {
+	Key     string
+	Value   []byte
+	Time    pkg.HLC
+	Node    string // 写入的节点,时间相同时名字大的胜出
+	Deleted bool   // 墓碑
+}
+
+// newer 按 last-writer-wins 规则,e是否胜过o
+func (e *MapEntry) newer(o *MapEntry) bool {
+	if e.Time != o.Time {
+		return o.Time.Less(e.Time)
+	}
+	return e.Node > o.Node
+}
+
+// hash 项的哈希,同一个桶中所有项的哈希异或得到桶的摘要
+func (e *MapEntry) hash() uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(e.Key))
+	var buf [14]byte
+	binary.BigEndian.PutUint64(buf[1:], uint64(e.Time.Wall))
+	binary.BigEndian.PutUint32(buf[9:], e.Time.Logical)
+	if e.Deleted {
+		buf[13] = 1
+	}
+	h.Write(buf[:])
+	h.Write([]byte(e.Node))
+	return h.Sum64()
+}
+
+func mapBucket(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % mapDigestBuckets)
+}
+
+// MapEvent 复制map中一个键的变化
+type MapEvent struct {
+	Key     string
+	Value   []byte // 新的值,删除时为nil
+	Old     []byte // 之前的值,之前不存在时为nil
+	Deleted bool
+	Node    string // 写入的节点
+}
+
+// ReplicatedMap 基于 last-writer-wins 和混合逻辑时钟的复制map。
+// 写入通过广播队列gossip,push/pull时先交换每个桶的摘要,再合并摘要不同的桶,所有节点最终收敛到相同的内容。
+// 删除会留下墓碑,超过 MapTombstoneTTL 的墓碑每隔 MapTombstoneGCInterval 回收一次
+type ReplicatedMap struct {
+	m     *Members
+	clock pkg.HybridClock
+
+	lock    sync.RWMutex
+	entries map[string]*MapEntry
+}
+
+func newReplicatedMap(m *Members) *ReplicatedMap {
+	r := &ReplicatedMap{
+		m:       m,
+		entries: make(map[string]*MapEntry),
+	}
+	r.clock.MaxDrift = m.Config.MapMaxClockDrift
+	return r
+}
+
+// ReplicatedMap 返回本节点的复制map
+func (m *Members) ReplicatedMap() *ReplicatedMap {
+	return m.replMap
+}
+
+// Get 返回键的值
+func (r *ReplicatedMap) Get(key string) ([]byte, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	e, ok := r.entries[key]
+	if !ok || e.Deleted {
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// Set 写入键的值并广播
+func (r *ReplicatedMap) Set(key string, value []byte) error {
+	return r.write(&MapEntry{Key: key, Value: value})
+}
+
+// Delete 删除键并广播墓碑
+func (r *ReplicatedMap) Delete(key string) error {
+	return r.write(&MapEntry{Key: key, Deleted: true})
+}
+
+// GetValue 用msgpack把键的值解码到out,键不存在时返回false
+func (r *ReplicatedMap) GetValue(key string, out interface{}) (bool, error) {
+	buf, ok := r.Get(key)
+	if !ok {
+		return false, nil
+	}
+	return true, Decode(buf, out)
+}
+
+// SetValue 用msgpack编码v后写入
+func (r *ReplicatedMap) SetValue(key string, v interface{}) error {
+	var buf bytes.Buffer
+	hd := codec.MsgpackHandle{}
+	if err := codec.NewEncoder(&buf, &hd).Encode(v); err != nil {
+		return err
+	}
+	return r.Set(key, buf.Bytes())
+}
+
+// Keys 返回所有键,按字典序排列
+func (r *ReplicatedMap) Keys() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	out := make([]string, 0, len(r.entries))
+	for k, e := range r.entries {
+		if !e.Deleted {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Len 返回键的数量,不包括墓碑
+func (r *ReplicatedMap) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	n := 0
+	for _, e := range r.entries {
+		if !e.Deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// Snapshot 返回所有键值的拷贝
+func (r *ReplicatedMap) Snapshot() map[string][]byte {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	out := make(map[string][]byte, len(r.entries))
+	for k, e := range r.entries {
+		if !e.Deleted {
+			out[k] = e.Value
+		}
+	}
+	return out
+}
+
+func (r *ReplicatedMap) write(e *MapEntry) error {
+	if !r.m.Config.EnableReplicatedMap {
+		return errMapDisabled
+	}
+	e.Time = r.clock.Tick()
+	e.Node = r.m.Config.Name
+
+	buf, err := Encode(MapMsg, e)
+	if err != nil {
+		return err
+	}
+	if limit := r.m.maxRequestPacket() - CompoundHeaderOverhead - CompoundOverhead; buf.Len() > limit {
+		return fmt.Errorf("复制map的值太大 (%d > %d)", buf.Len(), limit)
+	}
+	if ev, ok := r.merge(e); ok {
+		r.broadcast(e.Key, buf.Bytes())
+		r.notify(ev)
+	}
+	return nil
+}
+
+// merge 合并一项,返回变化;没有胜过本地的值时返回false
+func (r *ReplicatedMap) merge(e *MapEntry) (MapEvent, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	cur, ok := r.entries[e.Key]
+	if ok && !e.newer(cur) {
+		return MapEvent{}, false
+	}
+	r.entries[e.Key] = e
+
+	ev := MapEvent{Key: e.Key, Deleted: e.Deleted, Node: e.Node}
+	if !e.Deleted {
+		ev.Value = e.Value
+	}
+	if ok && !cur.Deleted {
+		ev.Old = cur.Value
+	}
+	return ev, true
+}
+
+// broadcast 同一个键的新写入会替换队列中旧的写入
+func (r *ReplicatedMap) broadcast(key string, msg []byte) {
+	r.m.Broadcasts.QueueBroadcast(broadcast_tree.NewKeyedBroadcast(msg, nil, "map:"+key))
+}
+
+func (r *ReplicatedMap) notify(ev MapEvent) {
+	// 删除不存在的键不算变化
+	if ev.Deleted && ev.Old == nil {
+		return
+	}
+	if d := r.m.Config.MapEvents; d != nil {
+		d.NotifyMapChange(ev)
+	}
+}
+
+// digest 返回每个桶的摘要,push/pull时代替全部的项发送
+func (r *ReplicatedMap) digest() []uint64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.digestLocked()
+}
+
+func (r *ReplicatedMap) digestLocked() []uint64 {
+	out := make([]uint64, mapDigestBuckets)
+	for k, e := range r.entries {
+		out[mapBucket(k)] ^= e.hash()
+	}
+	return out
+}
+
+// delta 返回摘要与对方不同的桶中的项;对方的桶数不同时返回全部
+func (r *ReplicatedMap) delta(remote []uint64) []*MapEntry {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	local := r.digestLocked()
+	all := len(remote) != len(local)
+	var out []*MapEntry
+	for k, e := range r.entries {
+		if b := mapBucket(k); all || local[b] != remote[b] {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// CollectTombstones 回收超过 MapTombstoneTTL 的墓碑,返回回收的数量
+func (r *ReplicatedMap) CollectTombstones() int {
+	ttl := r.m.Config.MapTombstoneTTL
+	if ttl <= 0 {
+		return 0
+	}
+	cutoff := time.Now().Add(-ttl).UnixNano()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := 0
+	for k, e := range r.entries {
+		if e.Deleted && e.Time.Wall < cutoff {
+			delete(r.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// collectTombstones 定时回收墓碑
+func (m *Members) collectTombstones() {
+	if n := m.replMap.CollectTombstones(); n > 0 {
+		m.Logger.Printf("[DEBUG] memberlist: 回收了 %d 个复制map墓碑", n)
+	}
+}
+
+// handleMapEntry 处理gossip收到的写入,胜出时继续传播
+func (m *Members) handleMapEntry(buf []byte, from net.Addr) {
+	var e MapEntry
+	if err := Decode(buf, &e); err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码复制map失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	if !m.Config.EnableReplicatedMap {
+		return
+	}
+	r := m.replMap
+	if !r.accept(&e, from) {
+		return
+	}
+	if ev, ok := r.merge(&e); ok {
+		msg := make([]byte, 1, len(buf)+1)
+		msg[0] = byte(MapMsg)
+		msg = append(msg, buf...)
+		r.broadcast(e.Key, msg)
+		r.notify(ev)
+	}
+}
+
+// accept 用写入的时间更新时钟;时间超前本地太多时丢弃这个写入,避免它永远胜出
+func (r *ReplicatedMap) accept(e *MapEntry, from net.Addr) bool {
+	if _, err := r.clock.Update(e.Time); err != nil {
+		r.m.Logger.Printf("[WARN] memberlist: 丢弃复制map写入 %s,来自 %s 的时间超前 %s: %s %s",
+			e.Key, e.Node, time.Duration(e.Time.Wall-time.Now().UnixNano()), err, pkg.LogAddress(from))
+		return false
+	}
+	return true
+}
+
+// mergeMapState 合并push/pull收到的项
+func (m *Members) mergeMapState(entries []*MapEntry) {
+	r := m.replMap
+	for _, e := range entries {
+		if !r.accept(e, nil) {
+			continue
+		}
+		if ev, ok := r.merge(e); ok {
+			r.notify(ev)
+		}
+	}
+}
+
+// repairMap push/pull发起方把摘要不同的桶中的项直接发送给对方
+func (m *Members) repairMap(a pkg.Address, remote []uint64) {
+	for _, e := range m.replMap.delta(remote) {
+		buf, err := Encode(MapMsg, e)
+		if err != nil {
+			m.Logger.Printf("[错误] memberlist: 编码复制map失败: %s", err)
+			continue
+		}
+		if err := m.RawSendMsgPacket(a, nil, buf.Bytes()); err != nil {
+			m.Logger.Printf("[错误] memberlist: 发送复制map失败 %s: %s", a.Name, err)
+			return
+		}
+	}
+}
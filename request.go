@@ -0,0 +1,316 @@
+package memberlist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+var errNoRequestHandler = errors.New("没有配置RequestHandler")
+
+// RequestHeader 请求、响应消息的头部,与 UserMsgHeader 一样使用msgpack编码,后面紧跟Len字节的数据
+type RequestHeader struct {
+	ID         uint32 // 关联请求与响应
+	Len        int
+	SourceNode string `codec:",omitempty"` // 请求方的名字,用于回复
+	Error      string `codec:",omitempty"` // 只用于响应,远端处理失败的原因
+}
+
+type requestResult struct {
+	payload []byte
+	err     error
+}
+
+// pendingRequest 等待响应的请求,只接受来自目标节点的响应
+type pendingRequest struct {
+	ch   chan requestResult
+	node string
+	addr string
+}
+
+// accepts 响应是否来自请求的目标节点:来源未知时拒绝,有名字时比较名字,有地址时比较来源地址。
+// 通过流发回的响应源端口是临时分配的,只比较IP
+func (p *pendingRequest) accepts(h *RequestHeader, from net.Addr, stream bool) bool {
+	if from == nil {
+		return false
+	}
+	if p.node != "" && h.SourceNode != p.node {
+		return false
+	}
+	if p.addr == "" {
+		return p.node != ""
+	}
+	if !stream {
+		return from.String() == p.addr
+	}
+	host, _, err := net.SplitHostPort(p.addr)
+	return err == nil && sourceOf(from) == host
+}
+
+// Request 向node发送请求并等待它的RequestHandler返回响应。
+// 能放进一个UDP包的请求使用UDP发送,丢包时只能等到ctx超时;更大的请求使用TCP流。
+// ctx没有设置超时时使用 Config.RequestTimeout,它为0时流请求使用 Config.TCPTimeout
+func (m *Members) Request(ctx context.Context, node *Node, payload []byte) ([]byte, error) {
+	a := pkg.Address{Addr: node.Address(), Name: node.Name}
+	if a.Name == "" && m.Config.RequireNodeNames {
+		return nil, errNodeNamesAreRequired
+	}
+	if _, ok := ctx.Deadline(); !ok && m.Config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Config.RequestTimeout)
+		defer cancel()
+	}
+
+	id := m.NextSeqNo()
+	frame, err := encodeRequestFrame(RequestMsg, &RequestHeader{ID: id, SourceNode: m.Config.Name}, payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) > m.maxRequestPacket() {
+		return m.requestStream(ctx, a, id, frame)
+	}
+
+	ch := make(chan requestResult, 1)
+	m.reqLock.Lock()
+	m.reqHandlers[id] = &pendingRequest{ch: ch, node: node.Name, addr: a.Addr}
+	m.reqLock.Unlock()
+	defer func() {
+		m.reqLock.Lock()
+		delete(m.reqHandlers, id)
+		m.reqLock.Unlock()
+	}()
+
+	if err := m.RawSendMsgPacket(a, node, frame); err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-ch:
+		return r.payload, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-m.ShutdownCh:
+		return nil, fmt.Errorf("memberlist 已经关闭")
+	}
+}
+
+// requestStream 在同一个TCP流上发送请求并读取响应
+func (m *Members) requestStream(ctx context.Context, a pkg.Address, id uint32, frame []byte) ([]byte, error) {
+	deadline := time.Now().Add(m.Config.TCPTimeout)
+	d, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		deadline = d
+	}
+
+	// 连接的超时用的就是ctx的截止时间,超时后等ctx也结束,统一返回ctx的错误
+	ctxErr := func(err error) error {
+		if hasDeadline && !time.Now().Before(deadline) {
+			<-ctx.Done()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	conn, err := m.Transport.DialAddressTimeout(a, deadline.Sub(time.Now()))
+	if err != nil {
+		return nil, ctxErr(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	// ctx被取消时关闭连接,结束阻塞的读写
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	resp, err := m.exchangeRequest(conn, id, frame)
+	if err != nil {
+		return nil, ctxErr(err)
+	}
+	return resp, nil
+}
+
+func (m *Members) exchangeRequest(conn net.Conn, id uint32, frame []byte) ([]byte, error) {
+	if err := m.RawSendMsgStream(conn, frame, m.Config.Label); err != nil {
+		return nil, err
+	}
+
+	msgType, bufConn, dec, err := m.ReadStream(conn, m.Config.Label)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != ResponseMsg {
+		return nil, fmt.Errorf("未知的消息类型 (%d) from request %s", msgType, pkg.LogConn(conn))
+	}
+
+	h, payload, err := decodeRequestFrame(bufConn, dec)
+	if err != nil {
+		return nil, err
+	}
+	if h.ID != id {
+		return nil, fmt.Errorf("响应 (%d) 与请求 (%d) 不匹配", h.ID, id)
+	}
+	r := requestResultOf(h, payload)
+	return r.payload, r.err
+}
+
+// maxRequestPacket 可以用UDP发送的最大请求、响应帧
+func (m *Members) maxRequestPacket() int {
+	limit := m.Config.UDPBufferSize - LabelOverhead(m.Config.Label) - 5 // crc
+	if m.Config.EncryptionEnabled() && m.Config.GossipVerifyOutgoing {
+		limit -= encryptOverhead(m.EncryptionVersion())
+	}
+	return limit
+}
+
+// serveRequest 调用RequestHandler,返回响应帧
+func (m *Members) serveRequest(h *RequestHeader, payload []byte) ([]byte, error) {
+	resp := RequestHeader{ID: h.ID, SourceNode: m.Config.Name}
+	var body []byte
+	if handler := m.Config.Requests; handler == nil {
+		resp.Error = errNoRequestHandler.Error()
+	} else if out, err := handler.HandleRequest(h.SourceNode, payload); err != nil {
+		resp.Error = err.Error()
+	} else {
+		body = out
+	}
+	return encodeRequestFrame(ResponseMsg, &resp, body)
+}
+
+// handleRequest 处理UDP收到的请求;响应放不进一个UDP包时通过TCP流发回
+func (m *Members) handleRequest(buf []byte, from net.Addr) {
+	h, payload, err := decodeRequestPacket(buf)
+	if err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码请求失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+
+	frame, err := m.serveRequest(h, payload)
+	if err != nil {
+		m.Logger.Printf("[错误] memberlist: 编码响应失败: %s", err)
+		return
+	}
+
+	a := pkg.Address{Addr: from.String(), Name: h.SourceNode}
+	if len(frame) <= m.maxRequestPacket() {
+		if err := m.RawSendMsgPacket(a, nil, frame); err != nil {
+			m.Logger.Printf("[错误] memberlist: 发送响应失败: %s %s", err, pkg.LogAddress(from))
+		}
+		return
+	}
+
+	conn, err := m.Transport.DialAddressTimeout(a, m.Config.TCPTimeout)
+	if err != nil {
+		m.Logger.Printf("[错误] memberlist: 发送响应失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(m.Config.TCPTimeout))
+	if err := m.RawSendMsgStream(conn, frame, m.Config.Label); err != nil {
+		m.Logger.Printf("[错误] memberlist: 发送响应失败: %s %s", err, pkg.LogConn(conn))
+	}
+}
+
+// handleResponse 处理UDP收到的响应
+func (m *Members) handleResponse(buf []byte, from net.Addr) {
+	h, payload, err := decodeRequestPacket(buf)
+	if err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码响应失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	m.deliverResponse(h, payload, from, false)
+}
+
+// deliverResponse 把响应交给等待中的请求;请求已经超时或者响应不是来自目标节点则丢弃。
+// from 为nil表示响应来自TCP流,只能比较节点名字
+func (m *Members) deliverResponse(h *RequestHeader, payload []byte, from net.Addr, stream bool) {
+	m.reqLock.Lock()
+	p, ok := m.reqHandlers[h.ID]
+	m.reqLock.Unlock()
+	if !ok {
+		m.Logger.Printf("[DEBUG] memberlist: 没有等待中的请求 %d", h.ID)
+		return
+	}
+	if !p.accepts(h, from, stream) {
+		m.Logger.Printf("[WARN] memberlist: 请求 %d 的响应来自 %q 而不是 %q %s", h.ID, h.SourceNode, p.node, pkg.LogAddress(from))
+		return
+	}
+	select {
+	case p.ch <- requestResultOf(h, payload):
+	default:
+	}
+}
+
+// readRequestStream 处理TCP流上的请求,在同一个流上返回响应
+func (m *Members) readRequestStream(conn net.Conn, bufConn io.Reader, dec *codec.Decoder, streamLabel string) error {
+	h, payload, err := decodeRequestFrame(bufConn, dec)
+	if err != nil {
+		return err
+	}
+	frame, err := m.serveRequest(h, payload)
+	if err != nil {
+		return err
+	}
+	return m.RawSendMsgStream(conn, frame, streamLabel)
+}
+
+func requestResultOf(h *RequestHeader, payload []byte) requestResult {
+	if h.Error != "" {
+		return requestResult{err: fmt.Errorf("远端处理请求失败: %s", h.Error)}
+	}
+	return requestResult{payload: payload}
+}
+
+// encodeRequestFrame 与 SendUserMsg 的格式相同: 类型、msgpack编码的头部、数据
+func encodeRequestFrame(msgType MessageType, h *RequestHeader, payload []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(byte(msgType))
+
+	h.Len = len(payload)
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(buf, &hd)
+	if err := enc.Encode(h); err != nil {
+		return nil, err
+	}
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+func decodeRequestPacket(buf []byte) (*RequestHeader, []byte, error) {
+	r := bytes.NewReader(buf)
+	hd := codec.MsgpackHandle{}
+	return decodeRequestFrame(r, codec.NewDecoder(r, &hd))
+}
+
+func decodeRequestFrame(r io.Reader, dec *codec.Decoder) (*RequestHeader, []byte, error) {
+	var h RequestHeader
+	if err := dec.Decode(&h); err != nil {
+		return nil, nil, err
+	}
+	if h.Len < 0 || h.Len > maxPushStateBytes {
+		return nil, nil, fmt.Errorf("请求数据太大 (%d)", h.Len)
+	}
+
+	payload := make([]byte, h.Len)
+	if h.Len > 0 {
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, nil, fmt.Errorf("读取完整的请求数据失败: %v", err)
+		}
+	}
+	return &h, payload, nil
+}
@@ -0,0 +1,70 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// SRVPrefix 种子地址以它开头时按DNS SRV记录解析,例如 srv://_memberlist._tcp.example.com 。
+// 一条SRV记录可能对应多个节点,所以SRV种子不能带 name/ 前缀,节点名在push/pull时得到;
+// 因此 RequireNodeNames 开启时不能使用SRV种子。
+const SRVPrefix = "srv://"
+
+// dnsServer 解析种子使用的DNS服务器:Config.DNSServer,否则是 DNSConfigPath 中的第一个
+func (m *Members) dnsServer() (string, error) {
+	if m.Config.DNSServer != "" {
+		return pkg.EnsurePort(m.Config.DNSServer, 53), nil
+	}
+	return pkg.ConfigDNSServer(m.Config.DNSConfigPath)
+}
+
+// resolveSRV 先通过TCP查询SRV,失败时退回系统解析器;有TTL的结果会被缓存
+func (m *Members) resolveSRV(name string) ([]pkg.IpPort, error) {
+	if name == "" {
+		return nil, fmt.Errorf("无效的SRV地址: %q", name)
+	}
+	if strings.Contains(name, "/") {
+		return nil, fmt.Errorf("SRV种子不支持节点名前缀: %q", name)
+	}
+	key := SRVPrefix + name
+	if ips, ok := m.dnsCache.Get(key); ok {
+		return ips, nil
+	}
+
+	server, err := m.dnsServer()
+	if err == nil && server != "" {
+		var ips []pkg.IpPort
+		var ttl uint32
+		if ips, ttl, err = pkg.TcpLookupSRV(name, server); err == nil && len(ips) > 0 {
+			m.dnsCache.Put(key, ips, ttl)
+			return ips, nil
+		}
+	}
+	if err != nil {
+		m.Logger.Printf("[DEBUG] memberlist: TCP SRV lookup 失败'%s', falling back to system resolver: %s", name, err)
+	}
+
+	// 系统解析器已经按优先级和权重排序,但不提供TTL,不缓存
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var ips []pkg.IpPort
+	for _, r := range records {
+		addrs, err := net.LookupIP(r.Target)
+		if err != nil {
+			m.Logger.Printf("[WARN] memberlist: 解析SRV目标失败 %s: %s", r.Target, err)
+			continue
+		}
+		for _, ip := range addrs {
+			ips = append(ips, pkg.IpPort{IP: ip, Port: r.Port})
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("SRV %s 没有可用的地址", name)
+	}
+	return ips, nil
+}
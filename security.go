@@ -187,7 +187,7 @@ func DecryptPayload(keys [][]byte, msg []byte, data []byte) ([]byte, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("没有安装的密钥可以解密信息")
+	return nil, errNoDecryptKey
 }
 
 func appendBytes(first []byte, second []byte) []byte {
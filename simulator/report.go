@@ -0,0 +1,145 @@
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// FailureReport 单个故障节点的检测情况
+type FailureReport struct {
+	Node string
+
+	// Detection 从注入故障到第一个健康节点判定其失败的时间;未被检测到时为0
+	Detection time.Duration
+
+	// Dissemination 从第一次检测到所有健康节点都判定其失败的时间;尚未传播完时为0
+	Dissemination time.Duration
+
+	// Observers 已经判定其失败的健康节点数
+	Observers int
+}
+
+// Report 模拟结果的汇总
+type Report struct {
+	Nodes    int
+	Failed   int
+	Elapsed  time.Duration
+	Failures []FailureReport
+
+	// Undetected 还没有被任何健康节点检测到的故障节点数
+	Undetected int
+
+	MeanDetection     time.Duration
+	MaxDetection      time.Duration
+	MeanDissemination time.Duration
+	MaxDissemination  time.Duration
+
+	// FalsePositives 被至少一个健康节点误判为失败的健康节点数
+	FalsePositives    int
+	FalsePositiveRate float64
+
+	// 每个节点发送的字节数,包括数据包和流连接
+	TotalBytes       uint64
+	MeanBytesPerNode uint64
+	MaxBytesPerNode  uint64
+}
+
+// Report 汇总当前的检测、误报以及流量统计
+func (s *Simulator) Report() *Report {
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+
+	r := &Report{
+		Nodes:   len(s.names),
+		Failed:  len(s.failed),
+		Elapsed: time.Since(s.started),
+	}
+	numHealthy := len(s.names) - len(s.failed)
+
+	var sumDetect, sumDissem time.Duration
+	var numDissem int
+	for name, at := range s.failed {
+		fr := FailureReport{Node: name}
+		var first, last time.Time
+		for obs, when := range s.detected[name] {
+			if _, ok := s.failed[obs]; ok {
+				continue
+			}
+			fr.Observers++
+			if first.IsZero() || when.Before(first) {
+				first = when
+			}
+			if when.After(last) {
+				last = when
+			}
+		}
+		if fr.Observers == 0 {
+			r.Undetected++
+		} else {
+			fr.Detection = first.Sub(at)
+			sumDetect += fr.Detection
+			if fr.Detection > r.MaxDetection {
+				r.MaxDetection = fr.Detection
+			}
+			if fr.Observers == numHealthy {
+				fr.Dissemination = last.Sub(first)
+				sumDissem += fr.Dissemination
+				numDissem++
+				if fr.Dissemination > r.MaxDissemination {
+					r.MaxDissemination = fr.Dissemination
+				}
+			}
+		}
+		r.Failures = append(r.Failures, fr)
+	}
+	sort.Slice(r.Failures, func(i, j int) bool {
+		return r.Failures[i].Node < r.Failures[j].Node
+	})
+	if detected := r.Failed - r.Undetected; detected > 0 {
+		r.MeanDetection = sumDetect / time.Duration(detected)
+	}
+	if numDissem > 0 {
+		r.MeanDissemination = sumDissem / time.Duration(numDissem)
+	}
+
+	for name, seen := range s.detected {
+		if _, ok := s.failed[name]; ok {
+			continue
+		}
+		for obs := range seen {
+			if _, ok := s.failed[obs]; !ok {
+				r.FalsePositives++
+				break
+			}
+		}
+	}
+	if numHealthy > 0 {
+		r.FalsePositiveRate = float64(r.FalsePositives) / float64(numHealthy)
+	}
+
+	for _, t := range s.transports {
+		sent := atomic.LoadUint64(&t.sent)
+		r.TotalBytes += sent
+		if sent > r.MaxBytesPerNode {
+			r.MaxBytesPerNode = sent
+		}
+	}
+	if r.Nodes > 0 {
+		r.MeanBytesPerNode = r.TotalBytes / uint64(r.Nodes)
+	}
+	return r
+}
+
+// String 返回便于阅读的汇总
+func (r *Report) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "nodes=%d failed=%d undetected=%d elapsed=%s\n", r.Nodes, r.Failed, r.Undetected, r.Elapsed)
+	fmt.Fprintf(&buf, "detection: mean=%s max=%s\n", r.MeanDetection, r.MaxDetection)
+	fmt.Fprintf(&buf, "dissemination: mean=%s max=%s\n", r.MeanDissemination, r.MaxDissemination)
+	fmt.Fprintf(&buf, "false positives: %d (%.4f)\n", r.FalsePositives, r.FalsePositiveRate)
+	fmt.Fprintf(&buf, "bytes sent: total=%d mean/node=%d max/node=%d\n", r.TotalBytes, r.MeanBytesPerNode, r.MaxBytesPerNode)
+	return buf.String()
+}
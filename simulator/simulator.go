@@ -0,0 +1,350 @@
+// Package simulator 在进程内基于MockNetwork模拟大规模memberlist集群,
+// 用于评估 SuspicionMult、GossipNodes、RetransmitMult 等参数在上千节点下的表现。
+//
+// 模拟器不是确定性的:节点运行在真实的goroutine与定时器上,memberlist 内部选择探测、gossip目标
+// 使用的随机数也不受控制。Seed 只决定故障节点、加入时的种子节点以及虚拟链路上的丢包与延迟抖动,
+// 同一个Seed的多次运行只能在统计上相互比较,不能逐事件重放。
+package simulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// joinRetries 每个节点加入集群时最多尝试的种子数
+const joinRetries = 3
+
+// joinParallelism 同时进行的加入数;逐个加入在上千节点时耗时过长
+const joinParallelism = 16
+
+// Config 模拟器的配置
+type Config struct {
+	// Nodes 集群中的节点数
+	Nodes int
+
+	// Seed 模拟器自身随机数源以及MockNetwork链路模型的种子,不会修改全局 math/rand
+	Seed int64
+
+	// LossRate 每个数据包被丢弃的概率 [0, 1),流连接不受影响
+	LossRate float64
+
+	// MinLatency、MaxLatency 每个数据包的投递延迟在这个区间内均匀分布
+	MinLatency time.Duration
+	MaxLatency time.Duration
+
+	// Memberlist 用于调整每个节点的memberlist配置,例如 SuspicionMult、GossipNodes、RetransmitMult;
+	// 不能修改Name、Transport、Events
+	Memberlist func(c *memberlist.Config)
+}
+
+// DefaultConfig 返回一个适合在本地快速运行的配置
+func DefaultConfig() *Config {
+	return &Config{
+		Nodes:      100,
+		Seed:       1,
+		MinLatency: time.Millisecond,
+		MaxLatency: 5 * time.Millisecond,
+	}
+}
+
+// Simulator 管理一组运行在同一个虚拟网络上的Members
+type Simulator struct {
+	config  *Config
+	network *memberlist.MockNetwork
+
+	rngLock sync.Mutex
+	rng     *rand.Rand
+
+	names      []string
+	transports map[string]*transport
+	byAddr     map[string]*transport
+	members    map[string]*memberlist.Members
+
+	stateLock sync.RWMutex
+	started   time.Time
+	failed    map[string]time.Time            // 故障节点 -> 注入故障的时间
+	detected  map[string]map[string]time.Time // 被判定失败的节点 -> 观察者 -> 时间
+	stopping  bool
+	inflight  sync.WaitGroup
+	stopCh    chan struct{}
+}
+
+// New 创建所有节点并让它们加入同一个集群
+func New(conf *Config) (*Simulator, error) {
+	if conf.Nodes < 1 {
+		return nil, fmt.Errorf("simulator: 节点数必须大于0")
+	}
+	if conf.LossRate < 0 || conf.LossRate >= 1 {
+		return nil, fmt.Errorf("simulator: 丢包率必须在 [0, 1) 之间")
+	}
+	if conf.MaxLatency < conf.MinLatency {
+		return nil, fmt.Errorf("simulator: MaxLatency 不能小于 MinLatency")
+	}
+
+	// 丢包与延迟交给MockNetwork的链路模型,与 MockLink 的其它用法保持一致
+	network := &memberlist.MockNetwork{Seed: conf.Seed}
+	network.SetDefaultLink(memberlist.MockLink{
+		DropRate: conf.LossRate,
+		Delay:    conf.MinLatency,
+		Jitter:   conf.MaxLatency - conf.MinLatency,
+	})
+
+	s := &Simulator{
+		config:     conf,
+		network:    network,
+		rng:        rand.New(rand.NewSource(conf.Seed)),
+		transports: make(map[string]*transport),
+		byAddr:     make(map[string]*transport),
+		members:    make(map[string]*memberlist.Members),
+		failed:     make(map[string]time.Time),
+		detected:   make(map[string]map[string]time.Time),
+		stopCh:     make(chan struct{}),
+	}
+
+	for i := 0; i < conf.Nodes; i++ {
+		name := fmt.Sprintf("node-%d", i)
+		t := newTransport(s, name)
+		s.names = append(s.names, name)
+		s.transports[name] = t
+		s.byAddr[t.Addr.String()] = t
+	}
+
+	for _, name := range s.names {
+		c := memberlist.DefaultLANConfig()
+		if conf.Memberlist != nil {
+			conf.Memberlist(c)
+		}
+		c.Name = name
+		c.Transport = s.transports[name]
+		c.Events = &observer{sim: s, name: name}
+		if c.Logger == nil && c.LogOutput == nil {
+			c.LogOutput = ioutil.Discard
+		}
+
+		m, err := memberlist.Create(c)
+		if err != nil {
+			s.Shutdown()
+			return nil, fmt.Errorf("simulator: 创建节点 %s 失败: %v", name, err)
+		}
+		s.members[name] = m
+	}
+
+	if err := s.joinAll(); err != nil {
+		s.Shutdown()
+		return nil, err
+	}
+
+	s.stateLock.Lock()
+	s.started = time.Now()
+	s.stateLock.Unlock()
+	return s, nil
+}
+
+// joinAll 让第一个节点之外的每个节点随机加入一个编号更小的节点,避免所有节点与同一个种子做全量同步。
+// 加入并发进行,种子自己可能还没有加入,由gossip和push/pull最终合并
+func (s *Simulator) joinAll() error {
+	var (
+		wg      sync.WaitGroup
+		errLock sync.Mutex
+		first   error
+	)
+	sem := make(chan struct{}, joinParallelism)
+	for i := 1; i < len(s.names); i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			name := s.names[i]
+			if err := s.join(s.members[name], i); err != nil {
+				errLock.Lock()
+				if first == nil {
+					first = fmt.Errorf("simulator: 节点 %s 加入集群失败: %v", name, err)
+				}
+				errLock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return first
+}
+
+// join 从前n个节点中随机选择种子加入,失败时换一个种子重试
+func (s *Simulator) join(m *memberlist.Members, n int) error {
+	var err error
+	for try := 0; try < joinRetries; try++ {
+		seed := s.names[s.intn(n)]
+		if _, err = m.Join([]string{seed + "/" + s.transports[seed].Addr.String()}); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Names 返回所有节点的名字
+func (s *Simulator) Names() []string {
+	out := make([]string, len(s.names))
+	copy(out, s.names)
+	return out
+}
+
+// Members 返回指定节点的Members
+func (s *Simulator) Members(name string) *memberlist.Members {
+	return s.members[name]
+}
+
+// WaitConverged 等待所有健康节点都看到全部健康节点,超时返回错误
+func (s *Simulator) WaitConverged(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		healthy := s.healthy()
+		lagging, example, seen := 0, "", 0
+		for _, name := range healthy {
+			if n := s.members[name].NumMembers(); n != len(healthy) {
+				lagging++
+				example, seen = name, n
+			}
+		}
+		if lagging == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("simulator: %d 个节点在 %s 内没有收敛,例如 %s 只看到 %d/%d 个节点",
+				lagging, timeout, example, seen, len(healthy))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Fail 随机选择n个健康节点注入故障,这些节点的所有网络流量都会被丢弃;返回被选中的节点
+func (s *Simulator) Fail(n int) []string {
+	healthy := s.healthy()
+	s.rngLock.Lock()
+	s.rng.Shuffle(len(healthy), func(i, j int) {
+		healthy[i], healthy[j] = healthy[j], healthy[i]
+	})
+	s.rngLock.Unlock()
+	if n > len(healthy) {
+		n = len(healthy)
+	}
+	victims := healthy[:n]
+	s.FailNodes(victims...)
+	return victims
+}
+
+// FailNodes 对指定节点注入故障
+func (s *Simulator) FailNodes(names ...string) {
+	now := time.Now()
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	for _, name := range names {
+		if _, ok := s.failed[name]; !ok {
+			s.failed[name] = now
+		}
+	}
+}
+
+// Run 让集群运行一段时间
+func (s *Simulator) Run(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-s.stopCh:
+	}
+}
+
+// Shutdown 停止所有节点;先等待正在投递的数据包,避免阻塞在已经停止的节点上
+func (s *Simulator) Shutdown() {
+	s.stateLock.Lock()
+	if s.stopping {
+		s.stateLock.Unlock()
+		return
+	}
+	s.stopping = true
+	s.stateLock.Unlock()
+
+	s.inflight.Wait()
+	close(s.stopCh)
+	for _, m := range s.members {
+		m.SetShutdown()
+	}
+}
+
+// healthy 返回没有被注入故障的节点
+func (s *Simulator) healthy() []string {
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+	out := make([]string, 0, len(s.names))
+	for _, name := range s.names {
+		if _, ok := s.failed[name]; !ok {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func (s *Simulator) isFailed(name string) bool {
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+	_, ok := s.failed[name]
+	return ok
+}
+
+// begin 登记一次正在进行的投递;停止后返回false
+func (s *Simulator) begin() bool {
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+	if s.stopping {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+func (s *Simulator) done() {
+	s.inflight.Done()
+}
+
+func (s *Simulator) intn(n int) int {
+	s.rngLock.Lock()
+	defer s.rngLock.Unlock()
+	return s.rng.Intn(n)
+}
+
+// lookup 与MockTransport一样,优先按名字查找目标
+func (s *Simulator) lookup(a pkg.Address) *transport {
+	if a.Name != "" {
+		return s.transports[a.Name]
+	}
+	return s.byAddr[a.Addr]
+}
+
+// observer 记录每个节点看到的失败事件
+type observer struct {
+	sim  *Simulator
+	name string
+}
+
+func (o *observer) NotifyJoin(*memberlist.Node) {}
+
+func (o *observer) NotifyUpdate(*memberlist.Node) {}
+
+func (o *observer) NotifyLeave(n *memberlist.Node) {
+	o.sim.stateLock.Lock()
+	defer o.sim.stateLock.Unlock()
+	seen, ok := o.sim.detected[n.Name]
+	if !ok {
+		seen = make(map[string]time.Time)
+		o.sim.detected[n.Name] = seen
+	}
+	if _, ok := seen[o.name]; !ok {
+		seen[o.name] = time.Now()
+	}
+}
@@ -0,0 +1,124 @@
+package simulator
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+func fastConfig(c *memberlist.Config) {
+	c.ProbeInterval = 200 * time.Millisecond
+	c.ProbeTimeout = 100 * time.Millisecond
+	c.GossipInterval = 20 * time.Millisecond
+	c.PushPullInterval = time.Second
+	c.SuspicionMult = 3
+	c.TCPTimeout = time.Second
+}
+
+func TestSimulator_DetectsFailures(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Nodes = 10
+	conf.Memberlist = fastConfig
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	require.NoError(t, s.WaitConverged(10*time.Second))
+
+	victims := s.Fail(2)
+	require.Len(t, victims, 2)
+
+	deadline := time.Now().Add(10 * time.Second)
+	var r *Report
+	for time.Now().Before(deadline) {
+		r = s.Report()
+		if r.Undetected == 0 && r.MaxDissemination > 0 && r.MeanDissemination > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Equal(t, 0, r.Undetected, r.String())
+	require.Len(t, r.Failures, 2)
+	for _, f := range r.Failures {
+		require.True(t, f.Detection > 0, r.String())
+	}
+	require.True(t, r.TotalBytes > 0)
+	require.True(t, r.MaxBytesPerNode >= r.MeanBytesPerNode)
+}
+
+func TestSimulator_Loss(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Nodes = 8
+	conf.LossRate = 0.1
+	conf.Memberlist = fastConfig
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	// 丢包可能导致误判,这里只检查统计本身
+	s.Run(500 * time.Millisecond)
+
+	r := s.Report()
+	require.Equal(t, 8, r.Nodes)
+	require.Equal(t, 0, r.Failed)
+	require.True(t, r.FalsePositiveRate >= 0 && r.FalsePositiveRate <= 1)
+}
+
+func TestSimulator_BadConfig(t *testing.T) {
+	_, err := New(&Config{Nodes: 0})
+	require.Error(t, err)
+
+	_, err = New(&Config{Nodes: 1, LossRate: 1})
+	require.Error(t, err)
+}
+
+// TestSimulator_Large 在目标规模下检查加入、收敛与故障检测。上千节点需要多核机器和较长时间,
+// 只在设置了 SIMULATOR_NODES 时运行,例如:
+//
+//	SIMULATOR_NODES=1000 go test -run Large -timeout 30m ./simulator/
+func TestSimulator_Large(t *testing.T) {
+	nodes, _ := strconv.Atoi(os.Getenv("SIMULATOR_NODES"))
+	if nodes <= 0 {
+		t.Skip("设置 SIMULATOR_NODES 以运行大规模模拟")
+	}
+
+	conf := DefaultConfig()
+	conf.Nodes = nodes
+	conf.Memberlist = func(c *memberlist.Config) {
+		c.ProbeInterval = time.Second
+		c.ProbeTimeout = 500 * time.Millisecond
+		c.GossipInterval = 500 * time.Millisecond
+		// push/pull间隔会随集群规模放大,它负责补齐错过gossip的节点
+		c.PushPullInterval = 10 * time.Second
+		c.SuspicionMult = 4
+		c.TCPTimeout = 30 * time.Second
+		c.EnableCompression = false
+	}
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	// 收敛与检测时间都随 log(N) 增长,这里按节点数线性放宽以容忍较慢的机器
+	wait := 2*time.Minute + time.Duration(nodes)*100*time.Millisecond
+	require.NoError(t, s.WaitConverged(wait))
+
+	victims := s.Fail(5)
+	require.Len(t, victims, 5)
+
+	deadline := time.Now().Add(wait)
+	var r *Report
+	for time.Now().Before(deadline) {
+		r = s.Report()
+		if r.Undetected == 0 && r.MaxDissemination > 0 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	t.Log(r.String())
+	require.Equal(t, nodes, r.Nodes)
+	require.Equal(t, 0, r.Undetected, r.String())
+}
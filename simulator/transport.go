@@ -0,0 +1,117 @@
+package simulator
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// transport 包装MockTransport,负责故障注入与异步投递,并统计每个节点发送的字节数;
+// 丢包和延迟由MockNetwork的链路模型施加
+type transport struct {
+	*memberlist.MockTransport
+	sim      *Simulator
+	name     string
+	streamCh chan net.Conn
+	sent     uint64 // 发送的字节数,原子操作
+}
+
+var _ memberlist.NodeAwareTransport = (*transport)(nil)
+
+func newTransport(sim *Simulator, name string) *transport {
+	t := &transport{
+		MockTransport: sim.network.NewTransport(name),
+		sim:           sim,
+		name:          name,
+		streamCh:      make(chan net.Conn),
+	}
+	go t.forwardStreams()
+	return t
+}
+
+// forwardStreams 接管MockTransport的流通道,以便统计接收方在流上写出的字节
+func (t *transport) forwardStreams() {
+	for {
+		select {
+		case conn := <-t.MockTransport.StreamCh:
+			select {
+			case t.streamCh <- &countingConn{Conn: conn, counter: &t.sent}:
+			case <-t.sim.stopCh:
+				conn.Close()
+				return
+			}
+		case <-t.sim.stopCh:
+			return
+		}
+	}
+}
+
+// See Transport.
+func (t *transport) GetStreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// See Transport.
+func (t *transport) WriteTo(b []byte, addr string) (time.Time, error) {
+	return t.WriteToAddress(b, pkg.Address{Addr: addr})
+}
+
+// WriteToAddress 与UDP一样,丢弃的包不会返回错误;投递总是异步进行,避免两个节点互相阻塞
+func (t *transport) WriteToAddress(b []byte, a pkg.Address) (time.Time, error) {
+	now := time.Now()
+	dest := t.sim.lookup(a)
+	if dest == nil {
+		return time.Time{}, fmt.Errorf("No route to %s", a.String())
+	}
+	atomic.AddUint64(&t.sent, uint64(len(b)))
+
+	if t.sim.isFailed(t.name) || t.sim.isFailed(dest.name) || !t.sim.begin() {
+		return now, nil
+	}
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	go func() {
+		defer t.sim.done()
+		t.MockTransport.WriteToAddress(buf, a)
+	}()
+	return now, nil
+}
+
+// See Transport.
+func (t *transport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return t.DialAddressTimeout(pkg.Address{Addr: addr}, timeout)
+}
+
+// DialAddressTimeout 流连接不会丢包,但是任意一端故障时拨号失败
+func (t *transport) DialAddressTimeout(a pkg.Address, timeout time.Duration) (net.Conn, error) {
+	dest := t.sim.lookup(a)
+	if dest == nil {
+		return nil, fmt.Errorf("No route to %s", a.String())
+	}
+	if t.sim.isFailed(t.name) || t.sim.isFailed(dest.name) || !t.sim.begin() {
+		return nil, fmt.Errorf("dial %s: i/o timeout", a.String())
+	}
+	defer t.sim.done()
+
+	conn, err := t.MockTransport.DialAddressTimeout(a, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, counter: &t.sent}, nil
+}
+
+// countingConn 统计写入连接的字节数
+type countingConn struct {
+	net.Conn
+	counter *uint64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(c.counter, uint64(n))
+	return n, err
+}
@@ -33,6 +33,7 @@ type Node struct {
 	DMin  uint8         // Min 协议版本 for the delegate to understand
 	DMax  uint8         // Max 协议版本 for the delegate to understand
 	DCur  uint8         // Current version delegate is speaking
+	ID    []byte        // 可选的稳定节点ID,不随名字和地址变化
 }
 
 // Address 返回host:Port
@@ -59,6 +60,10 @@ type NodeState struct {
 	Incarnation uint32        // Last known incarnation number
 	State       NodeStateType // 当前的状态
 	StateChange time.Time     // Time last state change happened
+	DeclaredBy  string        // 宣布该节点死亡的节点,存活时为空
+
+	// movedFrom 同一个NodeID换地址之前的地址,旧地址上迟到的消息不能把地址改回去
+	movedFrom Node
 }
 
 // Address returns the host:Port form of a node's Address, suitable for use
@@ -123,6 +128,18 @@ func (m *Members) Schedule() {
 		go m.triggerFunc(m.Config.GossipInterval, t.C, stopCh, m.Gossip)
 		m.tickers = append(m.tickers, t)
 	}
+
+	// 定时尝试重新连接失败的节点,使网络分区恢复后集群能自动合并
+	if m.Config.ReconnectInterval > 0 {
+		t := time.NewTicker(m.Config.ReconnectInterval)
+		go m.triggerFunc(m.Config.ReconnectInterval, t.C, stopCh, m.Reconnect)
+		m.tickers = append(m.tickers, t)
+	}
+	if m.Config.MapTombstoneGCInterval > 0 {
+		t := time.NewTicker(m.Config.MapTombstoneGCInterval)
+		go m.triggerFunc(m.Config.MapTombstoneGCInterval, t.C, stopCh, m.collectTombstones)
+		m.tickers = append(m.tickers, t)
+	}
 	if len(m.tickers) > 0 {
 		m.stopTickCh = stopCh
 	}
@@ -259,13 +276,25 @@ func FailedRemote(err error) bool {
 
 // ResetNodes 清除Dead节点,并将节点列表刷新
 func (m *Members) ResetNodes() {
+	dead, left := m.Config.tombstoneRetention()
+	reap, _ := m.Config.Events.(ReapEventDelegate)
+	var reaped []Tombstone
+	// NotifyReap 可能阻塞,释放 NodeLock 之后再调用
+	defer func() {
+		for i := range reaped {
+			reap.NotifyReap(&reaped[i])
+		}
+	}()
 	m.NodeLock.Lock()
 	defer m.NodeLock.Unlock()
 
-	// 移除Dead node ,超过了Dead interval的
-	DeadIdx := MoveDeadNodes(m.Nodes, m.Config.GossipToTheDeadTime)
+	// 移除Dead node ,超过了墓碑保留时间的
+	DeadIdx := moveTombstones(m.Nodes, dead, left)
 	// 第一个在m.Nodes Dead的节点的索引
 	for i := DeadIdx; i < len(m.Nodes); i++ {
+		if reap != nil {
+			reaped = append(reaped, m.Nodes[i].tombstone())
+		}
 		delete(m.NodeMap, m.Nodes[i].Name)
 		m.Nodes[i] = nil
 	}
@@ -374,6 +403,7 @@ func (m *Members) Refute(me *NodeState, accusedInc uint32) {
 			me.PMin, me.PMax, me.PCur,
 			me.DMin, me.DMax, me.DCur,
 		},
+		ID: me.ID,
 	}
 	m.EncodeBroadcast(me.Addr.String(), AliveMsg, a)
 }
@@ -0,0 +1,132 @@
+package test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+type banAfter struct {
+	threshold uint64
+	ban       time.Duration
+	calls     int32
+	dropped   uint64
+}
+
+func (b *banAfter) NotifyThrottled(from net.Addr, msgType memberlist.MessageType, dropped uint64) time.Duration {
+	atomic.AddInt32(&b.calls, 1)
+	atomic.StoreUint64(&b.dropped, dropped)
+	if dropped >= b.threshold {
+		return b.ban
+	}
+	return 0
+}
+
+func userPacket() []byte {
+	return append([]byte{byte(memberlist.UserMsg)}, "hi"...)
+}
+
+func TestAdmission_RateLimit(t *testing.T) {
+	m := GetMemberlist(t, func(c *memberlist.Config) {
+		c.RateLimits = map[memberlist.MessageType]memberlist.RateLimit{
+			memberlist.UserMsg: {Rate: 0.001, Burst: 2},
+		}
+	})
+	defer m.SetShutdown()
+
+	bad := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	good := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	buf := userPacket()
+
+	for i := 0; i < 5; i++ {
+		m.HandleCommand(buf, bad, time.Now())
+	}
+	require.Equal(t, uint64(3), m.AdmissionStats().Throttled[memberlist.UserMsg])
+
+	// 其他来源有独立的令牌桶
+	m.HandleCommand(buf, good, time.Now())
+	require.Equal(t, uint64(3), m.AdmissionStats().Throttled[memberlist.UserMsg])
+
+	// 不同端口、同一个IP共享令牌桶
+	m.HandleCommand(buf, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}, time.Now())
+	require.Equal(t, uint64(4), m.AdmissionStats().Throttled[memberlist.UserMsg])
+
+	// 复合消息拆开后逐条计算
+	compound := memberlist.MakeCompoundMessage([][]byte{buf, buf})
+	m.HandleCommand(compound.Bytes(), bad, time.Now())
+	require.Equal(t, uint64(6), m.AdmissionStats().Throttled[memberlist.UserMsg])
+}
+
+func TestAdmission_BanHook(t *testing.T) {
+	hook := &banAfter{threshold: 2, ban: time.Hour}
+	m := GetMemberlist(t, func(c *memberlist.Config) {
+		c.RateLimits = map[memberlist.MessageType]memberlist.RateLimit{
+			memberlist.UserMsg: {Rate: 0.001, Burst: 1},
+		}
+		c.Admission = hook
+	})
+	defer m.SetShutdown()
+
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	buf := userPacket()
+	for i := 0; i < 3; i++ {
+		m.HandleCommand(buf, from, time.Now())
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&hook.calls))
+
+	// 封禁后全部流量都被丢弃,不再经过限流
+	m.HandleIngestPacket(buf, from, time.Now())
+	m.HandleCommand(buf, from, time.Now())
+	stats := m.AdmissionStats()
+	require.Equal(t, uint64(2), stats.Banned)
+	require.Equal(t, uint64(2), stats.Throttled[memberlist.UserMsg])
+	require.Equal(t, int32(2), atomic.LoadInt32(&hook.calls))
+
+	m.UnbanSource(from.IP)
+	m.HandleCommand(buf, from, time.Now())
+	require.Equal(t, uint64(2), m.AdmissionStats().Banned)
+}
+
+func TestAdmission_DroppedResetOnRefill(t *testing.T) {
+	hook := &banAfter{threshold: 100, ban: time.Hour}
+	m := GetMemberlist(t, func(c *memberlist.Config) {
+		c.RateLimits = map[memberlist.MessageType]memberlist.RateLimit{
+			memberlist.UserMsg: {Rate: 20, Burst: 1},
+		}
+		c.Admission = hook
+	})
+	defer m.SetShutdown()
+
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	buf := userPacket()
+	for i := 0; i < 3; i++ {
+		m.HandleCommand(buf, from, time.Now())
+	}
+	require.Equal(t, uint64(2), atomic.LoadUint64(&hook.dropped))
+
+	// 令牌桶补满后重新计数
+	time.Sleep(200 * time.Millisecond)
+	m.HandleCommand(buf, from, time.Now())
+	m.HandleCommand(buf, from, time.Now())
+	require.Equal(t, uint64(1), atomic.LoadUint64(&hook.dropped))
+	require.Equal(t, uint64(3), m.AdmissionStats().Throttled[memberlist.UserMsg])
+}
+
+func TestAdmission_BanSource(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.SetShutdown()
+
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	m.BanSource(from.IP, 50*time.Millisecond)
+
+	m.HandleIngestPacket(userPacket(), from, time.Now())
+	require.Equal(t, uint64(1), m.AdmissionStats().Banned)
+
+	time.Sleep(60 * time.Millisecond)
+	m.HandleIngestPacket(userPacket(), from, time.Now())
+	require.Equal(t, uint64(1), m.AdmissionStats().Banned)
+}
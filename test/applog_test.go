@@ -0,0 +1,184 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+// countMsgs 统计每种消息收到的次数
+func countMsgs(d *MockDelegate) map[string]int {
+	out := make(map[string]int)
+	for _, msg := range d.getMessages() {
+		out[string(msg)]++
+	}
+	return out
+}
+
+func TestAppBroadcast_Gossip(t *testing.T) {
+	_, members, delegates := newTestCluster(t, 3, nil)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	seq, err := members[0].BroadcastApp([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), seq)
+	seq, err = members[1].BroadcastApp([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), seq)
+
+	// 来源节点自己不会收到
+	want := []map[string]int{{"b": 1}, {"a": 1}, {"a": 1, "b": 1}}
+	for i, d := range delegates {
+		retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+			if got := countMsgs(d); len(got) != len(want[i]) || got["a"] != want[i]["a"] || got["b"] != want[i]["b"] {
+				failf("node%d: %v", i+1, got)
+			}
+		})
+	}
+
+	_, err = members[0].BroadcastApp(make([]byte, 2000))
+	require.Error(t, err)
+}
+
+func appPartitionCluster(t *testing.T, logSize int) (*memberlist.MockNetwork, []*memberlist.Members, []*MockDelegate) {
+	return newTestCluster(t, 3, func(c *memberlist.Config) {
+		// 分区期间不做故障检测,只依靠push/pull修复
+		c.ProbeInterval = time.Hour
+		c.PushPullInterval = 50 * time.Millisecond
+		c.TCPTimeout = 50 * time.Millisecond
+		c.RetransmitMult = 1
+		c.AppLogSize = logSize
+	})
+}
+
+func TestAppBroadcast_RepairAfterPartition(t *testing.T) {
+	n, members, delegates := appPartitionCluster(t, 128)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	n.Partition([]string{"node1", "node2"}, []string{"node3"})
+	for i := 0; i < 5; i++ {
+		_, err := members[0].BroadcastApp([]byte("m" + strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		if got := countMsgs(delegates[1]); len(got) != 5 {
+			failf("node2: %v", got)
+		}
+	})
+	// 等待重传结束
+	time.Sleep(200 * time.Millisecond)
+	require.Empty(t, countMsgs(delegates[2]))
+
+	n.Heal()
+	retry(t, 100, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		got := countMsgs(delegates[2])
+		if len(got) != 5 {
+			failf("node3: %v", got)
+		}
+	})
+
+	// 多次push/pull之后也不会重复投递
+	time.Sleep(300 * time.Millisecond)
+	for _, d := range delegates {
+		for msg, num := range countMsgs(d) {
+			require.Equal(t, 1, num, msg)
+		}
+	}
+}
+
+func TestAppBroadcast_RepairTruncatedLog(t *testing.T) {
+	n, members, delegates := appPartitionCluster(t, 2)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	n.Partition([]string{"node1", "node2"}, []string{"node3"})
+	for i := 0; i < 5; i++ {
+		_, err := members[0].BroadcastApp([]byte("m" + strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// 只能修复日志中保留的最近两条
+	n.Heal()
+	retry(t, 100, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		got := countMsgs(delegates[2])
+		if got["m3"] != 1 || got["m4"] != 1 {
+			failf("node3: %v", got)
+		}
+	})
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, map[string]int{"m3": 1, "m4": 1}, countMsgs(delegates[2]))
+}
+
+// oldPushPullHeader 不认识应用广播的旧版本使用的头部
+type oldPushPullHeader struct {
+	Nodes        int
+	UserStateLen int
+	Join         bool
+}
+
+func TestAppBroadcast_PushPullOldPeer(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	d := &MockDelegate{}
+	d.setState([]byte("node1-state"))
+	m1 := newTestNode(t, n, "node1", func(c *memberlist.Config) { c.Delegate = d })
+	defer m1.SetShutdown()
+	old := newTestNode(t, n, "old", nil)
+	defer old.SetShutdown()
+
+	_, err := m1.BroadcastApp([]byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, m1.ReplicatedMap().Set("k", []byte("v")))
+
+	conn, err := n.TransportsByName["old"].DialTimeout(n.TransportsByName["node1"].Addr.String(), time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// 按旧版本的格式发送: 头部、节点、用户状态
+	buf := bytes.NewBuffer([]byte{byte(memberlist.PushPullMsg)})
+	enc := codec.NewEncoder(buf, &codec.MsgpackHandle{})
+	require.NoError(t, enc.Encode(&oldPushPullHeader{Nodes: 1, UserStateLen: len("old-state")}))
+	require.NoError(t, enc.Encode(&memberlist.PushNodeState{
+		Name:        "old",
+		Addr:        net.ParseIP("127.0.0.1"),
+		Port:        9999,
+		Incarnation: 1,
+		State:       memberlist.StateAlive,
+		Vsn:         old.Config.BuildVsnArray(),
+	}))
+	buf.WriteString("old-state")
+	require.NoError(t, old.RawSendMsgStream(conn, buf.Bytes(), ""))
+
+	// 旧版本读到用户状态为止,后面的数据被忽略
+	msgType, bufConn, dec, err := old.ReadStream(conn, "")
+	require.NoError(t, err)
+	require.Equal(t, memberlist.PushPullMsg, msgType)
+	var h oldPushPullHeader
+	require.NoError(t, dec.Decode(&h))
+	for i := 0; i < h.Nodes; i++ {
+		var s memberlist.PushNodeState
+		require.NoError(t, dec.Decode(&s))
+	}
+	userState := make([]byte, h.UserStateLen)
+	_, err = io.ReadFull(bufConn, userState)
+	require.NoError(t, err)
+	require.Equal(t, "node1-state", string(userState))
+
+	retry(t, 50, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if got := string(d.getRemoteState()); got != "old-state" {
+			failf("remote state %q", got)
+		}
+	})
+}
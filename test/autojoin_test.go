@@ -0,0 +1,66 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/memberlist/discover"
+	"github.com/stretchr/testify/require"
+)
+
+func autoJoinNode(t *testing.T, n *memberlist.MockNetwork, name string, interval time.Duration) *memberlist.Members {
+	return newTestNode(t, n, name, func(c *memberlist.Config) {
+		c.AutoJoinInterval = interval
+	})
+}
+
+func TestAutoJoin_Static(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := autoJoinNode(t, n, "node1", time.Hour)
+	defer m1.SetShutdown()
+	m2 := autoJoinNode(t, n, "node2", time.Hour)
+	defer m2.SetShutdown()
+
+	stop := m2.AutoJoin(discover.Static{seedOf(n, "node1")})
+	defer stop()
+
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		if m1.NumMembers() != 2 || m2.NumMembers() != 2 {
+			failf("not joined: %d %d", m1.NumMembers(), m2.NumMembers())
+		}
+	})
+}
+
+func TestAutoJoin_FileWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autojoin")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seeds")
+	require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+
+	n := &memberlist.MockNetwork{}
+	m1 := autoJoinNode(t, n, "node1", 0)
+	defer m1.SetShutdown()
+	m2 := autoJoinNode(t, n, "node2", 0)
+	defer m2.SetShutdown()
+
+	stop := m2.AutoJoin(&discover.File{Path: path, PollInterval: 10 * time.Millisecond})
+	defer stop()
+
+	// 没有种子节点时保持孤立
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, m2.NumMembers())
+
+	// 文件变化后重新发现并加入
+	seeds := seedOf(n, "node1") + "\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(seeds), 0644))
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		if m1.NumMembers() != 2 || m2.NumMembers() != 2 {
+			failf("not joined: %d %d", m1.NumMembers(), m2.NumMembers())
+		}
+	})
+}
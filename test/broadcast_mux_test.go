@@ -0,0 +1,164 @@
+package test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/memberlist/broadcast_tree"
+	"github.com/stretchr/testify/require"
+)
+
+func muxTopic(name string, weight int, handler func([]byte)) *memberlist.BroadcastTopic {
+	return &memberlist.BroadcastTopic{
+		Name:    name,
+		Weight:  weight,
+		Queue:   &broadcast_tree.TransmitLimitedQueue{RetransmitMult: 1, NumNodes: func() int { return 1 }},
+		Handler: handler,
+	}
+}
+
+func queueMux(t *memberlist.BroadcastTopic, n, size int) {
+	for i := 0; i < n; i++ {
+		msg := make([]byte, size)
+		t.Queue.QueueBroadcast(&broadcast_tree.MemberlistBroadcast{Node: fmt.Sprintf("%s-%d", t.Name, i), Msg: msg})
+	}
+}
+
+func TestBroadcastMux_Register(t *testing.T) {
+	x := memberlist.NewBroadcastMux(nil)
+	require.NoError(t, x.Register(muxTopic("a", 1, nil)))
+	require.Error(t, x.Register(muxTopic("a", 1, nil)))
+	require.Error(t, x.Register(muxTopic("", 1, nil)))
+	require.Error(t, x.Register(&memberlist.BroadcastTopic{Name: "b"}))
+
+	x.Deregister("a")
+	require.Nil(t, x.Topic("a"))
+	require.NoError(t, x.Register(muxTopic("a", 1, nil)))
+}
+
+func TestBroadcastMux_WeightedShare(t *testing.T) {
+	x := memberlist.NewBroadcastMux(nil)
+	a := muxTopic("a", 3, nil)
+	b := muxTopic("b", 1, nil)
+	require.NoError(t, x.Register(a))
+	require.NoError(t, x.Register(b))
+	queueMux(a, 100, 8)
+	queueMux(b, 100, 8)
+
+	// 每条消息 2(开销) + 2(主题头) + 8 = 12 字节
+	out := x.GetBroadcasts(2, 480)
+	counts := map[byte]int{}
+	total := 0
+	for _, msg := range out {
+		require.Equal(t, byte(1), msg[0])
+		counts[msg[1]]++
+		total += 2 + len(msg)
+	}
+	require.True(t, total <= 480)
+	require.Equal(t, 30, counts['a'])
+	require.Equal(t, 10, counts['b'])
+}
+
+func TestBroadcastMux_LeftoverBudget(t *testing.T) {
+	x := memberlist.NewBroadcastMux(nil)
+	a := muxTopic("a", 1, nil)
+	b := muxTopic("b", 1, nil)
+	require.NoError(t, x.Register(a))
+	require.NoError(t, x.Register(b))
+	queueMux(a, 1, 8)
+	queueMux(b, 100, 8)
+
+	// a 只用了一条,剩余的预算分给 b
+	out := x.GetBroadcasts(2, 480)
+	counts := map[byte]int{}
+	for _, msg := range out {
+		counts[msg[1]]++
+	}
+	require.Equal(t, 1, counts['a'])
+	require.Equal(t, 39, counts['b'])
+}
+
+func TestBroadcastMux_Route(t *testing.T) {
+	var got []string
+	x := memberlist.NewBroadcastMux(nil)
+	require.NoError(t, x.Register(muxTopic("a", 1, func(msg []byte) { got = append(got, "a:"+string(msg)) })))
+	require.NoError(t, x.Register(muxTopic("bb", 1, func(msg []byte) { got = append(got, "bb:"+string(msg)) })))
+
+	x.NotifyMsg(append([]byte{1, 'a'}, "x"...))
+	x.NotifyMsg(append([]byte{2, 'b', 'b'}, "y"...))
+	x.NotifyMsg(append([]byte{1, 'c'}, "z"...))
+	x.NotifyMsg([]byte{5, 'a'})
+	require.Equal(t, []string{"a:x", "bb:y"}, got)
+	x.NotifyMsg([]byte{0, 'd'})
+	require.Equal(t, []string{"a:x", "bb:y"}, got)
+	require.Equal(t, uint64(3), x.UnknownCount())
+}
+
+func TestBroadcastMux_Delegate(t *testing.T) {
+	d := &MockDelegate{}
+	d.setBroadcasts([][]byte{[]byte("plain")})
+	x := memberlist.NewBroadcastMux(d)
+	a := muxTopic("a", 1, nil)
+	require.NoError(t, x.Register(a))
+	queueMux(a, 1, 8)
+
+	// Delegate 的广播以0字节为前缀,和主题的消息一起发送
+	out := x.GetBroadcasts(2, 480)
+	require.Len(t, out, 2)
+	require.Contains(t, out, append([]byte{0}, "plain"...))
+
+	// 没有主题名的消息转发给 Delegate
+	x.NotifyMsg(append([]byte{0}, "hello"...))
+	require.Equal(t, [][]byte{[]byte("hello")}, d.getMessages())
+	require.Zero(t, x.UnknownCount())
+}
+
+func TestBroadcastMux_Cluster(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	var lock sync.Mutex
+	got := map[string][]string{}
+
+	var muxes []*memberlist.BroadcastMux
+	var members []*memberlist.Members
+	for i := 1; i <= 2; i++ {
+		name := fmt.Sprintf("node%d", i)
+		x := memberlist.NewBroadcastMux(&MockDelegate{})
+		for _, topic := range []string{"kv", "locks"} {
+			topic := topic
+			require.NoError(t, x.Register(muxTopic(topic, 1, func(msg []byte) {
+				lock.Lock()
+				defer lock.Unlock()
+				got[name+"/"+topic] = append(got[name+"/"+topic], string(msg))
+			})))
+		}
+
+		m := newTestNode(t, n, name, func(c *memberlist.Config) {
+			c.Delegate = x
+			c.GossipInterval = 10 * time.Millisecond
+		})
+		defer m.SetShutdown()
+		if i > 1 {
+			_, err := m.Join([]string{seedOf(n, "node1")})
+			require.NoError(t, err)
+		}
+		muxes = append(muxes, x)
+		members = append(members, m)
+	}
+
+	muxes[0].Topic("kv").Queue.QueueBroadcast(&broadcast_tree.MemberlistBroadcast{Node: "k", Msg: []byte("put")})
+	muxes[0].Topic("locks").Queue.QueueBroadcast(&broadcast_tree.MemberlistBroadcast{Node: "l", Msg: []byte("acquire")})
+
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		lock.Lock()
+		defer lock.Unlock()
+		if len(got["node2/kv"]) == 0 || got["node2/kv"][0] != "put" {
+			failf("kv not delivered: %v", got)
+		}
+		if len(got["node2/locks"]) == 0 || got["node2/locks"][0] != "acquire" {
+			failf("locks not delivered: %v", got)
+		}
+	})
+}
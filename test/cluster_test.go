@@ -0,0 +1,62 @@
+package test
+
+import (
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestNode 在MockNetwork上创建一个名为name的节点,conf 可以修改默认配置
+func newTestNode(t *testing.T, n *memberlist.MockNetwork, name string, conf func(c *memberlist.Config)) *memberlist.Members {
+	c := memberlist.DefaultLANConfig()
+	c.Name = name
+	c.Transport = n.NewTransport(name)
+	c.LogOutput = ioutil.Discard
+	if conf != nil {
+		conf(c)
+	}
+	m, err := memberlist.Create(c)
+	require.NoError(t, err)
+	return m
+}
+
+// seedOf 返回节点在MockNetwork上的种子地址
+func seedOf(n *memberlist.MockNetwork, name string) string {
+	return name + "/" + n.TransportsByName[name].Addr.String()
+}
+
+// newTestCluster 创建 node1..nodeN,每个节点使用一个 MockDelegate,其余节点加入 node1 并等待成员一致。
+// conf 按节点顺序调用
+func newTestCluster(t *testing.T, num int, conf func(c *memberlist.Config)) (*memberlist.MockNetwork, []*memberlist.Members, []*MockDelegate) {
+	n := &memberlist.MockNetwork{}
+	var members []*memberlist.Members
+	var delegates []*MockDelegate
+	for i := 0; i < num; i++ {
+		d := &MockDelegate{}
+		m := newTestNode(t, n, "node"+strconv.Itoa(i+1), func(c *memberlist.Config) {
+			c.Delegate = d
+			c.GossipInterval = 10 * time.Millisecond
+			if conf != nil {
+				conf(c)
+			}
+		})
+		if i > 0 {
+			_, err := m.Join([]string{seedOf(n, "node1")})
+			require.NoError(t, err)
+		}
+		members = append(members, m)
+		delegates = append(delegates, d)
+	}
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		for _, m := range members {
+			if got := m.NumMembers(); got != num {
+				failf("expected %d members, got %d", num, got)
+			}
+		}
+	})
+	return n, members, delegates
+}
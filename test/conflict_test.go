@@ -0,0 +1,222 @@
+package test
+
+import (
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+type conflictRecorder struct {
+	sync.Mutex
+	resolved []*memberlist.ConflictResolution
+	lost     []*memberlist.Node
+	keep     bool
+	notified int
+}
+
+func (c *conflictRecorder) NotifyConflict(existing, other *memberlist.Node) {
+	c.Lock()
+	defer c.Unlock()
+	c.notified++
+}
+
+func (c *conflictRecorder) getNotified() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.notified
+}
+
+func (c *conflictRecorder) NotifyConflictResolved(r *memberlist.ConflictResolution) {
+	c.Lock()
+	defer c.Unlock()
+	c.resolved = append(c.resolved, r)
+}
+
+func (c *conflictRecorder) NotifyConflictLost(winner *memberlist.Node) bool {
+	c.Lock()
+	defer c.Unlock()
+	c.lost = append(c.lost, winner)
+	return c.keep
+}
+
+func (c *conflictRecorder) getResolved() []*memberlist.ConflictResolution {
+	c.Lock()
+	defer c.Unlock()
+	return append([]*memberlist.ConflictResolution(nil), c.resolved...)
+}
+
+func (c *conflictRecorder) getLost() []*memberlist.Node {
+	c.Lock()
+	defer c.Unlock()
+	return append([]*memberlist.Node(nil), c.lost...)
+}
+
+// impostor 创建一个与已有节点同名、但不加入集群的节点
+func impostor(t *testing.T, n *memberlist.MockNetwork, name string, loser memberlist.ConflictLoserDelegate) *memberlist.Members {
+	c := memberlist.DefaultLANConfig()
+	c.Name = name
+	c.Transport = n.NewTransport("impostor")
+	c.LogOutput = ioutil.Discard
+	c.ResolveConflicts = true
+	c.ConflictVoteTimeout = 200 * time.Millisecond
+	c.ConflictLoser = loser
+	m, err := memberlist.Create(c)
+	require.NoError(t, err)
+	return m
+}
+
+func claim(m *memberlist.Members, n *memberlist.Node) {
+	m.AliveNode(&memberlist.Alive{
+		Incarnation: 1,
+		Node:        n.Name,
+		Addr:        n.Addr,
+		Port:        n.Port,
+		Vsn:         []uint8{1, 5, 2, 0, 0, 0},
+	}, nil, false)
+}
+
+func TestConflict_ImpostorLoses(t *testing.T) {
+	rec := &conflictRecorder{}
+	n, members, _ := newTestCluster(t, 4, func(c *memberlist.Config) {
+		c.ResolveConflicts = true
+		c.ConflictVoteTimeout = 200 * time.Millisecond
+		c.Conflict = rec
+	})
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+	loser := &conflictRecorder{}
+	imp := impostor(t, n, "node2", loser)
+	defer imp.SetShutdown()
+
+	claim(members[0], imp.LocalNode())
+
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		if len(rec.getResolved()) == 0 {
+			failf("conflict not resolved")
+		}
+	})
+	r := rec.getResolved()[0]
+	require.Equal(t, "node2", r.Name)
+	require.Equal(t, members[1].LocalNode().Address(), r.Winner.Address())
+	require.Equal(t, imp.LocalNode().Address(), r.Loser.Address())
+	require.Equal(t, 3, r.WinnerVotes)
+	require.Equal(t, 0, r.LoserVotes)
+
+	// 冒名的节点收到通知后停止
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		if len(loser.getLost()) != 1 {
+			failf("loser not notified")
+		}
+		if atomic.LoadInt32(&imp.Shutdown) != 1 {
+			failf("loser not shut down")
+		}
+	})
+	require.Equal(t, members[1].LocalNode().Address(), loser.getLost()[0].Address())
+
+	// 真正的节点不受影响
+	require.Equal(t, int32(0), atomic.LoadInt32(&members[1].Shutdown))
+	for _, m := range members {
+		require.Equal(t, 4, m.NumMembers())
+	}
+
+	// 冷却期内同一个名字不会重复投票
+	claim(members[0], imp.LocalNode())
+	time.Sleep(300 * time.Millisecond)
+	require.Len(t, rec.getResolved(), 1)
+}
+
+func TestConflict_StaleViewCorrected(t *testing.T) {
+	rec := &conflictRecorder{}
+	n, members, _ := newTestCluster(t, 4, func(c *memberlist.Config) {
+		c.ResolveConflicts = true
+		c.ConflictVoteTimeout = 200 * time.Millisecond
+		c.Conflict = rec
+		c.ProbeInterval = time.Hour
+		c.PushPullInterval = 0
+	})
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+	loser := &conflictRecorder{keep: true}
+	imp := impostor(t, n, "node2", loser)
+	defer imp.SetShutdown()
+
+	// node1 在本地把 node2 指向冒名的地址
+	var before uint32
+	func() {
+		m := members[0]
+		m.NodeLock.Lock()
+		defer m.NodeLock.Unlock()
+		state := m.NodeMap["node2"]
+		state.Addr = imp.LocalNode().Addr
+		state.Port = imp.LocalNode().Port
+		before = state.Incarnation
+	}()
+
+	// 真正的 node2 再次出现时,node1 发现冲突并被多数纠正
+	claim(members[0], members[1].LocalNode())
+
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		if len(rec.getResolved()) == 0 {
+			failf("conflict not resolved")
+		}
+	})
+	r := rec.getResolved()[0]
+	require.Equal(t, members[1].LocalNode().Address(), r.Winner.Address())
+	require.Equal(t, 1, r.LoserVotes)
+
+	// node1 只在本地纠正,由胜出的 node2 自己以更高的incarnation重新广播
+	got := nodeState(members[0], "node2")
+	require.Equal(t, members[1].LocalNode().Address(), got.Address())
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		for _, m := range members {
+			if s := nodeState(m, "node2"); s.Incarnation <= before {
+				failf("%s did not learn node2's announcement", m.Config.Name)
+			}
+		}
+	})
+	got = nodeState(members[0], "node2")
+	require.Equal(t, members[1].LocalNode().Address(), got.Address())
+
+	// ConflictLoser 接管时不会停止
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		if len(loser.getLost()) != 1 {
+			failf("loser not notified")
+		}
+	})
+	require.Equal(t, int32(0), atomic.LoadInt32(&imp.Shutdown))
+}
+
+func TestConflict_UnsolicitedVoteLost(t *testing.T) {
+	for _, resolve := range []bool{false, true} {
+		loser := &conflictRecorder{}
+		n, members, _ := newTestCluster(t, 2, func(c *memberlist.Config) {
+			c.ResolveConflicts = resolve
+			c.ConflictVoteTimeout = 100 * time.Millisecond
+			c.ConflictLoser = loser
+		})
+
+		// 冒名的节点伪造一个node2落败的通知,node1 从未为 node2 投票
+		imp := impostor(t, n, "node2", nil)
+		lost := memberlist.VoteLost{Node: "node2", Addr: imp.LocalNode().Addr, Port: imp.LocalNode().Port}
+		buf, err := memberlist.Encode(memberlist.VoteLostMsg, &lost)
+		require.NoError(t, err)
+		_, err = n.TransportsByName["impostor"].WriteTo(buf.Bytes(), members[1].LocalNode().Address())
+		require.NoError(t, err)
+
+		time.Sleep(300 * time.Millisecond)
+		require.Empty(t, loser.getLost(), "resolve=%v", resolve)
+		require.Equal(t, int32(0), atomic.LoadInt32(&members[1].Shutdown), "resolve=%v", resolve)
+
+		imp.SetShutdown()
+		for _, m := range members {
+			m.SetShutdown()
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelivery_BroadcastAck(t *testing.T) {
+	_, members, delegates := newTestCluster(t, 3, nil)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	d, err := members[0].BroadcastTracked([]byte("hello"), memberlist.DeliveryAck)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, d.Wait(ctx, memberlist.DeliveryAllAlive))
+	require.Equal(t, []string{"node2", "node3"}, d.AckedBy())
+	require.Equal(t, d.AckedBy(), d.Seen())
+
+	for _, dl := range delegates[1:] {
+		retry(t, 50, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+			for _, msg := range dl.getMessages() {
+				if string(msg) == "hello" {
+					return
+				}
+			}
+			failf("message not delivered")
+		})
+	}
+}
+
+func TestDelivery_UpdateNodeSent(t *testing.T) {
+	_, members, _ := newTestCluster(t, 3, nil)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	d := members[0].UpdateNodeTracked(memberlist.DeliverySent)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, d.Wait(ctx, 2))
+
+	sent := d.SentTo()
+	require.True(t, sent["node2"] > 0 && sent["node3"] > 0, "%v", sent)
+	require.Empty(t, d.AckedBy())
+}
+
+func TestDelivery_LeaveAck(t *testing.T) {
+	_, members, _ := newTestCluster(t, 2, nil)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	d, err := members[1].LeaveTracked(memberlist.DeliveryAck)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, d.Wait(ctx, 1))
+	require.Equal(t, []string{"node1"}, d.AckedBy())
+
+	_, err = members[1].LeaveTracked(memberlist.DeliveryAck)
+	require.Error(t, err)
+}
+
+func TestDelivery_Unreachable(t *testing.T) {
+	n, members, _ := newTestCluster(t, 2, func(c *memberlist.Config) {
+		c.DeliveryAckTimeout = 50 * time.Millisecond
+	})
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+	n.Block("node1", "node2")
+
+	d, err := members[0].BroadcastTracked([]byte("lost"), memberlist.DeliveryAck)
+	require.NoError(t, err)
+
+	// 重传次数用完后不会再有确认
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = d.Wait(ctx, memberlist.DeliveryAllAlive)
+	require.Error(t, err)
+	require.NotEqual(t, context.DeadlineExceeded, err)
+	require.True(t, d.Finished())
+	require.True(t, d.SentTo()["node2"] > 0)
+	require.Empty(t, d.AckedBy())
+}
+
+// packetParts 拆开CRC头和复合消息,返回其中的每条消息
+func packetParts(buf []byte) [][]byte {
+	if len(buf) >= 5 && memberlist.MessageType(buf[0]) == memberlist.HasCrcMsg {
+		buf = buf[5:]
+	}
+	if len(buf) == 0 || memberlist.MessageType(buf[0]) != memberlist.CompoundMsg {
+		return [][]byte{buf}
+	}
+	_, parts, err := memberlist.DecodeCompoundMessage(buf[1:])
+	if err != nil {
+		return nil
+	}
+	var out [][]byte
+	for _, p := range parts {
+		out = append(out, packetParts(p)...)
+	}
+	return out
+}
+
+func TestDelivery_OldPeer(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m := newTestNode(t, n, "node1", func(c *memberlist.Config) {
+		c.GossipInterval = 10 * time.Millisecond
+		c.EnableCompression = false
+	})
+	defer m.SetShutdown()
+
+	// 协议版本最高为5的老节点不认识 TrackedMsg
+	old := n.NewTransport("old")
+	ip, port, err := old.FinalAdvertiseAddr("", 0)
+	require.NoError(t, err)
+	claim(m, &memberlist.Node{Name: "old", Addr: ip, Port: uint16(port)})
+
+	d := m.UpdateNodeTracked(memberlist.DeliverySent)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, d.Wait(ctx, 1))
+
+	var alive bool
+	for p := recvPacket(old, 100*time.Millisecond); p != nil; p = recvPacket(old, 100*time.Millisecond) {
+		for _, part := range packetParts(p.Buf) {
+			require.NotEqual(t, memberlist.TrackedMsg, memberlist.MessageType(part[0]))
+			if memberlist.MessageType(part[0]) != memberlist.AliveMsg {
+				continue
+			}
+			var a memberlist.Alive
+			require.NoError(t, memberlist.Decode(part[1:], &a))
+			alive = alive || a.Node == "node1"
+		}
+	}
+	require.True(t, alive, "old peer never got node1's alive message")
+	require.True(t, d.SentTo()["old"] > 0)
+}
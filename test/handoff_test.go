@@ -0,0 +1,269 @@
+package test
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+func handoffConfig(depth, userDepth int, policy memberlist.OverflowPolicy) *memberlist.Config {
+	c := memberlist.DefaultLANConfig()
+	c.HandoffQueueDepth = depth
+	c.HandoffUserQueueDepth = userDepth
+	c.HandoffOverflow = policy
+	return c
+}
+
+func handoffMsg(t memberlist.MessageType, b byte) memberlist.HandoffMsg {
+	return memberlist.HandoffMsg{MsgType: t, Buf: []byte{b}}
+}
+
+func TestFairHandoffScheduler_Weights(t *testing.T) {
+	c := handoffConfig(16, 16, memberlist.OverflowDropNewest)
+	c.HandoffMembershipWeight = 2
+	c.HandoffUserWeight = 1
+	s := memberlist.NewFairHandoffScheduler(c)
+
+	for i := 0; i < 4; i++ {
+		require.True(t, s.Push(handoffMsg(memberlist.AliveMsg, byte(i))))
+		require.True(t, s.Push(handoffMsg(memberlist.UserMsg, byte(i))))
+	}
+
+	var order []memberlist.MessageType
+	for {
+		msg, ok := s.Pop()
+		if !ok {
+			break
+		}
+		order = append(order, msg.MsgType)
+	}
+	m, u := memberlist.AliveMsg, memberlist.UserMsg
+	require.Equal(t, []memberlist.MessageType{m, m, u, m, m, u, u, u}, order)
+}
+
+func TestFairHandoffScheduler_FIFO(t *testing.T) {
+	s := memberlist.NewFairHandoffScheduler(handoffConfig(4, 4, memberlist.OverflowDropNewest))
+	require.True(t, s.Push(handoffMsg(memberlist.SuspectMsg, 1)))
+	require.True(t, s.Push(handoffMsg(memberlist.DeadMsg, 2)))
+
+	msg, ok := s.Pop()
+	require.True(t, ok)
+	require.Equal(t, memberlist.SuspectMsg, msg.MsgType)
+	msg, ok = s.Pop()
+	require.True(t, ok)
+	require.Equal(t, memberlist.DeadMsg, msg.MsgType)
+	_, ok = s.Pop()
+	require.False(t, ok)
+}
+
+func TestFairHandoffScheduler_AliveFirst(t *testing.T) {
+	s := memberlist.NewFairHandoffScheduler(handoffConfig(3, 4, memberlist.OverflowDropOldest))
+	require.True(t, s.Push(handoffMsg(memberlist.AliveMsg, 1)))
+	require.True(t, s.Push(handoffMsg(memberlist.SuspectMsg, 2)))
+	require.True(t, s.Push(handoffMsg(memberlist.DeadMsg, 3)))
+
+	// 队列满时先丢弃怀疑消息而不是反驳
+	require.True(t, s.Push(handoffMsg(memberlist.AliveMsg, 4)))
+	require.Equal(t, 3, s.Stats().MembershipDepth)
+
+	var bufs []byte
+	for {
+		msg, ok := s.Pop()
+		if !ok {
+			break
+		}
+		bufs = append(bufs, msg.Buf[0])
+	}
+	require.Equal(t, []byte{1, 4, 3}, bufs)
+}
+
+func TestFairHandoffScheduler_DropNewest(t *testing.T) {
+	s := memberlist.NewFairHandoffScheduler(handoffConfig(2, 1, memberlist.OverflowDropNewest))
+	require.True(t, s.Push(handoffMsg(memberlist.AliveMsg, 1)))
+	require.True(t, s.Push(handoffMsg(memberlist.AliveMsg, 2)))
+	require.False(t, s.Push(handoffMsg(memberlist.AliveMsg, 3)))
+	require.True(t, s.Push(handoffMsg(memberlist.UserMsg, 1)))
+	require.False(t, s.Push(handoffMsg(memberlist.UserMsg, 2)))
+
+	require.Equal(t, memberlist.HandoffStats{
+		MembershipDepth:   2,
+		UserDepth:         1,
+		MembershipDropped: 1,
+		UserDropped:       1,
+	}, s.Stats())
+
+	msg, _ := s.Pop()
+	require.Equal(t, []byte{1}, msg.Buf)
+}
+
+func TestFairHandoffScheduler_DropOldest(t *testing.T) {
+	s := memberlist.NewFairHandoffScheduler(handoffConfig(2, 2, memberlist.OverflowDropOldest))
+	for i := 1; i <= 3; i++ {
+		require.True(t, s.Push(handoffMsg(memberlist.AliveMsg, byte(i))))
+	}
+
+	var bufs []byte
+	for {
+		msg, ok := s.Pop()
+		if !ok {
+			break
+		}
+		bufs = append(bufs, msg.Buf[0])
+	}
+	require.Equal(t, []byte{2, 3}, bufs)
+	require.Equal(t, uint64(1), s.Stats().MembershipDropped)
+}
+
+func TestFairHandoffScheduler_DropUserFirst(t *testing.T) {
+	s := memberlist.NewFairHandoffScheduler(handoffConfig(1, 2, memberlist.OverflowDropUserFirst))
+	require.True(t, s.Push(handoffMsg(memberlist.UserMsg, 1)))
+	require.True(t, s.Push(handoffMsg(memberlist.UserMsg, 2)))
+	require.False(t, s.Push(handoffMsg(memberlist.UserMsg, 3)))
+
+	// 成员消息总能入队,但不会超过自己的深度,也不会挤掉用户消息
+	require.True(t, s.Push(handoffMsg(memberlist.AliveMsg, 1)))
+	require.True(t, s.Push(handoffMsg(memberlist.DeadMsg, 2)))
+	require.True(t, s.Push(handoffMsg(memberlist.SuspectMsg, 3)))
+	require.Equal(t, memberlist.HandoffStats{
+		MembershipDepth:   1,
+		UserDepth:         2,
+		MembershipDropped: 2,
+		UserDropped:       1,
+	}, s.Stats())
+
+	var bufs []byte
+	for {
+		msg, ok := s.Pop()
+		if !ok {
+			break
+		}
+		if memberlist.ClassOf(msg.MsgType) == memberlist.HandoffMembership {
+			bufs = append(bufs, msg.Buf[0])
+		}
+	}
+	require.Equal(t, []byte{3}, bufs)
+}
+
+func TestHandleCommand_HandoffOverflow(t *testing.T) {
+	c := handoffConfig(1, 1, memberlist.OverflowDropNewest)
+	sched := memberlist.NewFairHandoffScheduler(c)
+	m := GetMemberlist(t, func(c *memberlist.Config) {
+		c.Handoff = sched
+	})
+	require.Equal(t, memberlist.HandoffScheduler(sched), m.HandoffQueue)
+
+	// 关闭后PacketHandler不再消费,消息留在队列里
+	m.SetShutdown()
+	time.Sleep(10 * time.Millisecond)
+
+	buf := append([]byte{byte(memberlist.UserMsg)}, "hi"...)
+	for i := 0; i < 3; i++ {
+		m.HandleCommand(buf, nil, time.Now())
+	}
+	stats := m.HandoffStats()
+	require.Equal(t, 1, stats.UserDepth)
+	require.Equal(t, uint64(2), stats.UserDropped)
+}
+
+// blockingDelegate 的NotifyMsg阻塞到release被关闭
+type blockingDelegate struct {
+	MockDelegate
+	release chan struct{}
+	mu      sync.Mutex
+	got     []string
+}
+
+func (d *blockingDelegate) NotifyMsg(msg []byte) {
+	<-d.release
+	d.mu.Lock()
+	d.got = append(d.got, string(msg))
+	d.mu.Unlock()
+}
+
+func (d *blockingDelegate) received() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.got...)
+}
+
+func TestPacketHandler_SlowDelegate(t *testing.T) {
+	d := &blockingDelegate{release: make(chan struct{})}
+	m := GetMemberlist(t, func(c *memberlist.Config) {
+		c.Delegate = d
+		c.UserMsgWorkers = 1
+		c.UserMsgWorkerQueue = 1
+		c.UserMsgDispatchTimeout = 100 * time.Millisecond
+	})
+	defer m.SetShutdown()
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	for i := 0; i < 5; i++ {
+		m.HandleCommand(append([]byte{byte(memberlist.UserMsg)}, "hi"...), from, time.Now())
+	}
+
+	// NotifyMsg 阻塞时,成员消息仍然被及时处理
+	a := memberlist.Alive{
+		Node:        "other",
+		Addr:        net.IPv4(127, 0, 0, 2),
+		Port:        7946,
+		Incarnation: 1,
+		Vsn:         m.Config.BuildVsnArray(),
+	}
+	buf, err := memberlist.Encode(memberlist.AliveMsg, &a)
+	require.NoError(t, err)
+	m.HandleCommand(buf.Bytes(), from, time.Now())
+
+	retry(t, 20, 50*time.Millisecond, func(failf func(string, ...interface{})) {
+		for _, n := range m.Members() {
+			if n.Name == "other" {
+				return
+			}
+		}
+		failf("alive message was not processed")
+	})
+
+	// 一条在处理中,一条在worker队列里,其余超时丢弃
+	retry(t, 20, 50*time.Millisecond, func(failf func(string, ...interface{})) {
+		if dropped := m.HandoffStats().DispatchDropped; dropped != 3 {
+			failf("expected 3 dropped, got %d", dropped)
+		}
+	})
+	close(d.release)
+	retry(t, 20, 50*time.Millisecond, func(failf func(string, ...interface{})) {
+		if got := len(d.received()); got != 2 {
+			failf("expected 2 messages, got %d", got)
+		}
+	})
+}
+
+func TestPacketHandler_ShardBySender(t *testing.T) {
+	d := &blockingDelegate{release: make(chan struct{})}
+	close(d.release)
+	m := GetMemberlist(t, func(c *memberlist.Config) {
+		c.Delegate = d
+		c.UserMsgWorkers = 4
+		c.UserMsgWorkerQueue = 128
+		c.UserMsgShardBySender = true
+	})
+	defer m.SetShutdown()
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	var want []string
+	for i := 0; i < 50; i++ {
+		msg := strconv.Itoa(i)
+		want = append(want, msg)
+		m.HandleCommand(append([]byte{byte(memberlist.UserMsg)}, msg...), from, time.Now())
+	}
+
+	retry(t, 20, 50*time.Millisecond, func(failf func(string, ...interface{})) {
+		if got := d.received(); len(got) != len(want) {
+			failf("expected %d messages, got %d", len(want), len(got))
+		}
+	})
+	require.Equal(t, want, d.received())
+}
@@ -0,0 +1,195 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+type healthRecorder struct {
+	lock   sync.Mutex
+	events [][2]int
+}
+
+func (h *healthRecorder) NotifyHealth(old, new int) {
+	h.lock.Lock()
+	h.events = append(h.events, [2]int{old, new})
+	h.lock.Unlock()
+}
+
+func (h *healthRecorder) get() [][2]int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([][2]int(nil), h.events...)
+}
+
+func TestHealthCheck_Awareness(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	rec := &healthRecorder{}
+	m := newTestNode(t, n, "node1", func(c *memberlist.Config) {
+		c.Health = rec
+	})
+	defer m.SetShutdown()
+
+	var failing int32 = 1
+	deregister, err := m.RegisterHealthCheck(memberlist.HealthCheck{
+		Name:     "disk",
+		Interval: 10 * time.Millisecond,
+		Penalty:  2,
+		Check: func(ctx context.Context) error {
+			if atomic.LoadInt32(&failing) == 1 {
+				return errors.New("disk full")
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	// 只在变为失败时增加一次分数,连续失败不再增加
+	retry(t, 50, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if s := m.HealthChecks()[0]; s.Failures < 4 {
+			failf("failures %d", s.Failures)
+		}
+	})
+	require.Equal(t, 2, m.GetHealthScore())
+	st := m.HealthChecks()
+	require.Len(t, st, 1)
+	require.True(t, st[0].Failing)
+	require.EqualError(t, st[0].Err, "disk full")
+	require.Equal(t, [][2]int{{0, 2}}, rec.get())
+
+	_, err = m.RegisterHealthCheck(memberlist.HealthCheck{Name: "disk", Check: func(context.Context) error { return nil }})
+	require.Error(t, err)
+
+	// 恢复时分数全部还回去
+	atomic.StoreInt32(&failing, 0)
+	retry(t, 50, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if s := m.HealthChecks()[0]; s.Failing {
+			failf("still failing")
+		}
+	})
+	require.Equal(t, 0, m.GetHealthScore())
+	require.Equal(t, [][2]int{{0, 2}, {2, 0}}, rec.get())
+
+	deregister()
+	require.Empty(t, m.HealthChecks())
+}
+
+func TestHealthCheck_ProbesKeepPenalty(t *testing.T) {
+	_, members, _ := newTestCluster(t, 2, func(c *memberlist.Config) {
+		c.ProbeInterval = 10 * time.Millisecond
+		c.ProbeTimeout = 5 * time.Millisecond
+	})
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+	m := members[0]
+
+	var failing int32 = 1
+	_, err := m.RegisterHealthCheck(memberlist.HealthCheck{
+		Name:     "disk",
+		Interval: 10 * time.Millisecond,
+		Penalty:  2,
+		Check: func(ctx context.Context) error {
+			if atomic.LoadInt32(&failing) == 1 {
+				return errors.New("disk full")
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	m.Awareness.ApplyDelta(1)
+
+	// 成功的探测只会抵消探测分数,惩罚一直保留到检查恢复
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		if score := m.GetHealthScore(); score != 2 {
+			failf("score %d", score)
+		}
+	})
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 2, m.GetHealthScore())
+
+	atomic.StoreInt32(&failing, 0)
+	retry(t, 50, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if score := m.GetHealthScore(); score != 0 {
+			failf("score %d", score)
+		}
+	})
+}
+
+func TestHealthCheck_Timeout(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m := newTestNode(t, n, "node1", nil)
+	defer m.SetShutdown()
+
+	block := make(chan struct{})
+	defer close(block)
+	deregister, err := m.RegisterHealthCheck(memberlist.HealthCheck{
+		Name:     "cpu",
+		Interval: time.Hour,
+		Timeout:  10 * time.Millisecond,
+		Check: func(ctx context.Context) error {
+			<-block
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	retry(t, 50, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if m.GetHealthScore() != 1 {
+			failf("score %d", m.GetHealthScore())
+		}
+	})
+	require.True(t, m.HealthChecks()[0].Failing)
+
+	// 注销失败中的检查会还回分数
+	deregister()
+	require.Equal(t, 0, m.GetHealthScore())
+}
+
+func TestHealthCheck_Advertise(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	conf := func(c *memberlist.Config) {
+		c.HealthAdvertise = true
+		c.HealthAdvertiseInterval = 10 * time.Millisecond
+	}
+	m1 := newTestNode(t, n, "node1", conf)
+	defer m1.SetShutdown()
+	m2 := newTestNode(t, n, "node2", conf)
+	defer m2.SetShutdown()
+	_, err := m2.Join([]string{seedOf(n, "node1")})
+	require.NoError(t, err)
+
+	node1 := func() *memberlist.Node {
+		s := nodeState(m2, "node1")
+		return &s.Node
+	}
+	score, ok := node1().HealthScore()
+	require.True(t, ok)
+	require.Equal(t, 0, score)
+
+	_, err = m1.RegisterHealthCheck(memberlist.HealthCheck{
+		Name:     "disk",
+		Interval: time.Hour,
+		Penalty:  3,
+		Check:    func(context.Context) error { return errors.New("disk full") },
+	})
+	require.NoError(t, err)
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		if score, _ := node1().HealthScore(); score != 3 {
+			failf("score %d", score)
+		}
+	})
+
+	app, score, ok := memberlist.SplitHealthMeta(append([]byte("app"), node1().Meta...))
+	require.True(t, ok)
+	require.Equal(t, 3, score)
+	require.Equal(t, []byte("app"), app)
+	_, _, ok = memberlist.SplitHealthMeta([]byte("app"))
+	require.False(t, ok)
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoinWithReport_PerSeed(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := newTestNode(t, n, "node1", nil)
+	defer m1.SetShutdown()
+	m2 := newTestNode(t, n, "node2", nil)
+	defer m2.SetShutdown()
+	m3 := newTestNode(t, n, "node3", nil)
+	defer m3.SetShutdown()
+
+	n.NewTransport("gone")
+	n.SetLink("node3", "gone", memberlist.MockLink{DialFail: true})
+
+	_, err := m2.Join([]string{seedOf(n, "node1")})
+	require.NoError(t, err)
+	// node1 在回复之后才合并 node2 的状态
+	retry(t, 50, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if m1.NumMembers() != 2 {
+			failf("node1 has %d members", m1.NumMembers())
+		}
+	})
+
+	r := m3.JoinWithReport([]string{seedOf(n, "node1"), seedOf(n, "gone"), "bad/:80"}, nil)
+	require.NoError(t, r.Err())
+	require.Equal(t, 1, r.NumSuccess)
+	require.Len(t, r.Seeds, 3)
+
+	ok := r.Seeds[0]
+	require.NoError(t, ok.ResolveErr)
+	require.Len(t, ok.Addrs, 1)
+	require.NoError(t, ok.Addrs[0].Err)
+	require.ElementsMatch(t, []string{"node1", "node2"}, ok.Addrs[0].Nodes)
+	require.Equal(t, memberlist.MismatchNone, ok.Addrs[0].Mismatch)
+
+	failed := r.Seeds[1]
+	require.Len(t, failed.Addrs, 1)
+	require.Error(t, failed.Addrs[0].Err)
+	require.Equal(t, 0, failed.Succeeded())
+
+	require.Error(t, r.Seeds[2].ResolveErr)
+	require.Empty(t, r.Seeds[2].Addrs)
+	require.ElementsMatch(t, []string{"node1", "node2"}, r.Nodes())
+
+	// 全部失败时 Err 与 Join 的错误一致
+	r = m3.JoinWithReport([]string{seedOf(n, "gone")}, nil)
+	require.Error(t, r.Err())
+	_, err = m3.Join([]string{seedOf(n, "gone")})
+	require.Equal(t, r.Err().Error(), err.Error())
+}
+
+func TestJoinWithReport_Mismatch(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := newTestNode(t, n, "node1", nil)
+	defer m1.SetShutdown()
+
+	cases := []struct {
+		name string
+		conf func(c *memberlist.Config)
+		want memberlist.JoinMismatch
+	}{
+		{"label", func(c *memberlist.Config) { c.Label = "other" }, memberlist.MismatchLabel},
+		{"encryption", func(c *memberlist.Config) {
+			c.SecretKey = []byte("0123456789abcdef")
+		}, memberlist.MismatchEncryption},
+		{"protocol", func(c *memberlist.Config) {
+			c.DelegateProtocolMin, c.DelegateProtocolMax, c.DelegateProtocolVersion = 3, 3, 3
+		}, memberlist.MismatchProtocol},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestNode(t, n, "joiner-"+tc.name, tc.conf)
+			defer m.SetShutdown()
+
+			r := m.JoinWithReport([]string{seedOf(n, "node1")}, nil)
+			require.Error(t, r.Err())
+			require.Len(t, r.Seeds[0].Addrs, 1)
+			require.Equal(t, tc.want, r.Seeds[0].Addrs[0].Mismatch, "%v", r.Seeds[0].Addrs[0].Err)
+			// 失败的地址不记录对方的节点
+			require.Empty(t, r.Seeds[0].Addrs[0].Nodes)
+			require.Empty(t, r.Nodes())
+		})
+	}
+}
+
+func TestJoinWithReport_ClosedIsNotMismatch(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m := newTestNode(t, n, "joiner", func(c *memberlist.Config) {
+		c.TCPTimeout = time.Second
+	})
+	defer m.SetShutdown()
+
+	// 不说明原因就关闭连接的对方不能被当作标签不一致
+	closer := n.NewTransport("closer")
+	go func() {
+		for conn := range closer.StreamCh {
+			conn.Close()
+		}
+	}()
+	r := m.JoinWithReport([]string{seedOf(n, "closer")}, nil)
+	require.Error(t, r.Err())
+	require.Len(t, r.Seeds[0].Addrs, 1)
+	require.Equal(t, memberlist.MismatchNone, r.Seeds[0].Addrs[0].Mismatch, "%v", r.Seeds[0].Addrs[0].Err)
+}
+
+func TestJoinWithReport_Concurrent(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := newTestNode(t, n, "node1", nil)
+	defer m1.SetShutdown()
+	m2 := newTestNode(t, n, "node2", func(c *memberlist.Config) {
+		c.TCPTimeout = 100 * time.Millisecond
+	})
+	defer m2.SetShutdown()
+
+	seeds := []string{seedOf(n, "node1")}
+	for _, name := range []string{"down1", "down2", "down3", "down4"} {
+		n.NewTransport(name)
+		n.SetLink("node2", name, memberlist.MockLink{Blocked: true})
+		seeds = append(seeds, seedOf(n, name))
+	}
+
+	r := m2.JoinWithReport(seeds, &memberlist.JoinOptions{Concurrency: 8})
+	require.NoError(t, r.Err())
+	require.Equal(t, 1, r.NumSuccess)
+	// 顺序进行至少需要 4 * TCPTimeout
+	require.True(t, r.Duration < 300*time.Millisecond, "took %s", r.Duration)
+	for _, s := range r.Seeds[1:] {
+		require.True(t, s.Duration >= 100*time.Millisecond)
+	}
+}
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoinWithRetry_Quorum(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := newTestNode(t, n, "node1", nil)
+	defer m1.SetShutdown()
+	m2 := newTestNode(t, n, "node2", nil)
+	defer m2.SetShutdown()
+	m3 := newTestNode(t, n, "node3", nil)
+	defer m3.SetShutdown()
+
+	// node2 一开始连不上
+	n.SetLink("node3", "node2", memberlist.MockLink{DialFail: true})
+
+	var attempts []int
+	var contacted []int
+	p, err := m3.JoinWithRetry(context.Background(), []string{seedOf(n, "node1"), seedOf(n, "node2")}, &memberlist.JoinRetryOptions{
+		MinContacted:   2,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     40 * time.Millisecond,
+		Progress: func(p *memberlist.JoinProgress) {
+			attempts = append(attempts, p.Attempt)
+			contacted = append(contacted, len(p.Contacted))
+			if p.NextRetry > 0 {
+				require.True(t, p.NextRetry >= 10*time.Millisecond && p.NextRetry <= 40*time.Millisecond)
+			}
+			if p.Attempt == 2 {
+				n.SetLink("node3", "node2", memberlist.MockLink{})
+			}
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, attempts)
+	require.Equal(t, []int{1, 1, 2}, contacted)
+	require.ElementsMatch(t, []string{"node1", "node2"}, p.Contacted)
+
+	// 第三轮只重试 node2
+	require.Len(t, p.Report.Seeds, 1)
+	require.Equal(t, seedOf(n, "node2"), p.Report.Seeds[0].Seed)
+	require.Equal(t, 3, m3.NumMembers())
+}
+
+func TestJoinWithRetry_Deadline(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := newTestNode(t, n, "node1", nil)
+	defer m1.SetShutdown()
+	n.NewTransport("gone")
+	n.SetLink("node1", "gone", memberlist.MockLink{DialFail: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	p, err := m1.JoinWithRetry(ctx, []string{seedOf(n, "gone")}, &memberlist.JoinRetryOptions{
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	})
+	require.Error(t, err)
+	require.True(t, p.Attempt > 1)
+	require.Empty(t, p.Contacted)
+	require.True(t, time.Since(start) < 2*time.Second)
+
+	// 所有种子都联系过但节点数不够时继续尝试全部种子,直到ctx结束
+	m2 := newTestNode(t, n, "node2", nil)
+	defer m2.SetShutdown()
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+	p, err = m1.JoinWithRetry(ctx2, []string{seedOf(n, "node2"), n.TransportsByName["node2"].Addr.String()}, &memberlist.JoinRetryOptions{
+		MinContacted:   2,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	})
+	require.Error(t, err)
+	require.True(t, p.Attempt > 1)
+	require.Len(t, p.Report.Seeds, 2)
+	// 两个种子是同一个节点,只算一个
+	require.Equal(t, []string{"node2"}, p.Contacted)
+}
+
+func TestJoinWithRetry_SkipsSelf(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := newTestNode(t, n, "node1", nil)
+	defer m1.SetShutdown()
+	m2 := newTestNode(t, n, "node2", nil)
+	defer m2.SetShutdown()
+
+	// 种子列表里有本节点自己,按名字或者地址都不算
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	p, err := m1.JoinWithRetry(ctx, []string{seedOf(n, "node1"), n.TransportsByName["node1"].Addr.String(), seedOf(n, "node2")}, &memberlist.JoinRetryOptions{
+		MinContacted:   2,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	})
+	require.Error(t, err)
+	require.Equal(t, []string{"node2"}, p.Contacted)
+}
+
+func TestJoinWithRetry_Context(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := newTestNode(t, n, "node1", func(c *memberlist.Config) {
+		c.TCPTimeout = 10 * time.Second
+	})
+	defer m1.SetShutdown()
+
+	// 已经结束的ctx不会开始新的一轮
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p, err := m1.JoinWithRetry(ctx, []string{seedOf(n, "node1")}, nil)
+	require.Error(t, err)
+	require.Equal(t, 0, p.Attempt)
+
+	// 对方接受连接但不回应时,不会等满 TCPTimeout
+	silent := n.NewTransport("silent")
+	go func() {
+		for range silent.StreamCh {
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	p, err = m1.JoinWithRetry(ctx, []string{seedOf(n, "silent")}, nil)
+	require.Error(t, err)
+	require.Equal(t, 1, p.Attempt)
+	require.True(t, time.Since(start) < 2*time.Second, "took %s", time.Since(start))
+}
@@ -501,7 +501,7 @@ func (h dnsHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 
 	name := "join.service.consul."
 	question := r.Question[0]
-	if question.Name != name || question.Qtype != dns.TypeANY {
+	if question.Name != name || (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA) {
 		h.t.Fatalf("bad: %#v", question)
 	}
 
@@ -509,20 +509,23 @@ func (h dnsHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	m.SetReply(r)
 	m.Authoritative = true
 	m.RecursionAvailable = false
-	m.Answer = append(m.Answer, &dns.A{
-		Hdr: dns.RR_Header{
-			Name:   name,
-			Rrtype: dns.TypeA,
-			Class:  dns.ClassINET},
-		A: net.ParseIP("127.0.0.1"),
-	})
-	m.Answer = append(m.Answer, &dns.AAAA{
-		Hdr: dns.RR_Header{
-			Name:   name,
-			Rrtype: dns.TypeAAAA,
-			Class:  dns.ClassINET},
-		AAAA: net.ParseIP("2001:db8:a0b:12f0::1"),
-	})
+	if question.Qtype == dns.TypeA {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET},
+			A: net.ParseIP("127.0.0.1"),
+		})
+	} else {
+		m.Answer = append(m.Answer, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET},
+			AAAA: net.ParseIP("2001:db8:a0b:12f0::1"),
+		})
+	}
 	if err := w.WriteMsg(m); err != nil {
 		h.t.Fatalf("err: %v", err)
 	}
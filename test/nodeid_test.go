@@ -0,0 +1,165 @@
+package test
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+func idCluster(t *testing.T, num int) (*memberlist.MockNetwork, []*memberlist.Members, *conflictRecorder) {
+	rec := &conflictRecorder{}
+	n, members, _ := newTestCluster(t, num, func(c *memberlist.Config) {
+		id, err := memberlist.GenerateNodeID()
+		require.NoError(t, err)
+		c.NodeID = id
+		c.Conflict = rec
+		c.ProbeInterval = time.Hour
+	})
+	return n, members, rec
+}
+
+func nodeState(m *memberlist.Members, name string) memberlist.NodeState {
+	m.NodeLock.RLock()
+	defer m.NodeLock.RUnlock()
+	return *m.NodeMap[name]
+}
+
+func TestNodeID_Validate(t *testing.T) {
+	c := memberlist.DefaultLANConfig()
+	c.Name = "node1"
+	c.Transport = (&memberlist.MockNetwork{}).NewTransport("node1")
+	c.LogOutput = ioutil.Discard
+	c.NodeID = []byte("short")
+	_, err := memberlist.Create(c)
+	require.Error(t, err)
+}
+
+func TestNodeID_Gossiped(t *testing.T) {
+	_, members, _ := idCluster(t, 3)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+	for _, m := range members {
+		for _, other := range members {
+			require.Equal(t, other.Config.NodeID, nodeState(m, other.Config.Name).ID)
+		}
+	}
+}
+
+func TestNodeID_ReplaceDeadNode(t *testing.T) {
+	n, members, rec := idCluster(t, 2)
+	defer members[0].SetShutdown()
+
+	// node2 宕机并被宣布死亡
+	old := nodeState(members[0], "node2")
+	members[1].SetShutdown()
+	members[0].DeadNode(&memberlist.Dead{Incarnation: old.Incarnation, Node: "node2", From: "node1", ID: old.ID})
+	require.Equal(t, memberlist.StateDead, nodeState(members[0], "node2").State)
+
+	// 另一台机器以同样的名字加入,不需要等待 DeadNodeReclaimTime
+	id, err := memberlist.GenerateNodeID()
+	require.NoError(t, err)
+	c := memberlist.DefaultLANConfig()
+	c.Name = "node2"
+	c.Transport = n.NewTransport("replacement")
+	c.LogOutput = ioutil.Discard
+	c.NodeID = id
+	m, err := memberlist.Create(c)
+	require.NoError(t, err)
+	defer m.SetShutdown()
+	_, err = m.Join([]string{members[0].LocalNode().Address()})
+	require.NoError(t, err)
+
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		s := nodeState(members[0], "node2")
+		if s.State != memberlist.StateAlive || s.Node.Address() != m.LocalNode().Address() {
+			failf("replacement not accepted: %v %s", s.State, s.Node.Address())
+		}
+	})
+	require.Equal(t, id, nodeState(members[0], "node2").ID)
+	require.Zero(t, rec.getNotified())
+
+	// 旧ID的死亡消息不影响新的节点
+	members[0].DeadNode(&memberlist.Dead{Incarnation: 1 << 20, Node: "node2", From: "node1", ID: old.ID})
+	require.Equal(t, memberlist.StateAlive, nodeState(members[0], "node2").State)
+}
+
+func TestNodeID_ReincarnationNewAddress(t *testing.T) {
+	_, members, rec := idCluster(t, 2)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	s := nodeState(members[0], "node2")
+	moved := &memberlist.Alive{
+		Incarnation: s.Incarnation,
+		Node:        "node2",
+		Addr:        []byte{127, 0, 0, 9},
+		Port:        s.Port,
+		Vsn:         []uint8{1, 5, 2, 0, 0, 0},
+		ID:          s.ID,
+	}
+
+	// 重启后incarnation没有变大也接受新的地址,并以更高的incarnation广播,不算冲突
+	members[0].AliveNode(moved, nil, false)
+	got := nodeState(members[0], "node2")
+	require.Equal(t, "127.0.0.9", got.Addr.String())
+	require.Equal(t, s.Incarnation+1, got.Incarnation)
+	require.Zero(t, rec.getNotified())
+
+	// 旧地址上迟到的消息不会把地址改回去
+	members[0].AliveNode(&memberlist.Alive{
+		Incarnation: s.Incarnation,
+		Node:        "node2",
+		Addr:        s.Addr,
+		Port:        s.Port,
+		Vsn:         []uint8{1, 5, 2, 0, 0, 0},
+		ID:          s.ID,
+	}, nil, false)
+	require.Equal(t, "127.0.0.9", nodeState(members[0], "node2").Addr.String())
+	moved.Incarnation = got.Incarnation
+
+	// 同名但ID不同、旧节点仍然存活,仍是冲突
+	id, err := memberlist.GenerateNodeID()
+	require.NoError(t, err)
+	members[0].AliveNode(&memberlist.Alive{
+		Incarnation: moved.Incarnation + 1,
+		Node:        "node2",
+		Addr:        []byte{127, 0, 0, 10},
+		Port:        s.Port,
+		Vsn:         []uint8{1, 5, 2, 0, 0, 0},
+		ID:          id,
+	}, nil, false)
+	require.Equal(t, "127.0.0.9", nodeState(members[0], "node2").Addr.String())
+	require.Equal(t, 1, rec.getNotified())
+}
+
+func TestNodeID_RestartDeadNode(t *testing.T) {
+	_, members, rec := idCluster(t, 2)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+	require.Zero(t, members[0].Config.DeadNodeReclaimTime)
+
+	// node2 被宣布死亡后以同样的ID、新的地址、更低的incarnation重启
+	s := nodeState(members[0], "node2")
+	members[0].DeadNode(&memberlist.Dead{Incarnation: s.Incarnation + 5, Node: "node2", From: "node1", ID: s.ID})
+	require.Equal(t, memberlist.StateDead, nodeState(members[0], "node2").State)
+
+	members[0].AliveNode(&memberlist.Alive{
+		Incarnation: 1,
+		Node:        "node2",
+		Addr:        []byte{127, 0, 0, 9},
+		Port:        s.Port,
+		Vsn:         []uint8{1, 5, 2, 0, 0, 0},
+		ID:          s.ID,
+	}, nil, false)
+	got := nodeState(members[0], "node2")
+	require.Equal(t, memberlist.StateAlive, got.State)
+	require.Equal(t, "127.0.0.9", got.Addr.String())
+	require.Equal(t, s.Incarnation+6, got.Incarnation)
+	require.Zero(t, rec.getNotified())
+}
@@ -0,0 +1,123 @@
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+type partitionEvents struct {
+	sync.Mutex
+	events []memberlist.PartitionEvent
+}
+
+func (p *partitionEvents) NotifyPartition(e memberlist.PartitionEvent) {
+	p.Lock()
+	defer p.Unlock()
+	p.events = append(p.events, e)
+}
+
+func (p *partitionEvents) get() []memberlist.PartitionEvent {
+	p.Lock()
+	defer p.Unlock()
+	return append([]memberlist.PartitionEvent(nil), p.events...)
+}
+
+func partitionCluster(t *testing.T) ([]*memberlist.Members, []*partitionEvents) {
+	var events []*partitionEvents
+	_, members, _ := newTestCluster(t, 5, func(c *memberlist.Config) {
+		e := &partitionEvents{}
+		events = append(events, e)
+		c.Partition = e
+		c.PartitionThreshold = 0.3
+		c.PartitionWindow = time.Second
+		c.PartitionRejoinInterval = 50 * time.Millisecond
+		c.ProbeInterval = time.Hour
+		c.PushPullInterval = 0
+		c.ReconnectInterval = 0
+		c.GossipToTheDeadTime = time.Nanosecond
+		c.DeadNodeRetention = time.Hour
+	})
+	return members, events
+}
+
+func TestPartition_DetectAndRejoin(t *testing.T) {
+	members, events := partitionCluster(t)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	// node1-3 与 node4-5 互相认为对方已经失败
+	sides := [][]int{{0, 1, 2}, {3, 4}}
+	for i, side := range sides {
+		for _, a := range side {
+			for _, b := range sides[1-i] {
+				name := members[b].Config.Name
+				inc := nodeState(members[a], name).Incarnation
+				members[a].DeadNode(&memberlist.Dead{Node: name, Incarnation: inc, From: members[a].Config.Name})
+			}
+		}
+	}
+	for _, m := range members {
+		require.True(t, m.Partitioned(), m.Config.Name)
+	}
+
+	// node4 和 node5 的种子是 node1,重新加入后分区恢复
+	retry(t, 100, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		for _, m := range members {
+			if got := m.NumMembers(); got != 5 {
+				failf("%s: expected 5 members, got %d", m.Config.Name, got)
+			}
+			if m.Partitioned() {
+				failf("%s still partitioned", m.Config.Name)
+			}
+		}
+	})
+
+	retry(t, 50, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		if len(events[3].get()) != 2 {
+			failf("expected 2 events, got %v", events[3].get())
+		}
+	})
+	got := events[3].get()
+	require.True(t, got[0].Partitioned)
+	require.Equal(t, []string{"node1", "node2", "node3"}, got[0].Lost)
+	require.False(t, got[1].Partitioned)
+	require.Empty(t, got[1].Lost)
+	require.Equal(t, []string{"node4", "node5"}, events[0].get()[0].Lost)
+}
+
+func TestPartition_BelowThreshold(t *testing.T) {
+	members, events := partitionCluster(t)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	inc := nodeState(members[0], "node5").Incarnation
+	members[0].DeadNode(&memberlist.Dead{Node: "node5", Incarnation: inc, From: "node1"})
+	require.False(t, members[0].Partitioned())
+	require.Empty(t, events[0].get())
+}
+
+func TestPartition_DisabledByDefault(t *testing.T) {
+	e := &partitionEvents{}
+	_, members, _ := newTestCluster(t, 5, func(c *memberlist.Config) {
+		c.Partition = e
+		c.ProbeInterval = time.Hour
+		c.PushPullInterval = 0
+	})
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	// 默认不检测分区,2/5 的节点失败只是普通的故障
+	for _, name := range []string{"node4", "node5"} {
+		inc := nodeState(members[0], name).Incarnation
+		members[0].DeadNode(&memberlist.Dead{Node: name, Incarnation: inc, From: "node1"})
+	}
+	require.False(t, members[0].Partitioned())
+	require.Empty(t, e.get())
+}
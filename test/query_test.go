@@ -0,0 +1,184 @@
+package test
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+type queryHandler struct {
+	name  string
+	big   bool
+	calls int32
+}
+
+func (h *queryHandler) HandleQuery(origin, name string, payload []byte) []byte {
+	atomic.AddInt32(&h.calls, 1)
+	if h.big {
+		return bytes.Repeat([]byte("x"), 4096)
+	}
+	return []byte(h.name + ":" + string(payload))
+}
+
+func queryCluster(t *testing.T, metas ...string) ([]*memberlist.Members, []*queryHandler) {
+	var handlers []*queryHandler
+	_, members, _ := newTestCluster(t, len(metas), func(c *memberlist.Config) {
+		i := len(handlers)
+		c.Delegate.(*MockDelegate).setMeta([]byte(metas[i]))
+		h := &queryHandler{name: c.Name}
+		c.Queries = h
+		handlers = append(handlers, h)
+	})
+	return members, handlers
+}
+
+// collect 读取查询的确认和响应直到查询结束
+func collect(r *memberlist.QueryResponse) ([]string, map[string]string) {
+	var acks []string
+	resps := make(map[string]string)
+	ackCh, respCh := r.AckCh(), r.ResponseCh()
+	for ackCh != nil || respCh != nil {
+		select {
+		case a, ok := <-ackCh:
+			if !ok {
+				ackCh = nil
+				continue
+			}
+			acks = append(acks, a)
+		case resp, ok := <-respCh:
+			if !ok {
+				respCh = nil
+				continue
+			}
+			resps[resp.From] = string(resp.Payload)
+		}
+	}
+	sort.Strings(acks)
+	return acks, resps
+}
+
+func TestQuery_FilterNodes(t *testing.T) {
+	members, _ := queryCluster(t, "", "", "")
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	r, err := members[0].Query("lag", []byte("?"), &memberlist.QueryParam{
+		FilterNodes: []string{"node2", "node3"},
+		RequestAck:  true,
+		Timeout:     500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	acks, resps := collect(r)
+	require.True(t, r.Finished())
+	require.Equal(t, []string{"node2", "node3"}, acks)
+	require.Equal(t, map[string]string{"node2": "node2:?", "node3": "node3:?"}, resps)
+}
+
+func TestQuery_FilterMeta(t *testing.T) {
+	members, handlers := queryCluster(t, "role=web", "role=db", "role=db")
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	r, err := members[0].Query("lag", []byte("?"), &memberlist.QueryParam{
+		FilterMeta: "^role=db$",
+		Timeout:    500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	acks, resps := collect(r)
+	require.Empty(t, acks)
+	require.Equal(t, map[string]string{"node2": "node2:?", "node3": "node3:?"}, resps)
+
+	// 每个节点只处理一次,不匹配的节点不调用处理函数
+	require.Equal(t, int32(0), atomic.LoadInt32(&handlers[0].calls))
+	require.Equal(t, int32(1), atomic.LoadInt32(&handlers[1].calls))
+	require.Equal(t, int32(1), atomic.LoadInt32(&handlers[2].calls))
+
+	_, err = members[0].Query("lag", nil, &memberlist.QueryParam{FilterMeta: "("})
+	require.Error(t, err)
+}
+
+func TestQuery_ResponseSizeLimit(t *testing.T) {
+	members, handlers := queryCluster(t, "", "")
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+	handlers[1].big = true
+
+	r, err := members[0].Query("dump", nil, &memberlist.QueryParam{
+		RequestAck: true,
+		Timeout:    300 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	acks, resps := collect(r)
+	require.Equal(t, []string{"node1", "node2"}, acks)
+	require.Equal(t, map[string]string{"node1": "node1:"}, resps)
+}
+
+func TestQuery_Close(t *testing.T) {
+	members, _ := queryCluster(t, "")
+	defer members[0].SetShutdown()
+
+	r, err := members[0].Query("x", nil, &memberlist.QueryParam{Timeout: time.Minute})
+	require.NoError(t, err)
+	require.False(t, r.Finished())
+	require.True(t, r.Deadline().After(time.Now()))
+	r.Close()
+	r.Close()
+	require.True(t, r.Finished())
+}
+
+func TestQuery_DropExpired(t *testing.T) {
+	members, handlers := queryCluster(t, "", "")
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	inject := func(id uint32, ttl time.Duration) {
+		q := memberlist.QueryReq{ID: id, Origin: "node1", Name: "x", Timeout: time.Minute, TTL: ttl}
+		buf, err := memberlist.Encode(memberlist.QueryMsg, &q)
+		require.NoError(t, err)
+		members[1].HandleCommand(buf.Bytes(), nil, time.Now())
+	}
+
+	// 传播途中已经用完了有效期
+	inject(1000, -1)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&handlers[1].calls))
+
+	inject(1001, time.Minute)
+	retry(t, 50, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if atomic.LoadInt32(&handlers[1].calls) != 1 {
+			failf("not answered")
+		}
+	})
+}
+
+func TestQuery_ForwardRemainingTTL(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m := newTestNode(t, n, "node1", nil)
+	defer m.SetShutdown()
+
+	_, err := m.Query("x", nil, &memberlist.QueryParam{Timeout: time.Second})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	// 没有其他节点,查询还在队列中;发送时只带剩余的有效期
+	var q memberlist.QueryReq
+	found := false
+	for _, msg := range m.Broadcasts.GetBroadcasts(0, 65000) {
+		if msg[0] == byte(memberlist.QueryMsg) {
+			require.NoError(t, memberlist.Decode(msg[1:], &q))
+			found = true
+		}
+	}
+	require.True(t, found)
+	require.Equal(t, time.Second, q.Timeout)
+	require.True(t, q.TTL > 0 && q.TTL <= 900*time.Millisecond, "ttl %s", q.TTL)
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+// splitCluster 构造 node1,node2 与 node3 互相认为对方已经失败的状态,与网络分区后的结果相同
+func splitCluster(t *testing.T, reconnect time.Duration) []*memberlist.Members {
+	_, members, _ := newTestCluster(t, 3, func(c *memberlist.Config) {
+		c.ProbeInterval = time.Hour
+		c.PushPullInterval = 50 * time.Millisecond
+		c.GossipToTheDeadTime = time.Nanosecond
+		c.DeadNodeRetention = time.Hour
+		c.ReconnectInterval = reconnect
+	})
+	declare := func(m *memberlist.Members, name string) {
+		inc := nodeState(m, name).Incarnation
+		m.DeadNode(&memberlist.Dead{Node: name, Incarnation: inc, From: m.Config.Name})
+	}
+	declare(members[0], "node3")
+	declare(members[1], "node3")
+	declare(members[2], "node1")
+	declare(members[2], "node2")
+	require.Equal(t, 2, members[0].NumMembers())
+	require.Equal(t, 1, members[2].NumMembers())
+	return members
+}
+
+func TestReconnect_HealsPartition(t *testing.T) {
+	members := splitCluster(t, 20*time.Millisecond)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	retry(t, 100, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		for _, m := range members {
+			if got := m.NumMembers(); got != 3 {
+				failf("%s: expected 3 members, got %d", m.Config.Name, got)
+			}
+		}
+	})
+	require.Empty(t, members[0].Tombstones())
+}
+
+func TestReconnect_Disabled(t *testing.T) {
+	// 默认不重连
+	members := splitCluster(t, memberlist.DefaultLANConfig().ReconnectInterval)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, 2, members[0].NumMembers())
+	require.Equal(t, 1, members[2].NumMembers())
+}
+
+func TestReconnect_GiveUp(t *testing.T) {
+	_, members, _ := newTestCluster(t, 2, func(c *memberlist.Config) {
+		c.ProbeInterval = time.Hour
+		c.GossipToTheDeadTime = time.Nanosecond
+		c.DeadNodeRetention = time.Hour
+		c.ReconnectInterval = 20 * time.Millisecond
+		c.ReconnectTimeout = time.Nanosecond
+		c.PushPullInterval = 0
+	})
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+	inc := nodeState(members[0], "node2").Incarnation
+	members[0].DeadNode(&memberlist.Dead{Node: "node2", Incarnation: inc, From: "node1"})
+
+	// 超过 ReconnectTimeout 的节点不再尝试
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 1, members[0].NumMembers())
+}
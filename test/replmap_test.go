@@ -0,0 +1,301 @@
+package test
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/memberlist/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+type mapEvents struct {
+	sync.Mutex
+	events []memberlist.MapEvent
+}
+
+func (d *mapEvents) NotifyMapChange(e memberlist.MapEvent) {
+	d.Lock()
+	defer d.Unlock()
+	d.events = append(d.events, e)
+}
+
+func (d *mapEvents) get() []memberlist.MapEvent {
+	d.Lock()
+	defer d.Unlock()
+	return append([]memberlist.MapEvent(nil), d.events...)
+}
+
+// waitMap 等待所有节点上key的值为want,want为nil表示不存在
+func waitMap(t *testing.T, members []*memberlist.Members, key string, want []byte) {
+	retry(t, 100, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		for _, m := range members {
+			got, ok := m.ReplicatedMap().Get(key)
+			if want == nil && ok {
+				failf("%s: %s still present", m.Config.Name, key)
+			}
+			if want != nil && string(got) != string(want) {
+				failf("%s: %s=%q, want %q", m.Config.Name, key, got, want)
+			}
+		}
+	})
+}
+
+func TestReplicatedMap_Gossip(t *testing.T) {
+	events := []*mapEvents{{}, {}, {}}
+	i := 0
+	_, members, _ := newTestCluster(t, 3, func(c *memberlist.Config) {
+		c.MapEvents = events[i]
+		i++
+	})
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	require.NoError(t, members[0].ReplicatedMap().Set("k", []byte("v1")))
+	waitMap(t, members, "k", []byte("v1"))
+
+	require.NoError(t, members[1].ReplicatedMap().Set("k", []byte("v2")))
+	waitMap(t, members, "k", []byte("v2"))
+
+	require.NoError(t, members[2].ReplicatedMap().Delete("k"))
+	waitMap(t, members, "k", nil)
+	for _, m := range members {
+		require.Empty(t, m.ReplicatedMap().Keys())
+	}
+
+	for _, ev := range events {
+		got := ev.get()
+		require.Len(t, got, 3)
+		require.Equal(t, memberlist.MapEvent{Key: "k", Value: []byte("v1"), Node: "node1"}, got[0])
+		require.Equal(t, memberlist.MapEvent{Key: "k", Value: []byte("v2"), Old: []byte("v1"), Node: "node2"}, got[1])
+		require.Equal(t, memberlist.MapEvent{Key: "k", Old: []byte("v2"), Deleted: true, Node: "node3"}, got[2])
+	}
+}
+
+func TestReplicatedMap_Typed(t *testing.T) {
+	_, members, _ := newTestCluster(t, 2, nil)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	type config struct {
+		Replicas int
+		Zone     string
+	}
+	require.NoError(t, members[0].ReplicatedMap().SetValue("cfg", &config{3, "a"}))
+	retry(t, 100, 20*time.Millisecond, func(failf func(string, ...interface{})) {
+		var got config
+		ok, err := members[1].ReplicatedMap().GetValue("cfg", &got)
+		if err != nil || !ok || got != (config{3, "a"}) {
+			failf("got %v %v %v", got, ok, err)
+		}
+	})
+
+	var missing config
+	ok, err := members[1].ReplicatedMap().GetValue("nope", &missing)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.Error(t, members[0].ReplicatedMap().Set("big", make([]byte, 2000)))
+}
+
+func mapPartitionCluster(t *testing.T, ttl time.Duration) (*memberlist.MockNetwork, []*memberlist.Members) {
+	n, members, _ := newTestCluster(t, 3, func(c *memberlist.Config) {
+		// 分区期间不做故障检测,只依靠push/pull合并
+		c.ProbeInterval = time.Hour
+		c.PushPullInterval = 50 * time.Millisecond
+		c.TCPTimeout = 50 * time.Millisecond
+		c.RetransmitMult = 1
+		c.MapTombstoneTTL = ttl
+		c.MapTombstoneGCInterval = 0
+	})
+	return n, members
+}
+
+func TestReplicatedMap_ConvergeAfterPartition(t *testing.T) {
+	n, members := mapPartitionCluster(t, time.Hour)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	n.Partition([]string{"node1", "node2"}, []string{"node3"})
+	require.NoError(t, members[0].ReplicatedMap().Set("k", []byte("old")))
+	require.NoError(t, members[0].ReplicatedMap().Set("gone", []byte("x")))
+	require.NoError(t, members[0].ReplicatedMap().Delete("gone"))
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, members[2].ReplicatedMap().Set("k", []byte("new")))
+	require.NoError(t, members[2].ReplicatedMap().Set("only3", []byte("y")))
+	time.Sleep(200 * time.Millisecond)
+
+	n.Heal()
+	waitMap(t, members, "k", []byte("new"))
+	waitMap(t, members, "only3", []byte("y"))
+	waitMap(t, members, "gone", nil)
+}
+
+func TestReplicatedMap_TombstoneGC(t *testing.T) {
+	n, members := mapPartitionCluster(t, time.Millisecond)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	require.NoError(t, members[0].ReplicatedMap().Set("k", []byte("v")))
+	waitMap(t, members, "k", []byte("v"))
+
+	// node3 错过了删除,墓碑回收之后再合并,键会从node3复活
+	n.Partition([]string{"node1", "node2"}, []string{"node3"})
+	require.NoError(t, members[0].ReplicatedMap().Delete("k"))
+	waitMap(t, members[:2], "k", nil)
+
+	// 没有自动回收时push/pull不会删除墓碑
+	time.Sleep(100 * time.Millisecond)
+	waitMap(t, members[:2], "k", nil)
+	for _, m := range members[:2] {
+		require.Equal(t, 1, m.ReplicatedMap().CollectTombstones())
+	}
+	require.Equal(t, 0, members[2].ReplicatedMap().CollectTombstones())
+
+	n.Heal()
+	waitMap(t, members, "k", []byte("v"))
+}
+
+// rawPushPull 以 from 的身份按header发起一次push/pull,返回对方的头部和复制map项
+func rawPushPull(t *testing.T, n *memberlist.MockNetwork, from, to *memberlist.Members, header memberlist.PushPullHeader) (memberlist.PushPullHeader, []memberlist.MapEntry) {
+	conn, err := n.TransportsByName[from.Config.Name].DialTimeout(n.TransportsByName[to.Config.Name].Addr.String(), time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	header.Nodes = 1
+	buf := bytes.NewBuffer([]byte{byte(memberlist.PushPullMsg)})
+	enc := codec.NewEncoder(buf, &codec.MsgpackHandle{})
+	require.NoError(t, enc.Encode(&header))
+	require.NoError(t, enc.Encode(&memberlist.PushNodeState{
+		Name:        from.Config.Name,
+		Addr:        net.ParseIP("127.0.0.1"),
+		Port:        9999,
+		Incarnation: 1,
+		State:       memberlist.StateAlive,
+		Vsn:         from.Config.BuildVsnArray(),
+	}))
+	require.NoError(t, from.RawSendMsgStream(conn, buf.Bytes(), ""))
+
+	msgType, _, dec, err := from.ReadStream(conn, "")
+	require.NoError(t, err)
+	require.Equal(t, memberlist.PushPullMsg, msgType)
+	var resp memberlist.PushPullHeader
+	require.NoError(t, dec.Decode(&resp))
+	require.Zero(t, resp.UserStateLen)
+	for i := 0; i < resp.Nodes; i++ {
+		var s memberlist.PushNodeState
+		require.NoError(t, dec.Decode(&s))
+	}
+	for i := 0; i < resp.AppEntries; i++ {
+		var e memberlist.AppBroadcast
+		require.NoError(t, dec.Decode(&e))
+	}
+	entries := make([]memberlist.MapEntry, resp.MapEntries)
+	for i := range entries {
+		require.NoError(t, dec.Decode(&entries[i]))
+	}
+	return resp, entries
+}
+
+func TestReplicatedMap_PushPullDelta(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := newTestNode(t, n, "node1", nil)
+	defer m1.SetShutdown()
+	peer := newTestNode(t, n, "peer", nil)
+	defer peer.SetShutdown()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, m1.ReplicatedMap().Set(strconv.Itoa(i), []byte("v")))
+	}
+
+	// 没有发送摘要的对方不支持复制map,什么都收不到
+	resp, entries := rawPushPull(t, n, peer, m1, memberlist.PushPullHeader{})
+	require.Empty(t, entries)
+	require.NotEmpty(t, resp.MapDigest)
+
+	// 空的摘要与每个非空的桶都不同,对方得到全部的项
+	_, entries = rawPushPull(t, n, peer, m1, memberlist.PushPullHeader{MapDigest: make([]uint64, len(resp.MapDigest))})
+	require.Len(t, entries, 10)
+
+	// 摘要相同时什么都不发
+	resp, entries = rawPushPull(t, n, peer, m1, memberlist.PushPullHeader{MapDigest: resp.MapDigest})
+	require.Empty(t, entries)
+
+	// 只发送变化的桶
+	require.NoError(t, m1.ReplicatedMap().Set("3", []byte("w")))
+	_, entries = rawPushPull(t, n, peer, m1, memberlist.PushPullHeader{MapDigest: resp.MapDigest})
+	require.NotEmpty(t, entries)
+	require.True(t, len(entries) < 10, "got %d entries", len(entries))
+	found := false
+	for _, e := range entries {
+		if e.Key == "3" {
+			require.Equal(t, "w", string(e.Value))
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+func TestReplicatedMap_Disabled(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := newTestNode(t, n, "node1", func(c *memberlist.Config) {
+		c.EnableReplicatedMap = false
+		c.AppLogSize = 0
+	})
+	defer m1.SetShutdown()
+	peer := newTestNode(t, n, "peer", nil)
+	defer peer.SetShutdown()
+
+	require.Error(t, m1.ReplicatedMap().Set("k", []byte("v")))
+	require.NoError(t, peer.ReplicatedMap().Set("k", []byte("v")))
+	_, err := peer.BroadcastApp([]byte("a"))
+	require.NoError(t, err)
+
+	// 关闭的功能不会出现在头部里,对方的项也被忽略
+	resp, entries := rawPushPull(t, n, peer, m1, memberlist.PushPullHeader{MapDigest: make([]uint64, 64)})
+	require.Empty(t, entries)
+	require.Nil(t, resp.MapDigest)
+	require.False(t, resp.AppLog)
+	require.Nil(t, resp.AppVersions)
+
+	_, err = m1.Join([]string{"peer/" + peer.Config.Transport.(*memberlist.MockTransport).Addr.String()})
+	require.NoError(t, err)
+	_, ok := m1.ReplicatedMap().Get("k")
+	require.False(t, ok)
+}
+
+func TestReplicatedMap_MaxClockDrift(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	m1 := newTestNode(t, n, "node1", func(c *memberlist.Config) { c.MapMaxClockDrift = time.Second })
+	defer m1.SetShutdown()
+	peer := newTestNode(t, n, "peer", nil)
+	defer peer.SetShutdown()
+	to := pkg.Address{Addr: n.TransportsByName["node1"].Addr.String(), Name: "node1"}
+
+	send := func(key string, at time.Time) {
+		buf, err := memberlist.Encode(memberlist.MapMsg, &memberlist.MapEntry{
+			Key:   key,
+			Value: []byte("v"),
+			Time:  pkg.HLC{Wall: at.UnixNano()},
+			Node:  "peer",
+		})
+		require.NoError(t, err)
+		require.NoError(t, peer.RawSendMsgPacket(to, nil, buf.Bytes()))
+	}
+
+	// 超前一小时的写入被丢弃,不会推动本地时钟
+	send("future", time.Now().Add(time.Hour))
+	send("now", time.Now())
+	waitMap(t, []*memberlist.Members{m1}, "now", []byte("v"))
+	_, ok := m1.ReplicatedMap().Get("future")
+	require.False(t, ok)
+}
@@ -0,0 +1,178 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+type echoHandler struct {
+	grow int // 响应额外增加的字节数
+}
+
+func (h *echoHandler) HandleRequest(from string, payload []byte) ([]byte, error) {
+	if bytes.HasPrefix(payload, []byte("fail")) {
+		return nil, errors.New("boom")
+	}
+	out := append([]byte(from+":"), payload...)
+	return append(out, bytes.Repeat([]byte("x"), h.grow)...), nil
+}
+
+func requestPair(t *testing.T, handler memberlist.RequestHandler) (*memberlist.MockNetwork, *memberlist.Members, *memberlist.Members) {
+	n := &memberlist.MockNetwork{}
+	create := func(name string, h memberlist.RequestHandler) *memberlist.Members {
+		return newTestNode(t, n, name, func(c *memberlist.Config) {
+			c.Requests = h
+			c.TCPTimeout = time.Second
+		})
+	}
+	m1 := create("node1", handler)
+	m2 := create("node2", nil)
+	_, err := m2.Join([]string{seedOf(n, "node1")})
+	require.NoError(t, err)
+	return n, m1, m2
+}
+
+func nodeNamed(m *memberlist.Members, name string) *memberlist.Node {
+	for _, n := range m.Members() {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+func TestRequest_Packet(t *testing.T) {
+	_, m1, m2 := requestPair(t, &echoHandler{})
+	defer m1.SetShutdown()
+	defer m2.SetShutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := m2.Request(ctx, nodeNamed(m2, "node1"), []byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, "node2:hello", string(resp))
+
+	_, err = m2.Request(ctx, nodeNamed(m2, "node1"), []byte("fail"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "boom")
+
+	// 没有配置RequestHandler
+	_, err = m1.Request(ctx, nodeNamed(m1, "node2"), []byte("hello"))
+	require.Error(t, err)
+}
+
+func TestRequest_Stream(t *testing.T) {
+	_, m1, m2 := requestPair(t, &echoHandler{})
+	defer m1.SetShutdown()
+	defer m2.SetShutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	big := bytes.Repeat([]byte("a"), 64*1024)
+	resp, err := m2.Request(ctx, nodeNamed(m2, "node1"), big)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte("node2:"), big...), resp)
+
+	_, err = m2.Request(ctx, nodeNamed(m2, "node1"), append([]byte("fail"), big...))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "boom")
+}
+
+func TestRequest_LargeResponse(t *testing.T) {
+	// 小请求走UDP,放不进一个UDP包的响应通过TCP流发回
+	_, m1, m2 := requestPair(t, &echoHandler{grow: 16 * 1024})
+	defer m1.SetShutdown()
+	defer m2.SetShutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := m2.Request(ctx, nodeNamed(m2, "node1"), []byte("hi"))
+	require.NoError(t, err)
+	require.Len(t, resp, len("node2:hi")+16*1024)
+}
+
+func TestRequest_Timeout(t *testing.T) {
+	n, m1, m2 := requestPair(t, &echoHandler{})
+	defer m1.SetShutdown()
+	defer m2.SetShutdown()
+
+	node1 := nodeNamed(m2, "node1")
+	n.Block("node2", "node1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := m2.Request(ctx, node1, []byte("hello"))
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	_, err = m2.Request(ctx2, node1, bytes.Repeat([]byte("a"), 64*1024))
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestRequest_DefaultTimeout(t *testing.T) {
+	n, m1, m2 := requestPair(t, &echoHandler{})
+	defer m1.SetShutdown()
+	defer m2.SetShutdown()
+	m2.Config.RequestTimeout = 100 * time.Millisecond
+
+	node1 := nodeNamed(m2, "node1")
+	n.Block("node2", "node1")
+
+	// ctx没有超时也不会一直等待丢失的包
+	start := time.Now()
+	_, err := m2.Request(context.Background(), node1, []byte("hello"))
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < time.Second)
+}
+
+type requestFunc func(from string, payload []byte) ([]byte, error)
+
+func (f requestFunc) HandleRequest(from string, payload []byte) ([]byte, error) {
+	return f(from, payload)
+}
+
+func TestRequest_IgnoreOtherSender(t *testing.T) {
+	var m2 *memberlist.Members
+	var base uint32
+	spoof := func() {
+		// 伪造其他节点对所有可能ID的响应:名字不对、名字对但地址不对、来源未知
+		other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 9), Port: 7946}
+		for id := base; id < base+100; id++ {
+			for _, c := range []struct {
+				name string
+				from net.Addr
+			}{{"node3", other}, {"node1", other}, {"node1", nil}} {
+				buf := bytes.NewBuffer([]byte{byte(memberlist.ResponseMsg)})
+				h := memberlist.RequestHeader{ID: id, Len: 5, SourceNode: c.name}
+				require.NoError(t, codec.NewEncoder(buf, &codec.MsgpackHandle{}).Encode(&h))
+				buf.WriteString("spoof")
+				m2.HandleCommand(buf.Bytes(), c.from, time.Now())
+			}
+		}
+	}
+	handler := requestFunc(func(from string, payload []byte) ([]byte, error) {
+		spoof()
+		time.Sleep(50 * time.Millisecond)
+		return []byte("real"), nil
+	})
+	_, m1, mm2 := requestPair(t, handler)
+	m2 = mm2
+	defer m1.SetShutdown()
+	defer m2.SetShutdown()
+
+	base = m2.NextSeqNo()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := m2.Request(ctx, nodeNamed(m2, "node1"), []byte("hi"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("real"), resp)
+}
@@ -0,0 +1,61 @@
+package test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemberList_ResolveAddr_SRV(t *testing.T) {
+	var queries int32
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		q := req.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		if q.Qtype == dns.TypeSRV && q.Name == "_memberlist._tcp.example.test." {
+			resp.Answer = []dns.RR{&dns.SRV{
+				Hdr:      dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 60},
+				Priority: 10, Weight: 1, Port: 7946, Target: "a.example.test.",
+			}}
+			resp.Extra = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: "a.example.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 0, 1),
+			}}
+		}
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	m := GetMemberlist(t, func(c *memberlist.Config) {
+		c.DNSServer = l.Addr().String()
+	})
+	defer m.SetShutdown()
+
+	for i := 0; i < 2; i++ {
+		ips, err := m.ResolveAddr("srv://_memberlist._tcp.example.test")
+		require.NoError(t, err)
+		require.Len(t, ips, 1)
+		require.Equal(t, "10.0.0.1", ips[0].IP.String())
+		require.Equal(t, uint16(7946), ips[0].Port)
+	}
+	// 第二次使用缓存
+	require.Equal(t, int32(1), atomic.LoadInt32(&queries))
+
+	_, err = m.ResolveAddr("srv://")
+	require.Error(t, err)
+
+	// SRV种子不能指定节点名
+	_, err = m.ResolveAddr("node1/srv://_memberlist._tcp.example.test")
+	require.Error(t, err)
+	_, err = m.ResolveAddr("srv://node1/_memberlist._tcp.example.test")
+	require.Error(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&queries))
+}
@@ -0,0 +1,117 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTombstones_Retention(t *testing.T) {
+	ch := make(chan memberlist.NodeEvent, 16)
+	m := GetMemberlist(t, func(c *memberlist.Config) {
+		c.Events = &memberlist.ChannelEventDelegate{Ch: ch, Reap: true}
+		c.DeadNodeRetention = 50 * time.Millisecond
+		c.LeftNodeRetention = time.Hour
+	})
+	defer m.SetShutdown()
+
+	for i, name := range []string{"failed", "left", "alive"} {
+		a := memberlist.Alive{Node: name, Addr: []byte{127, 0, 0, byte(i + 1)}, Incarnation: 1, Vsn: m.Config.BuildVsnArray()}
+		m.AliveNode(&a, nil, false)
+	}
+	m.DeadNode(&memberlist.Dead{Node: "failed", Incarnation: 1, From: "alive"})
+	m.DeadNode(&memberlist.Dead{Node: "left", Incarnation: 1, From: "left"})
+
+	ts := m.Tombstones()
+	require.Len(t, ts, 2)
+	require.Equal(t, "failed", ts[0].Node.Name)
+	require.Equal(t, memberlist.StateDead, ts[0].State)
+	require.Equal(t, "alive", ts[0].DeclaredBy)
+	require.Equal(t, "left", ts[1].Node.Name)
+	require.Equal(t, memberlist.StateLeft, ts[1].State)
+	require.Equal(t, "left", ts[1].DeclaredBy)
+	require.False(t, ts[1].DiedAt.Before(ts[0].DiedAt))
+
+	// 还没到保留时间
+	m.ResetNodes()
+	require.Len(t, m.Tombstones(), 2)
+
+	time.Sleep(100 * time.Millisecond)
+	m.ResetNodes()
+	ts = m.Tombstones()
+	require.Len(t, ts, 1)
+	require.Equal(t, "left", ts[0].Node.Name)
+	require.Len(t, m.Nodes, 2)
+	_, ok := m.NodeMap["failed"]
+	require.False(t, ok)
+
+	var reaped []string
+	for len(ch) > 0 {
+		if e := <-ch; e.Event == memberlist.NodeReap {
+			reaped = append(reaped, e.Node.Name)
+		}
+	}
+	require.Equal(t, []string{"failed"}, reaped)
+}
+
+func TestTombstones_ReapOutsideLock(t *testing.T) {
+	for _, reap := range []bool{false, true} {
+		ch := make(chan memberlist.NodeEvent)
+		m := GetMemberlist(t, func(c *memberlist.Config) {
+			c.Events = &memberlist.ChannelEventDelegate{Ch: ch, Reap: reap}
+			c.DeadNodeRetention = time.Millisecond
+		})
+
+		a := memberlist.Alive{Node: "failed", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.Config.BuildVsnArray()}
+		go m.AliveNode(&a, nil, false)
+		require.Equal(t, memberlist.NodeJoin, (<-ch).Event)
+		go m.DeadNode(&memberlist.Dead{Node: "failed", Incarnation: 1, From: "other"})
+		require.Equal(t, memberlist.NodeLeave, (<-ch).Event)
+		time.Sleep(10 * time.Millisecond)
+
+		done := make(chan struct{})
+		go func() {
+			m.ResetNodes()
+			close(done)
+		}()
+		if reap {
+			// 没有人读取事件时 ResetNodes 阻塞,但不能持有 NodeLock
+			time.Sleep(20 * time.Millisecond)
+			locked := make(chan struct{})
+			go func() {
+				m.NodeLock.Lock()
+				m.NodeLock.Unlock()
+				close(locked)
+			}()
+			select {
+			case <-locked:
+			case <-time.After(time.Second):
+				t.Fatalf("NodeLock held while sending the reap event")
+			}
+			require.Equal(t, memberlist.NodeReap, (<-ch).Event)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("ResetNodes blocked, reap=%v", reap)
+		}
+		m.SetShutdown()
+	}
+}
+
+func TestTombstones_ClearedOnRejoin(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.SetShutdown()
+
+	a := memberlist.Alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.Config.BuildVsnArray()}
+	m.AliveNode(&a, nil, false)
+	m.DeadNode(&memberlist.Dead{Node: "test", Incarnation: 1, From: "other"})
+	require.Len(t, m.Tombstones(), 1)
+
+	a.Incarnation = 2
+	m.AliveNode(&a, nil, false)
+	require.Empty(t, m.Tombstones())
+	require.Empty(t, m.NodeMap["test"].DeclaredBy)
+}
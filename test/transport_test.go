@@ -204,3 +204,167 @@ func TestTransport_TcpListenBackoff(t *testing.T) {
 	// no connections should have been accepted and sent to the channel
 	require.Equal(t, len(Transport.StreamCh), 0)
 }
+
+// recvPacket reads one packet from t, or returns nil after the timeout.
+func recvPacket(t *memberlist.MockTransport, timeout time.Duration) *memberlist.Packet {
+	select {
+	case p := <-t.PacketCh():
+		return p
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestMockNetwork_BlockAsymmetric(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	t1 := n.NewTransport("node1")
+	t2 := n.NewTransport("node2")
+
+	n.Block("node1", "node2")
+
+	// Dropped packets are not an error, like UDP.
+	_, err := t1.WriteTo([]byte("hi"), t2.Addr.String())
+	require.NoError(t, err)
+	require.Nil(t, recvPacket(t2, 50*time.Millisecond))
+
+	// The other direction still works.
+	go t2.WriteTo([]byte("hello"), t1.Addr.String())
+	p := recvPacket(t1, time.Second)
+	require.NotNil(t, p)
+	require.Equal(t, []byte("hello"), p.Buf)
+
+	// A stream needs both directions.
+	_, err = t2.DialTimeout(t1.Addr.String(), 10*time.Millisecond)
+	require.Error(t, err)
+
+	n.Unblock("node1", "node2")
+	require.Equal(t, memberlist.MockLink{}, n.Link("node1", "node2"))
+	go t1.WriteTo([]byte("back"), t2.Addr.String())
+	require.NotNil(t, recvPacket(t2, time.Second))
+}
+
+func TestMockNetwork_DropRate(t *testing.T) {
+	n := &memberlist.MockNetwork{Seed: 1}
+	t1 := n.NewTransport("node1")
+	t2 := n.NewTransport("node2")
+	n.SetLink("node1", "node2", memberlist.MockLink{DropRate: 0.5})
+
+	var got int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for recvPacket(t2, 100*time.Millisecond) != nil {
+			atomic.AddInt32(&got, 1)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		_, err := t1.WriteTo([]byte("x"), t2.Addr.String())
+		require.NoError(t, err)
+	}
+	<-done
+
+	require.True(t, got > 50 && got < 150, "got %d", got)
+}
+
+func TestMockNetwork_DelayAndDialFail(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	t1 := n.NewTransport("node1")
+	t2 := n.NewTransport("node2")
+	n.SetLinkBoth("node1", "node2", memberlist.MockLink{Delay: 50 * time.Millisecond})
+
+	start := time.Now()
+	_, err := t1.WriteTo([]byte("slow"), t2.Addr.String())
+	require.NoError(t, err)
+	p := recvPacket(t2, time.Second)
+	require.NotNil(t, p)
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// The round trip doesn't fit in the dial timeout.
+	_, err = t1.DialTimeout(t2.Addr.String(), 20*time.Millisecond)
+	require.Error(t, err)
+
+	n.SetLink("node1", "node2", memberlist.MockLink{DialFail: true})
+	_, err = t1.DialTimeout(t2.Addr.String(), time.Second)
+	require.Error(t, err)
+	go t1.WriteTo([]byte("still"), t2.Addr.String())
+	require.NotNil(t, recvPacket(t2, time.Second))
+}
+
+func TestMockNetwork_DefaultLinkJitter(t *testing.T) {
+	n := &memberlist.MockNetwork{Seed: 1}
+	t1 := n.NewTransport("node1")
+	t2 := n.NewTransport("node2")
+	def := memberlist.MockLink{Delay: 20 * time.Millisecond, Jitter: 30 * time.Millisecond}
+	n.SetDefaultLink(def)
+	require.Equal(t, def, n.Link("node1", "node2"))
+
+	start := time.Now()
+	_, err := t1.WriteTo([]byte("slow"), t2.Addr.String())
+	require.NoError(t, err)
+	require.NotNil(t, recvPacket(t2, time.Second))
+	elapsed := time.Since(start)
+	require.True(t, elapsed >= 20*time.Millisecond, "elapsed %s", elapsed)
+
+	// Blocking keeps the default delay, unblocking goes back to the default.
+	n.Block("node1", "node2")
+	require.Equal(t, 20*time.Millisecond, n.Link("node1", "node2").Delay)
+	_, err = t1.WriteTo([]byte("lost"), t2.Addr.String())
+	require.NoError(t, err)
+	require.Nil(t, recvPacket(t2, 100*time.Millisecond))
+	n.Unblock("node1", "node2")
+	require.Equal(t, def, n.Link("node1", "node2"))
+
+	n.Heal()
+	require.Equal(t, def, n.Link("node1", "node2"))
+}
+
+func TestMockNetwork_SendAfterShutdown(t *testing.T) {
+	n := &memberlist.MockNetwork{}
+	t1 := n.NewTransport("node1")
+	t2 := n.NewTransport("node2")
+
+	// Nobody reads from node2, fill its buffer and shut it down.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			t1.WriteTo([]byte("x"), t2.Addr.String())
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, t2.SetShutdown())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("sender blocked after shutdown")
+	}
+}
+
+func TestMockNetwork_SplitBrain(t *testing.T) {
+	n, members, _ := newTestCluster(t, 4, func(c *memberlist.Config) {
+		c.ProbeInterval = 100 * time.Millisecond
+		c.ProbeTimeout = 50 * time.Millisecond
+		c.GossipInterval = 20 * time.Millisecond
+		c.SuspicionMult = 1
+		c.TCPTimeout = 100 * time.Millisecond
+	})
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	n.Partition([]string{"node1", "node2"}, []string{"node3", "node4"})
+	require.True(t, n.Link("node1", "node3").Blocked)
+	require.True(t, n.Link("node4", "node2").Blocked)
+	require.False(t, n.Link("node1", "node2").Blocked)
+
+	retry(t, 50, 100*time.Millisecond, func(failf func(string, ...interface{})) {
+		for _, m := range members {
+			if num := m.NumMembers(); num != 2 {
+				failf("expected 2 members, got %d", num)
+			}
+		}
+	})
+
+	n.Heal()
+	require.Equal(t, memberlist.MockLink{}, n.Link("node1", "node3"))
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/require"
+)
+
+func eventCluster(t *testing.T, num int, conf func(c *memberlist.Config)) ([]*memberlist.Members, []chan memberlist.UserEvent) {
+	var chs []chan memberlist.UserEvent
+	_, members, _ := newTestCluster(t, num, func(c *memberlist.Config) {
+		ch := make(chan memberlist.UserEvent, 64)
+		c.UserEventCh = ch
+		chs = append(chs, ch)
+		if conf != nil {
+			conf(c)
+		}
+	})
+	return members, chs
+}
+
+// drainEvents 读取通道中的事件直到一段时间内没有新的事件
+func drainEvents(ch chan memberlist.UserEvent, quiet time.Duration) []memberlist.UserEvent {
+	var out []memberlist.UserEvent
+	for {
+		select {
+		case e := <-ch:
+			out = append(out, e)
+		case <-time.After(quiet):
+			return out
+		}
+	}
+}
+
+func TestUserEvent_DeliveredOnce(t *testing.T) {
+	members, chs := eventCluster(t, 3, nil)
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	require.NoError(t, members[0].UserEvent("deploy", []byte("v1"), false))
+	require.NoError(t, members[1].UserEvent("deploy", []byte("v2"), false))
+
+	for i, ch := range chs {
+		events := drainEvents(ch, 300*time.Millisecond)
+		require.Len(t, events, 2, "node%d", i+1)
+		payloads := map[string]bool{}
+		for _, e := range events {
+			require.Equal(t, "deploy", e.Name)
+			payloads[string(e.Payload)] = true
+		}
+		require.True(t, payloads["v1"] && payloads["v2"], "node%d", i+1)
+	}
+
+	// 其他节点见证了事件的逻辑时间
+	for _, m := range members {
+		require.True(t, m.UserEventTime() >= 1)
+	}
+}
+
+func TestUserEvent_Coalesce(t *testing.T) {
+	members, chs := eventCluster(t, 2, func(c *memberlist.Config) {
+		c.UserEventCoalescePeriod = 200 * time.Millisecond
+	})
+	for _, m := range members {
+		defer m.SetShutdown()
+	}
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, members[0].UserEvent("config", []byte(strconv.Itoa(i)), true))
+	}
+	require.NoError(t, members[0].UserEvent("other", []byte("x"), false))
+
+	for i, ch := range chs {
+		events := drainEvents(ch, 500*time.Millisecond)
+		var last []byte
+		numConfig := 0
+		numOther := 0
+		for _, e := range events {
+			switch e.Name {
+			case "config":
+				numConfig++
+				last = e.Payload
+			case "other":
+				numOther++
+			}
+		}
+		require.Equal(t, 1, numConfig, "node%d", i+1)
+		require.Equal(t, "4", string(last), "node%d", i+1)
+		require.Equal(t, 1, numOther, "node%d", i+1)
+	}
+}
+
+func TestUserEvent_SizeLimit(t *testing.T) {
+	m := newTestNode(t, &memberlist.MockNetwork{}, "node1", nil)
+	defer m.SetShutdown()
+
+	require.Error(t, m.UserEvent("big", make([]byte, 1024), false))
+	require.NoError(t, m.UserEvent("small", []byte("ok"), false))
+}
+
+func TestUserEvent_UnblockOnShutdown(t *testing.T) {
+	members, _ := eventCluster(t, 1, func(c *memberlist.Config) {
+		c.UserEventCh = make(chan memberlist.UserEvent)
+	})
+
+	// 没有人读取 UserEventCh
+	done := make(chan error, 1)
+	go func() { done <- members[0].UserEvent("deploy", nil, false) }()
+	time.Sleep(20 * time.Millisecond)
+	members[0].SetShutdown()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("user event delivery still blocked after shutdown")
+	}
+}
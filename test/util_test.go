@@ -57,7 +57,7 @@ func TestEncodeDecode(t *testing.T) {
 func TestRandomOffset(t *testing.T) {
 	vals := make(map[int]struct{})
 	for i := 0; i < 100; i++ {
-		offset := memberlist.RandomOffset(2 << 30)
+		offset := memberlist.RandomOffset(1 << 30)
 		if _, ok := vals[offset]; ok {
 			t.Fatalf("got collision")
 		}
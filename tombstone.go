@@ -0,0 +1,85 @@
+package memberlist
+
+import (
+	"sort"
+	"time"
+)
+
+// Tombstone 已经死亡或离开、但仍保留在节点列表中的节点
+type Tombstone struct {
+	Node        Node
+	State       NodeStateType // StateDead 或 StateLeft
+	Incarnation uint32
+	DiedAt      time.Time // 进入死亡/离开状态的时间
+	DeclaredBy  string    // 宣布死亡的节点;主动离开时是节点自己
+}
+
+// ReapEventDelegate Config.Events 可以额外实现这个接口,在墓碑被移除时收到通知
+type ReapEventDelegate interface {
+	// NotifyReap 节点的墓碑超过保留时间被移除,之后这个名字就被完全遗忘了
+	NotifyReap(t *Tombstone)
+}
+
+func (n *NodeState) tombstone() Tombstone {
+	return Tombstone{
+		Node:        n.Node,
+		State:       n.State,
+		Incarnation: n.Incarnation,
+		DiedAt:      n.StateChange,
+		DeclaredBy:  n.DeclaredBy,
+	}
+}
+
+// Tombstones 返回当前保留的墓碑,按死亡时间排序
+func (m *Members) Tombstones() []Tombstone {
+	m.NodeLock.RLock()
+	defer m.NodeLock.RUnlock()
+
+	var out []Tombstone
+	for _, n := range m.Nodes {
+		if n.DeadOrLeft() {
+			out = append(out, n.tombstone())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].DiedAt.Before(out[j].DiedAt)
+	})
+	return out
+}
+
+// tombstoneRetention 返回失败和离开节点的墓碑保留时间,未设置时使用 GossipToTheDeadTime
+func (c *Config) tombstoneRetention() (dead, left time.Duration) {
+	dead, left = c.DeadNodeRetention, c.LeftNodeRetention
+	if dead == 0 {
+		dead = c.GossipToTheDeadTime
+	}
+	if left == 0 {
+		left = c.GossipToTheDeadTime
+	}
+	return dead, left
+}
+
+// moveTombstones 与 MoveDeadNodes 相同,但失败与离开的节点使用各自的保留时间
+func moveTombstones(nodes []*NodeState, dead, left time.Duration) int {
+	numDead := 0
+	n := len(nodes)
+	for i := 0; i < n-numDead; i++ {
+		if !nodes[i].DeadOrLeft() {
+			continue
+		}
+
+		retention := dead
+		if nodes[i].State == StateLeft {
+			retention = left
+		}
+		if time.Since(nodes[i].StateChange) <= retention {
+			continue
+		}
+
+		// 将节点移至最后
+		nodes[i], nodes[n-numDead-1] = nodes[n-numDead-1], nodes[i]
+		numDead++
+		i--
+	}
+	return n - numDead
+}
@@ -0,0 +1,214 @@
+package memberlist
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist/broadcast_tree"
+	"github.com/hashicorp/memberlist/pkg"
+)
+
+// UserEvent 通过gossip传播的用户事件
+type UserEvent struct {
+	LTime    pkg.LamportTime
+	Name     string
+	Payload  []byte
+	Coalesce bool
+}
+
+// userEventKey 同一个逻辑时间内区分不同事件
+type userEventKey struct {
+	name string
+	hash uint64
+}
+
+// userEventSlot 最近事件缓冲区中的一格,保存同一个逻辑时间的事件
+type userEventSlot struct {
+	ltime  pkg.LamportTime
+	events map[userEventKey]struct{}
+}
+
+// userEventBroadcast 可合并的事件以名字作为广播名,队列中同名的旧事件会被新事件替换
+type userEventBroadcast struct {
+	name string
+	msg  []byte
+}
+
+func (b *userEventBroadcast) Invalidates(other broadcast_tree.Broadcast) bool {
+	return false
+}
+
+func (b *userEventBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *userEventBroadcast) Finished() {}
+
+type namedUserEventBroadcast struct {
+	userEventBroadcast
+}
+
+func (b *namedUserEventBroadcast) Name() string {
+	return "userevent:" + b.name
+}
+
+type uniqueUserEventBroadcast struct {
+	userEventBroadcast
+}
+
+func (b *uniqueUserEventBroadcast) UniqueBroadcast() {}
+
+// userEvents 用户事件的时钟、去重缓冲区以及合并
+type userEvents struct {
+	clock pkg.LamportClock
+
+	lock   sync.Mutex
+	buffer []*userEventSlot
+
+	coalesceLock sync.Mutex
+	pending      map[string]UserEvent // 等待合并投递的事件,名字 -> 最新的事件
+}
+
+func newUserEvents(size int) *userEvents {
+	if size <= 0 {
+		size = 1
+	}
+	return &userEvents{
+		buffer:  make([]*userEventSlot, size),
+		pending: make(map[string]UserEvent),
+	}
+}
+
+// record 记录事件,返回false表示事件重复或者已经太旧
+func (u *userEvents) record(e *UserEvent) bool {
+	u.clock.Witness(e.LTime)
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	size := pkg.LamportTime(len(u.buffer))
+	if cur := u.clock.Time(); cur > size && e.LTime < cur-size {
+		return false
+	}
+
+	h := fnv.New64a()
+	h.Write(e.Payload)
+	key := userEventKey{e.Name, h.Sum64()}
+
+	idx := e.LTime % size
+	slot := u.buffer[idx]
+	if slot == nil || slot.ltime != e.LTime {
+		slot = &userEventSlot{ltime: e.LTime, events: make(map[userEventKey]struct{})}
+		u.buffer[idx] = slot
+	}
+	if _, ok := slot.events[key]; ok {
+		return false
+	}
+	slot.events[key] = struct{}{}
+	return true
+}
+
+// UserEventTime 返回用户事件的Lamport时钟
+func (m *Members) UserEventTime() pkg.LamportTime {
+	return m.userEvents.clock.Time()
+}
+
+// UserEvent 向集群广播一个用户事件。coalesce为true时,队列中还没有发送完的同名事件会被替换,
+// 接收方也会在 UserEventCoalescePeriod 内只投递同名事件中最新的一个
+func (m *Members) UserEvent(name string, payload []byte, coalesce bool) error {
+	e := UserEvent{
+		LTime:    m.userEvents.clock.Time(),
+		Name:     name,
+		Payload:  payload,
+		Coalesce: coalesce,
+	}
+	m.userEvents.clock.Increment()
+
+	buf, err := Encode(UserEventMsg, &e)
+	if err != nil {
+		return err
+	}
+	if limit := m.Config.UserEventSizeLimit; limit > 0 && buf.Len() > limit {
+		return fmt.Errorf("用户事件太大 (%d > %d)", buf.Len(), limit)
+	}
+
+	// 本节点也会收到自己的事件
+	if m.userEvents.record(&e) {
+		m.queueUserEvent(&e, buf.Bytes())
+		m.deliverUserEvent(e)
+	}
+	return nil
+}
+
+func (m *Members) queueUserEvent(e *UserEvent, msg []byte) {
+	b := userEventBroadcast{name: e.Name, msg: msg}
+	if e.Coalesce {
+		m.Broadcasts.QueueBroadcast(&namedUserEventBroadcast{b})
+	} else {
+		m.Broadcasts.QueueBroadcast(&uniqueUserEventBroadcast{b})
+	}
+}
+
+// handleUserEvent 处理gossip收到的用户事件:去重、继续传播、投递
+func (m *Members) handleUserEvent(buf []byte, from net.Addr) {
+	var e UserEvent
+	if err := Decode(buf, &e); err != nil {
+		m.Logger.Printf("[错误] memberlist: 解码用户事件失败: %s %s", err, pkg.LogAddress(from))
+		return
+	}
+	if !m.userEvents.record(&e) {
+		return
+	}
+
+	msg := make([]byte, 1, len(buf)+1)
+	msg[0] = byte(UserEventMsg)
+	msg = append(msg, buf...)
+	m.queueUserEvent(&e, msg)
+	m.deliverUserEvent(e)
+}
+
+// deliverUserEvent 投递到 UserEventCh,与 ChannelEventDelegate 一样会阻塞到事件被取走或者节点停止
+func (m *Members) deliverUserEvent(e UserEvent) {
+	ch := m.Config.UserEventCh
+	if ch == nil {
+		return
+	}
+	period := m.Config.UserEventCoalescePeriod
+	if !e.Coalesce || period <= 0 {
+		select {
+		case ch <- e:
+		case <-m.ShutdownCh:
+		}
+		return
+	}
+
+	u := m.userEvents
+	u.coalesceLock.Lock()
+	defer u.coalesceLock.Unlock()
+	prev, ok := u.pending[e.Name]
+	if !ok {
+		time.AfterFunc(period, func() { m.flushUserEvent(e.Name) })
+	}
+	if !ok || e.LTime >= prev.LTime {
+		u.pending[e.Name] = e
+	}
+}
+
+// flushUserEvent 投递合并期内同名事件中最新的一个
+func (m *Members) flushUserEvent(name string) {
+	u := m.userEvents
+	u.coalesceLock.Lock()
+	e, ok := u.pending[name]
+	delete(u.pending, name)
+	u.coalesceLock.Unlock()
+
+	if ok {
+		select {
+		case m.Config.UserEventCh <- e:
+		case <-m.ShutdownCh:
+		}
+	}
+}